@@ -5,6 +5,7 @@
 package archiver
 
 import (
+	"container/heap"
 	"errors"
 	"fmt"
 	"io"
@@ -14,10 +15,12 @@ import (
 	"time"
 
 	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/internal/lhttp"
 	"github.com/luci/luci-go/client/internal/progress"
 	"github.com/luci/luci-go/client/internal/tracer"
 	"github.com/luci/luci-go/client/isolatedclient"
 	"github.com/luci/luci-go/common/isolated"
+	"golang.org/x/net/context"
 )
 
 const (
@@ -119,7 +122,10 @@ func (s *Stats) deepCopy() *Stats {
 }
 
 // New returns a thread-safe Archiver instance.
-func New(is isolatedclient.IsolateServer, out io.Writer) Archiver {
+//
+// ctx is used for all the requests to the server. The Archiver is canceled
+// when ctx is canceled.
+func New(ctx context.Context, is isolatedclient.IsolateServer, out io.Writer) Archiver {
 	// TODO(maruel): Cache hashes and server cache presence.
 	a := &archiver{
 		canceler:              common.NewCanceler(),
@@ -136,6 +142,15 @@ func New(is isolatedclient.IsolateServer, out io.Writer) Archiver {
 		stage4UploadChan:      make(chan *archiverItem),
 	}
 	tracer.NewPID(a, "archiver")
+	// a.ctx is canceled when the archiver is canceled or closed, aborting
+	// in-flight requests.
+	a.ctx, a.cancelCtx = common.CancelerContext(ctx, a.canceler)
+	go func() {
+		<-a.ctx.Done()
+		if err := ctx.Err(); err != nil {
+			a.Cancel(err)
+		}
+	}()
 
 	a.wg.Add(1)
 	go func() {
@@ -312,6 +327,8 @@ func (i *archiverItem) link(child *archiverItem) {
 type archiver struct {
 	// Immutable.
 	is                    isolatedclient.IsolateServer
+	ctx                   context.Context
+	cancelCtx             context.CancelFunc
 	maxConcurrentHash     int           // Stage 2; Disk I/O bound.
 	maxConcurrentContains int           // Stage 3; Server overload due to parallelism (DDoS).
 	maxConcurrentUpload   int           // Stage 4; Network I/O bound.
@@ -326,6 +343,8 @@ type archiver struct {
 	canceler              common.Canceler
 	progress              progress.Progress
 
+	dirCache dirCache // Shared by all PushDirectory() calls; has its own lock.
+
 	// Mutable.
 	statsLock sync.Mutex
 	stats     Stats
@@ -350,6 +369,7 @@ func (a *archiver) Close() error {
 	a.wg.Wait()
 	_ = a.progress.Close()
 	_ = a.canceler.Close()
+	a.cancelCtx()
 	err := a.CancelationReason()
 	tracer.Instant(a, "done", tracer.Global, nil)
 	return err
@@ -563,15 +583,71 @@ func (a *archiver) stage3LookupLoop() {
 }
 
 func (a *archiver) stage4UploadLoop() {
-	pool := common.NewGoroutinePool(a.maxConcurrentUpload, a.canceler)
-	defer func() {
-		_ = pool.Wait()
-	}()
-	for state := range a.stage4UploadChan {
-		item := state
-		pool.Schedule(func() {
-			a.doUpload(item)
-		}, nil)
+	// Items are not uploaded in the order they are received. The pending items
+	// are kept in a priority queue so that .isolated files and small files are
+	// uploaded first; this reduces the time until the first .isolated is usable
+	// and reduces the odds of small files being stuck behind large blobs.
+	work := make(chan *archiverItem)
+	var wg sync.WaitGroup
+	for i := 0; i < a.maxConcurrentUpload; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range work {
+				if err := a.CancelationReason(); err != nil {
+					item.setErr(err)
+					item.Close()
+					continue
+				}
+				a.doUpload(item)
+			}
+		}()
+	}
+	queue := &uploadQueue{}
+	c := a.stage4UploadChan
+	for c != nil || queue.Len() != 0 {
+		// Sending to a nil channel blocks forever, which disables this case when
+		// the queue is empty.
+		var out chan<- *archiverItem
+		var next *archiverItem
+		if queue.Len() != 0 {
+			out = work
+			next = (*queue)[0]
+		}
+		select {
+		case item, ok := <-c:
+			if !ok {
+				c = nil
+				break
+			}
+			heap.Push(queue, item)
+		case out <- next:
+			heap.Pop(queue)
+		}
+	}
+	close(work)
+	wg.Wait()
+}
+
+// waitHealthy pauses until the server may be contacted again if err is a
+// *lhttp.CircuitOpenError. It returns true if the call that returned err should
+// be retried.
+//
+// This permits to pause the archival while the server is unhealthy instead of
+// canceling it.
+func (a *archiver) waitHealthy(err error) bool {
+	e, ok := err.(*lhttp.CircuitOpenError)
+	if !ok {
+		return false
+	}
+	d := e.RetryAt.Sub(time.Now())
+	tracer.Instant(a, "paused", tracer.Thread, tracer.Args{"host": e.Host, "duration": d})
+	log.Printf("%s is unhealthy; pausing for %s", e.Host, d)
+	select {
+	case <-time.After(d):
+		return true
+	case <-a.ctx.Done():
+		return false
 	}
 }
 
@@ -583,7 +659,13 @@ func (a *archiver) doContains(items []*archiverItem) {
 	for i, item := range items {
 		tmp[i] = &item.digestItem
 	}
-	states, err := a.is.Contains(tmp)
+	var states []*isolatedclient.PushState
+	var err error
+	for {
+		if states, err = a.is.Contains(a.ctx, tmp); !a.waitHealthy(err) {
+			break
+		}
+	}
 	if err != nil {
 		err = fmt.Errorf("contains(%d) failed: %s", len(items), err)
 		a.Cancel(err)
@@ -612,7 +694,7 @@ func (a *archiver) doContains(items []*archiverItem) {
 
 // doUpload is called by stage 4.
 func (a *archiver) doUpload(item *archiverItem) {
-	var src io.Reader
+	var src io.ReadSeeker
 	if item.src == nil {
 		f, err := os.Open(item.path)
 		if err != nil {
@@ -628,7 +710,17 @@ func (a *archiver) doUpload(item *archiverItem) {
 		item.src = nil
 	}
 	start := time.Now()
-	if err := a.is.Push(item.state, src); err != nil {
+	var err error
+	for {
+		if err = a.is.Push(a.ctx, item.state, src); !a.waitHealthy(err) {
+			break
+		}
+		// The failed attempt may have consumed part of src.
+		if _, err = src.Seek(0, os.SEEK_SET); err != nil {
+			break
+		}
+	}
+	if err != nil {
 		err = fmt.Errorf("push(%s) failed: %s\n", item.path, err)
 		a.Cancel(err)
 		item.setErr(err)
@@ -644,3 +736,37 @@ func (a *archiver) doUpload(item *archiverItem) {
 	a.statsLock.Unlock()
 	log.Printf("Uploaded %7s: %s\n", size, item.DisplayName())
 }
+
+// uploadQueue is a priority queue of items to upload. It implements
+// heap.Interface.
+//
+// In-memory items, which are the generated .isolated files, are uploaded
+// first, then items are uploaded from the smallest to the largest.
+type uploadQueue []*archiverItem
+
+func (u uploadQueue) Len() int {
+	return len(u)
+}
+
+func (u uploadQueue) Less(i, j int) bool {
+	if iMem, jMem := u[i].path == "", u[j].path == ""; iMem != jMem {
+		return iMem
+	}
+	return u[i].digestItem.Size < u[j].digestItem.Size
+}
+
+func (u uploadQueue) Swap(i, j int) {
+	u[i], u[j] = u[j], u[i]
+}
+
+func (u *uploadQueue) Push(x interface{}) {
+	*u = append(*u, x.(*archiverItem))
+}
+
+func (u *uploadQueue) Pop() interface{} {
+	old := *u
+	n := len(old)
+	item := old[n-1]
+	*u = old[:n-1]
+	return item
+}
@@ -6,19 +6,25 @@ package archiver
 
 import (
 	"bytes"
+	"container/heap"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/internal/lhttp"
 	"github.com/luci/luci-go/client/isolatedclient"
 	"github.com/luci/luci-go/client/isolatedclient/isolatedfake"
 	"github.com/luci/luci-go/common/isolated"
 	"github.com/maruel/ut"
+	"golang.org/x/net/context"
 )
 
 func init() {
@@ -27,7 +33,7 @@ func init() {
 
 func TestArchiverEmpty(t *testing.T) {
 	t.Parallel()
-	a := New(isolatedclient.New("https://localhost:1", "default-gzip"), nil)
+	a := New(context.Background(), isolatedclient.New(nil, "https://localhost:1", "default-gzip"), nil)
 	stats := a.Stats()
 	ut.AssertEqual(t, 0, stats.TotalHits())
 	ut.AssertEqual(t, 0, stats.TotalMisses())
@@ -41,7 +47,7 @@ func TestArchiverFile(t *testing.T) {
 	server := isolatedfake.New()
 	ts := httptest.NewServer(server)
 	defer ts.Close()
-	a := New(isolatedclient.New(ts.URL, "default-gzip"), nil)
+	a := New(context.Background(), isolatedclient.New(nil, ts.URL, "default-gzip"), nil)
 
 	fEmpty, err := ioutil.TempFile("", "archiver")
 	ut.AssertEqual(t, nil, err)
@@ -83,7 +89,7 @@ func TestArchiverFileHit(t *testing.T) {
 	server := isolatedfake.New()
 	ts := httptest.NewServer(server)
 	defer ts.Close()
-	a := New(isolatedclient.New(ts.URL, "default-gzip"), nil)
+	a := New(context.Background(), isolatedclient.New(nil, ts.URL, "default-gzip"), nil)
 	server.Inject([]byte("foo"))
 	future := a.Push("foo", bytes.NewReader([]byte("foo")))
 	future.WaitForHashed()
@@ -102,7 +108,7 @@ func TestArchiverCancel(t *testing.T) {
 	server := isolatedfake.New()
 	ts := httptest.NewServer(server)
 	defer ts.Close()
-	a := New(isolatedclient.New(ts.URL, "default-gzip"), nil)
+	a := New(context.Background(), isolatedclient.New(nil, ts.URL, "default-gzip"), nil)
 
 	tmpDir, err := ioutil.TempDir("", "archiver")
 	ut.AssertEqual(t, nil, err)
@@ -133,17 +139,37 @@ func TestArchiverCancel(t *testing.T) {
 
 func TestArchiverPushClosed(t *testing.T) {
 	t.Parallel()
-	a := New(nil, nil)
+	a := New(context.Background(), nil, nil)
 	ut.AssertEqual(t, nil, a.Close())
 	ut.AssertEqual(t, nil, a.PushFile("ignored", "ignored"))
 }
 
+func TestArchiverContextCanceled(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	a := New(ctx, nil, nil)
+	cancel()
+	ut.AssertEqual(t, context.Canceled, <-a.Channel())
+	ut.AssertEqual(t, context.Canceled, a.Close())
+}
+
+func TestArchiverWaitHealthy(t *testing.T) {
+	t.Parallel()
+	a := New(context.Background(), nil, nil).(*archiver)
+	ut.AssertEqual(t, false, a.waitHealthy(nil))
+	ut.AssertEqual(t, false, a.waitHealthy(errors.New("fail")))
+	ut.AssertEqual(t, true, a.waitHealthy(&lhttp.CircuitOpenError{Host: "host", RetryAt: time.Now().Add(time.Millisecond)}))
+	a.Cancel(nil)
+	ut.AssertEqual(t, false, a.waitHealthy(&lhttp.CircuitOpenError{Host: "host", RetryAt: time.Now().Add(time.Hour)}))
+	ut.AssertEqual(t, common.ErrCanceled, a.Close())
+}
+
 func TestArchiverPushSeeked(t *testing.T) {
 	t.Parallel()
 	server := isolatedfake.New()
 	ts := httptest.NewServer(server)
 	defer ts.Close()
-	a := New(isolatedclient.New(ts.URL, "default-gzip"), nil)
+	a := New(context.Background(), isolatedclient.New(nil, ts.URL, "default-gzip"), nil)
 	misplaced := bytes.NewReader([]byte("foo"))
 	_, _ = misplaced.Seek(1, os.SEEK_SET)
 	future := a.Push("works", misplaced)
@@ -151,3 +177,52 @@ func TestArchiverPushSeeked(t *testing.T) {
 	ut.AssertEqual(t, isolated.HexDigest("0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33"), future.Digest())
 	ut.AssertEqual(t, nil, a.Close())
 }
+
+func TestArchiverPushRetryRewinds(t *testing.T) {
+	t.Parallel()
+	server := isolatedfake.New()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	is := &unhealthyOnce{IsolateServer: isolatedclient.New(nil, ts.URL, "default-gzip")}
+	a := New(context.Background(), is, nil)
+	future := a.Push("foo", bytes.NewReader([]byte("foo")))
+	ut.AssertEqual(t, nil, a.Close())
+	ut.AssertEqual(t, true, is.failed)
+	expected := map[isolated.HexDigest][]byte{future.Digest(): []byte("foo")}
+	ut.AssertEqual(t, expected, server.Contents())
+}
+
+// unhealthyOnce consumes part of the source of the first Push before
+// reporting the server as unhealthy.
+type unhealthyOnce struct {
+	isolatedclient.IsolateServer
+	failed bool
+}
+
+func (u *unhealthyOnce) Push(ctx context.Context, state *isolatedclient.PushState, src io.Reader) error {
+	if !u.failed {
+		u.failed = true
+		_, _ = src.Read(make([]byte, 1))
+		return &lhttp.CircuitOpenError{Host: "host", RetryAt: time.Now()}
+	}
+	return u.IsolateServer.Push(ctx, state, src)
+}
+
+func TestUploadQueue(t *testing.T) {
+	t.Parallel()
+	item := func(path string, size int64) *archiverItem {
+		return &archiverItem{path: path, digestItem: isolated.DigestItem{Size: size}}
+	}
+	q := &uploadQueue{}
+	heap.Push(q, item("large", 1000))
+	heap.Push(q, item("small", 10))
+	heap.Push(q, item("", 500))
+	heap.Push(q, item("medium", 100))
+	heap.Push(q, item("", 50))
+	expected := []int64{50, 500, 10, 100, 1000}
+	actual := []int64{}
+	for q.Len() != 0 {
+		actual = append(actual, heap.Pop(q).(*archiverItem).digestItem.Size)
+	}
+	ut.AssertEqual(t, expected, actual)
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package archiver
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// blacklist matches relative paths against gitignore-style patterns.
+//
+// Supported syntax:
+//   - A pattern without a slash matches a file or directory name at any depth.
+//   - A pattern with a slash is anchored to the root. A leading slash only
+//     anchors.
+//   - A trailing slash only matches directories.
+//   - "**" matches zero or more directories.
+//   - A leading "!" negates the pattern, re-including a path excluded by a
+//     previous pattern. Use "\!" for a literal "!".
+//   - Other special characters are the ones supported by path.Match().
+//
+// The last matching pattern wins. Since an excluded directory is not
+// enumerated, files within it cannot be re-included.
+type blacklist []blacklistPattern
+
+type blacklistPattern struct {
+	negate  bool
+	dirOnly bool
+	parts   []string
+}
+
+// newBlacklist parses patterns. Patterns can use the OS specific path
+// separator.
+func newBlacklist(patterns []string) (blacklist, error) {
+	out := make(blacklist, 0, len(patterns))
+	for _, pattern := range patterns {
+		p := blacklistPattern{}
+		s := filepath.ToSlash(pattern)
+		if strings.HasPrefix(s, "!") {
+			p.negate = true
+			s = s[1:]
+		} else if strings.HasPrefix(s, "\\!") {
+			s = s[1:]
+		}
+		if strings.HasSuffix(s, "/") {
+			p.dirOnly = true
+			s = strings.TrimRight(s, "/")
+		}
+		anchored := strings.Contains(s, "/")
+		s = strings.TrimPrefix(s, "/")
+		if s == "" {
+			return nil, fmt.Errorf("bad blacklist pattern \"%s\"", pattern)
+		}
+		if !anchored {
+			// Matches at any depth.
+			s = "**/" + s
+		}
+		p.parts = strings.Split(s, "/")
+		for _, part := range p.parts {
+			if _, err := path.Match(part, part); err != nil {
+				return nil, fmt.Errorf("bad blacklist pattern \"%s\"", pattern)
+			}
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// match returns true if relPath must be ignored. isDir must be true if relPath
+// is a directory.
+func (b blacklist) match(relPath string, isDir bool) bool {
+	name := strings.Split(filepath.ToSlash(relPath), "/")
+	ignored := false
+	for _, p := range b {
+		if ignored != p.negate || (p.dirOnly && !isDir) {
+			// This pattern cannot change the outcome.
+			continue
+		}
+		if matchParts(p.parts, name) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+// matchParts matches the path elements name against the pattern elements.
+func matchParts(pattern, name []string) bool {
+	for len(pattern) != 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				// A trailing "**" matches everything inside, but not the directory
+				// itself.
+				return len(name) != 0
+			}
+			for i := range name {
+				if matchParts(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], name[0]); !matched {
+			return false
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
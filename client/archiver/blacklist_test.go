@@ -0,0 +1,79 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package archiver
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestBlacklist(t *testing.T) {
+	t.Parallel()
+	data := []struct {
+		patterns []string
+		relPath  string
+		isDir    bool
+		expected bool
+	}{
+		// Compatibility with the previous filepath.Match() based matching.
+		{[]string{".git"}, ".git", true, true},
+		{[]string{".git"}, filepath.Join("a", ".git"), true, true},
+		{[]string{"*.pyc"}, "foo.pyc", false, true},
+		{[]string{"*.pyc"}, filepath.Join("a", "b", "foo.pyc"), false, true},
+		{[]string{"*.pyc"}, "foo.py", false, false},
+		{[]string{filepath.Join("*", "ignored2")}, filepath.Join("base", "ignored2"), false, true},
+		{[]string{filepath.Join("*", "ignored2")}, "ignored2", false, false},
+		{[]string{filepath.Join("*", "ignored2")}, filepath.Join("a", "b", "ignored2"), false, false},
+
+		// Anchoring.
+		{[]string{"/foo"}, "foo", false, true},
+		{[]string{"/foo"}, filepath.Join("a", "foo"), false, false},
+		{[]string{"a/foo"}, filepath.Join("a", "foo"), false, true},
+		{[]string{"a/foo"}, filepath.Join("b", "a", "foo"), false, false},
+
+		// "**".
+		{[]string{"**/*.pyc"}, "foo.pyc", false, true},
+		{[]string{"**/*.pyc"}, filepath.Join("a", "b", "foo.pyc"), false, true},
+		{[]string{"a/**/b"}, filepath.Join("a", "b"), false, true},
+		{[]string{"a/**/b"}, filepath.Join("a", "x", "y", "b"), false, true},
+		{[]string{"a/**/b"}, filepath.Join("a", "x", "c"), false, false},
+		{[]string{"a/**"}, filepath.Join("a", "x"), false, true},
+		{[]string{"a/**"}, "a", true, false},
+		{[]string{"**/out/*.o"}, filepath.Join("x", "out", "y.o"), false, true},
+
+		// Directory only.
+		{[]string{"out/"}, "out", true, true},
+		{[]string{"out/"}, "out", false, false},
+		{[]string{"out/"}, filepath.Join("a", "out"), true, true},
+		{[]string{"/out/"}, filepath.Join("a", "out"), true, false},
+
+		// Negation; the last matching pattern wins.
+		{[]string{"*.pyc", "!important.pyc"}, "important.pyc", false, false},
+		{[]string{"*.pyc", "!important.pyc"}, "other.pyc", false, true},
+		{[]string{"!important.pyc", "*.pyc"}, "important.pyc", false, true},
+		{[]string{"*.pyc", "!important.pyc", "/important.pyc"}, "important.pyc", false, true},
+		{[]string{"!foo"}, "foo", false, false},
+		{[]string{"\\!foo"}, "!foo", false, true},
+		{[]string{"\\!foo"}, "foo", false, false},
+	}
+	for i, line := range data {
+		b, err := newBlacklist(line.patterns)
+		ut.AssertEqualIndex(t, i, nil, err)
+		ut.AssertEqualIndex(t, i, line.expected, b.match(line.relPath, line.isDir))
+	}
+}
+
+func TestBlacklistBad(t *testing.T) {
+	t.Parallel()
+	data := []string{"a[", "a/b[/c", "/", "!"}
+	for i, pattern := range data {
+		b, err := newBlacklist([]string{pattern})
+		ut.AssertEqualIndex(t, i, blacklist(nil), b)
+		ut.AssertEqualIndex(t, i, errors.New("bad blacklist pattern \""+pattern+"\""), err)
+	}
+}
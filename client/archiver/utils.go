@@ -87,88 +87,290 @@ func (s *simpleFuture) Finalize(d isolated.HexDigest, err error) {
 	s.wgHashed.Done()
 }
 
+// WalkOptions controls how PushDirectory enumerates a directory tree.
+type WalkOptions struct {
+	// Blacklist is a list of gitignore-style patterns of files and directories
+	// to ignore. Anchored patterns are relative to the root.
+	Blacklist []string
+	// FollowSymlinks specifies that symlinks pointing outside of the root must
+	// be followed and their target archived as if it was in the tree.
+	//
+	// Symlinks pointing inside the tree are always archived as symlinks.
+	// Symlinks pointing outside of the tree are archived as-is when false.
+	FollowSymlinks bool
+}
+
 type walkItem struct {
 	fullPath string
 	relPath  string
 	info     os.FileInfo
+	link     string // Set when the item must be archived as a symlink.
 	err      error
 }
 
-// walk() enumerates a directory tree synchronously and sends the items to
-// channel c.
-//
-// blacklist is a list of globs of files to ignore. Each blacklist glob is
-// relative to root.
-func walk(root string, blacklist []string, c chan<- *walkItem) {
-	// TODO(maruel): Walk() sorts the file names list, which is not needed here
-	// and slows things down. Options:
-	// #1 Use os.File.Readdir() directly. It's in the stdlib and works fine, but
-	//    it's not the most efficient implementation. On posix it does a lstat()
-	//    call, on Windows it does a Win32FileAttributeData.
-	// #2 Use raw syscalls.
-	//   - On POSIX, use syscall.ReadDirent(). See src/os/dir_unix.go.
-	//   - On Windows, use syscall.FindFirstFile(), syscall.FindNextFile(),
-	//     syscall.FindClose() directly. See src/os/file_windows.go. For odd
-	//     reasons, Windows does not have a batched version to reduce the number
-	//     of kernel calls. It's as if they didn't care about performance.
-	//
-	// In practice, #2 may not be needed, the performance of #1 may be good
-	// enough relative to the other performance costs. This needs to be perf
-	// tested at 100k+ files scale on Windows and OSX.
-	//
-	// TODO(maruel): Cache directory enumeration. In particular cases (Chromium),
-	// the same directory may be enumerated multiple times. Caching the content
-	// may be worth. This needs to be perf tested.
+// maxConcurrentWalk is the maximum number of goroutines enumerating
+// directories, shared by all the concurrent walk() calls.
+const maxConcurrentWalk = 16
 
-	total := 0
+// walkSem limits the number of goroutines enumerating directories. When it is
+// full, subdirectories are enumerated synchronously.
+var walkSem = make(chan struct{}, maxConcurrentWalk)
+
+// walk() enumerates a directory tree and sends the items to channel c.
+//
+// Directories are enumerated concurrently so items are sent in no particular
+// order. opts and cache can be nil.
+func walk(root string, opts *WalkOptions, cache *dirCache, c chan<- *walkItem) {
+	if opts == nil {
+		opts = &WalkOptions{}
+	}
+	w := &walker{opts: opts, cache: cache, c: c}
 	end := tracer.Span(root, "walk:"+filepath.Base(root), nil)
-	defer func() { end(tracer.Args{"root": root, "total": total}) }()
+	defer func() { end(tracer.Args{"root": root, "total": w.total}) }()
 	// Check patterns upfront, so it has consistent behavior w.r.t. bad glob
 	// patterns.
-	for _, b := range blacklist {
-		if _, err := filepath.Match(b, b); err != nil {
-			c <- &walkItem{err: fmt.Errorf("bad blacklist pattern \"%s\"", b)}
-			return
-		}
+	b, err := newBlacklist(opts.Blacklist)
+	if err != nil {
+		c <- &walkItem{err: err}
+		return
 	}
+	w.blacklist = b
 	if strings.HasSuffix(root, string(filepath.Separator)) {
 		root = root[:len(root)-1]
 	}
-	rootLen := len(root) + 1
-	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
-		total++
-		if err != nil {
-			return fmt.Errorf("walk(%s): %s", p, err)
+	if _, err := os.Lstat(root); err != nil {
+		c <- &walkItem{err: fmt.Errorf("walk(%s): %s", root, err)}
+		return
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		// Like filepath.Walk(), there is nothing to enumerate in a file.
+		return
+	}
+	w.root = root
+	w.realRoot = root
+	var stack []string
+	if real, err := filepath.EvalSymlinks(root); err == nil {
+		w.realRoot = real
+		stack = []string{real}
+	}
+	w.walkDir(root, "", stack)
+	w.wg.Wait()
+	if w.err != nil {
+		c <- &walkItem{err: w.err}
+	}
+}
+
+// walker holds the state of a single walk() call.
+type walker struct {
+	root      string
+	realRoot  string // root with its symlinks resolved.
+	opts      *WalkOptions
+	blacklist blacklist
+	cache     *dirCache
+	c         chan<- *walkItem
+	wg        sync.WaitGroup // Goroutines started by spawn().
+
+	lock  sync.Mutex
+	total int
+	err   error
+}
+
+// spawn enumerates dir in a new goroutine if walkSem has room, otherwise
+// synchronously.
+func (w *walker) spawn(dir, relDir string, stack []string) {
+	select {
+	case walkSem <- struct{}{}:
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			defer func() { <-walkSem }()
+			w.walkDir(dir, relDir, stack)
+		}()
+	default:
+		w.walkDir(dir, relDir, stack)
+	}
+}
+
+// walkDir enumerates dir, which is mapped to relDir in the archive, and
+// recurses into its subdirectories, concurrently when possible.
+//
+// stack is the list of real paths of the directories leading to dir that were
+// reached by following symlinks, to detect cycles.
+func (w *walker) walkDir(dir, relDir string, stack []string) {
+	if w.failed() {
+		return
+	}
+	infos, err := w.cache.readDir(dir)
+	if err != nil {
+		w.setErr(fmt.Errorf("walk(%s): %s", dir, err))
+		return
+	}
+	w.lock.Lock()
+	w.total += len(infos)
+	w.lock.Unlock()
+	for _, info := range infos {
+		p := filepath.Join(dir, info.Name())
+		relPath := info.Name()
+		if relDir != "" {
+			relPath = filepath.Join(relDir, relPath)
 		}
-		if len(p) <= rootLen {
-			// Root directory.
-			return nil
+		if w.blacklist.match(relPath, info.IsDir()) {
+			continue
 		}
-		relPath := p[rootLen:]
-		for _, b := range blacklist {
-			matched, _ := filepath.Match(b, relPath)
-			if !matched {
-				// Also check at the base file name.
-				matched, _ = filepath.Match(b, filepath.Base(relPath))
+		if info.IsDir() {
+			w.spawn(p, relPath, stack)
+			continue
+		}
+		if info.Mode()&os.ModeSymlink == os.ModeSymlink {
+			if err := w.symlink(p, relPath, stack); err != nil {
+				w.setErr(err)
+				return
 			}
-			if matched {
-				// Must not return io.SkipDir for file, filepath.walk() handles this
-				// badly.
-				if info.IsDir() {
-					return filepath.SkipDir
-				}
-				return nil
+			continue
+		}
+		w.c <- &walkItem{fullPath: p, relPath: relPath, info: info}
+	}
+}
+
+func (w *walker) setErr(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *walker) failed() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.err != nil
+}
+
+// symlink processes the symlink at path p.
+//
+// Symlinks pointing inside the root are sent as links, with absolute links
+// converted to relative ones so they are still valid once mapped. Symlinks
+// pointing outside the root are either sent as-is or followed.
+func (w *walker) symlink(p, relPath string, stack []string) error {
+	l, err := os.Readlink(p)
+	if err != nil {
+		return fmt.Errorf("readlink(%s): %s", p, err)
+	}
+	target := l
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(p), target)
+	}
+	target = filepath.Clean(target)
+	// The target is also compared once resolved, in case the root or the
+	// target goes through a symlink, e.g. /tmp on OSX.
+	dir := filepath.Dir(p)
+	within := isWithin(w.root, target)
+	resolved := false
+	if !within {
+		if real, err := filepath.EvalSymlinks(target); err == nil && isWithin(w.realRoot, real) {
+			if dir, err = filepath.EvalSymlinks(dir); err != nil {
+				return err
 			}
+			within, resolved, target = true, true, real
 		}
-		if info.IsDir() {
-			return nil
+	}
+	if within {
+		// A link only found inside once resolved may go through a path outside
+		// of the root, so it is rewritten too.
+		if filepath.IsAbs(l) || resolved {
+			if l, err = filepath.Rel(dir, target); err != nil {
+				return err
+			}
 		}
-		c <- &walkItem{fullPath: p, relPath: relPath, info: info}
+		w.c <- &walkItem{fullPath: p, relPath: relPath, link: l}
 		return nil
-	})
+	}
+	if !w.opts.FollowSymlinks {
+		w.c <- &walkItem{fullPath: p, relPath: relPath, link: l}
+		return nil
+	}
+	info, err := os.Stat(p)
 	if err != nil {
-		c <- &walkItem{err: err}
+		return fmt.Errorf("dangling symlink %s -> %s", p, l)
+	}
+	if !info.IsDir() {
+		w.c <- &walkItem{fullPath: p, relPath: relPath, info: info}
+		return nil
+	}
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return fmt.Errorf("dangling symlink %s -> %s", p, l)
+	}
+	for _, s := range stack {
+		if isWithin(real, s) {
+			return fmt.Errorf("symlink cycle %s -> %s", p, l)
+		}
+	}
+	// Force a copy of stack since it is shared with sibling directories.
+	w.spawn(real, relPath, append(stack[:len(stack):len(stack)], real))
+	return nil
+}
+
+// dirCache memoizes directory enumerations. It is safe for concurrent use.
+//
+// The content of the directories is assumed to not change during the lifetime
+// of the cache.
+type dirCache struct {
+	lock    sync.Mutex
+	entries map[string]*dirEntry
+}
+
+type dirEntry struct {
+	done  chan struct{} // Closed once infos and err are set.
+	infos []os.FileInfo
+	err   error
+}
+
+// readDir returns the content of directory dir. It is a no-op cache when d is
+// nil.
+func (d *dirCache) readDir(dir string) ([]os.FileInfo, error) {
+	if d == nil {
+		return readDir(dir)
+	}
+	d.lock.Lock()
+	if d.entries == nil {
+		d.entries = map[string]*dirEntry{}
+	}
+	e, ok := d.entries[dir]
+	if !ok {
+		e = &dirEntry{done: make(chan struct{})}
+		d.entries[dir] = e
 	}
+	d.lock.Unlock()
+	if ok {
+		<-e.done
+	} else {
+		e.infos, e.err = readDir(dir)
+		close(e.done)
+	}
+	return e.infos, e.err
+}
+
+// readDir enumerates dir without sorting. The returned items are not followed
+// if they are symlinks.
+//
+// readDir is mocked in tests.
+var readDir = func(dir string) ([]os.FileInfo, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdir(-1)
+}
+
+// isWithin returns true if p is root or a path inside root.
+func isWithin(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
 
 // PushDirectory walks a directory at root and creates a .isolated file.
@@ -182,14 +384,20 @@ func walk(root string, blacklist []string, c chan<- *walkItem) {
 // relDir is a relative directory to offset relative paths against in the
 // generated .isolated file.
 //
-// blacklist is a list of globs of files to ignore.
-func PushDirectory(a Archiver, root string, relDir string, blacklist []string) Future {
+// opts controls the enumeration and can be nil.
+func PushDirectory(a Archiver, root string, relDir string, opts *WalkOptions) Future {
 	total := 0
 	end := tracer.Span(a, "PushDirectory", tracer.Args{"path": relDir, "root": root})
 	defer func() { end(tracer.Args{"total": total}) }()
+	// Directories reached multiple times, through symlinks or by several
+	// PushDirectory() calls of the same archival, are only enumerated once.
+	cache := &dirCache{}
+	if arch, ok := a.(*archiver); ok {
+		cache = &arch.dirCache
+	}
 	c := make(chan *walkItem)
 	go func() {
-		walk(root, blacklist, c)
+		walk(root, opts, cache, c)
 		close(c)
 	}()
 
@@ -214,17 +422,11 @@ func PushDirectory(a Archiver, root string, relDir string, blacklist []string) F
 		if relDir != "" {
 			item.relPath = filepath.Join(relDir, item.relPath)
 		}
-		mode := item.info.Mode()
-		if mode&os.ModeSymlink == os.ModeSymlink {
-			l, err := os.Readlink(item.fullPath)
-			if err != nil {
-				s.Finalize("", fmt.Errorf("readlink(%s): %s", item.fullPath, err))
-				continue
-			}
-			i.Files[item.relPath] = isolated.File{Link: newString(l)}
+		if item.link != "" {
+			i.Files[item.relPath] = isolated.File{Link: newString(item.link)}
 		} else {
 			i.Files[item.relPath] = isolated.File{
-				Mode: newInt(int(mode.Perm())),
+				Mode: newInt(int(item.info.Mode().Perm())),
 				Size: newInt64(item.info.Size()),
 			}
 			futures = append(futures, a.PushFile(item.relPath, item.fullPath))
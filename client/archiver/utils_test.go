@@ -7,10 +7,12 @@ package archiver
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"testing"
 
@@ -19,6 +21,7 @@ import (
 	"github.com/luci/luci-go/client/isolatedclient/isolatedfake"
 	"github.com/luci/luci-go/common/isolated"
 	"github.com/maruel/ut"
+	"golang.org/x/net/context"
 )
 
 func TestWalkInexistent(t *testing.T) {
@@ -28,7 +31,7 @@ func TestWalkInexistent(t *testing.T) {
 	go func() {
 		defer wg.Done()
 		defer close(ch)
-		walk("inexistent_directory", nil, ch)
+		walk("inexistent_directory", nil, nil, ch)
 	}()
 	item := <-ch
 	err := errors.New("walk(inexistent_directory): lstat inexistent_directory: no such file or directory")
@@ -49,7 +52,7 @@ func TestWalkBadRegexp(t *testing.T) {
 	go func() {
 		defer wg.Done()
 		defer close(ch)
-		walk("inexistent", []string{"a["}, ch)
+		walk("inexistent", &WalkOptions{Blacklist: []string{"a["}}, nil, ch)
 	}()
 	item := <-ch
 	ut.AssertEqual(t, &walkItem{err: errors.New("bad blacklist pattern \"a[\"")}, item)
@@ -59,13 +62,30 @@ func TestWalkBadRegexp(t *testing.T) {
 	wg.Wait()
 }
 
+func TestWalkFile(t *testing.T) {
+	t.Parallel()
+	f, err := ioutil.TempFile("", "archiver")
+	ut.AssertEqual(t, nil, err)
+	defer func() {
+		if err := os.Remove(f.Name()); err != nil {
+			t.Fail()
+		}
+	}()
+	ut.AssertEqual(t, nil, f.Close())
+
+	// A root that is a file has nothing to enumerate.
+	actual, err := walkAll(f.Name(), nil)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, map[string]string{}, actual)
+}
+
 func TestPushDirectory(t *testing.T) {
 	// Uploads a real directory. 2 times the same file.
 	t.Parallel()
 	server := isolatedfake.New()
 	ts := httptest.NewServer(server)
 	defer ts.Close()
-	a := New(isolatedclient.New(ts.URL, "default-gzip"), nil)
+	a := New(context.Background(), isolatedclient.New(nil, ts.URL, "default-gzip"), nil)
 
 	// Setup temporary directory.
 	tmpDir, err := ioutil.TempDir("", "archiver")
@@ -87,7 +107,7 @@ func TestPushDirectory(t *testing.T) {
 	ut.AssertEqual(t, nil, os.Mkdir(ignoredDir, 0700))
 	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(ignoredDir, "really"), []byte("ignored"), 0600))
 
-	future := PushDirectory(a, tmpDir, "", []string{"ignored1", filepath.Join("*", "ignored2")})
+	future := PushDirectory(a, tmpDir, "", &WalkOptions{Blacklist: []string{"ignored1", filepath.Join("*", "ignored2")}})
 	ut.AssertEqual(t, filepath.Base(tmpDir)+".isolated", future.DisplayName())
 	future.WaitForHashed()
 	ut.AssertEqual(t, nil, a.Close())
@@ -132,3 +152,297 @@ func TestPushDirectory(t *testing.T) {
 
 	ut.AssertEqual(t, nil, server.Error())
 }
+
+func TestWalkSymlinks(t *testing.T) {
+	if common.IsWindows() {
+		t.Skip("symlinks are not supported on Windows")
+	}
+	t.Parallel()
+	tmpDir, err := ioutil.TempDir("", "archiver")
+	ut.AssertEqual(t, nil, err)
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Fail()
+		}
+	}()
+	root := filepath.Join(tmpDir, "root")
+	outside := filepath.Join(tmpDir, "outside")
+	ut.AssertEqual(t, nil, os.MkdirAll(filepath.Join(root, "sub"), 0700))
+	ut.AssertEqual(t, nil, os.MkdirAll(filepath.Join(outside, "dir"), 0700))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(root, "sub", "file"), []byte("in"), 0600))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(outside, "file"), []byte("out"), 0600))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(outside, "dir", "a"), []byte("a"), 0600))
+	ut.AssertEqual(t, nil, os.Symlink(filepath.Join("sub", "file"), filepath.Join(root, "relative")))
+	ut.AssertEqual(t, nil, os.Symlink(filepath.Join(root, "sub", "file"), filepath.Join(root, "sub", "absolute")))
+	ut.AssertEqual(t, nil, os.Symlink(filepath.Join(outside, "file"), filepath.Join(root, "file_out")))
+	ut.AssertEqual(t, nil, os.Symlink(filepath.Join("..", "outside", "dir"), filepath.Join(root, "dir_out")))
+
+	// By default, symlinks pointing outside are kept as-is.
+	expected := map[string]string{
+		"relative":                       filepath.Join("sub", "file"),
+		filepath.Join("sub", "absolute"): "file",
+		filepath.Join("sub", "file"):     "",
+		"file_out":                       filepath.Join(outside, "file"),
+		"dir_out":                        filepath.Join("..", "outside", "dir"),
+	}
+	actual, err := walkAll(root, nil)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, actual)
+
+	// When following, the target of external symlinks is enumerated.
+	expected = map[string]string{
+		"relative":                       filepath.Join("sub", "file"),
+		filepath.Join("sub", "absolute"): "file",
+		filepath.Join("sub", "file"):     "",
+		"file_out":                       "",
+		filepath.Join("dir_out", "a"):    "",
+	}
+	actual, err = walkAll(root, &WalkOptions{FollowSymlinks: true})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, actual)
+
+	// A dangling symlink pointing inside the tree is archived as a symlink.
+	ut.AssertEqual(t, nil, os.Symlink("missing", filepath.Join(root, "dangling")))
+	expected["dangling"] = "missing"
+	actual, err = walkAll(root, &WalkOptions{FollowSymlinks: true})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, actual)
+
+	// A dangling symlink pointing outside can't be followed.
+	dangling := filepath.Join(outside, "missing")
+	ut.AssertEqual(t, nil, os.Symlink(dangling, filepath.Join(root, "dangling_out")))
+	_, err = walkAll(root, &WalkOptions{FollowSymlinks: true})
+	ut.AssertEqual(t, fmt.Errorf("dangling symlink %s -> %s", filepath.Join(root, "dangling_out"), dangling), err)
+}
+
+func TestWalkSymlinksCycle(t *testing.T) {
+	if common.IsWindows() {
+		t.Skip("symlinks are not supported on Windows")
+	}
+	t.Parallel()
+	tmpDir, err := ioutil.TempDir("", "archiver")
+	ut.AssertEqual(t, nil, err)
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Fail()
+		}
+	}()
+	root := filepath.Join(tmpDir, "root")
+	outside := filepath.Join(tmpDir, "outside")
+	ut.AssertEqual(t, nil, os.Mkdir(root, 0700))
+	ut.AssertEqual(t, nil, os.Mkdir(outside, 0700))
+	ut.AssertEqual(t, nil, os.Symlink(outside, filepath.Join(root, "out")))
+	ut.AssertEqual(t, nil, os.Symlink(tmpDir, filepath.Join(outside, "loop")))
+
+	_, err = walkAll(root, &WalkOptions{FollowSymlinks: true})
+	ut.AssertEqual(t, fmt.Errorf("symlink cycle %s -> %s", filepath.Join(outside, "loop"), tmpDir), err)
+}
+
+func TestWalkSymlinkedRoot(t *testing.T) {
+	if common.IsWindows() {
+		t.Skip("symlinks are not supported on Windows")
+	}
+	t.Parallel()
+	tmpDir, err := ioutil.TempDir("", "archiver")
+	ut.AssertEqual(t, nil, err)
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Fail()
+		}
+	}()
+	real := filepath.Join(tmpDir, "real")
+	ut.AssertEqual(t, nil, os.Mkdir(real, 0700))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(real, "file"), []byte("in"), 0600))
+	ut.AssertEqual(t, nil, os.Symlink(filepath.Join(real, "file"), filepath.Join(real, "absolute")))
+	root := filepath.Join(tmpDir, "root")
+	ut.AssertEqual(t, nil, os.Symlink(real, root))
+
+	// The symlink points inside the tree once the root is resolved.
+	expected := map[string]string{
+		"absolute": "file",
+		"file":     "",
+	}
+	actual, err := walkAll(root, nil)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, actual)
+}
+
+func TestWalkSymlinkThroughOutside(t *testing.T) {
+	if common.IsWindows() {
+		t.Skip("symlinks are not supported on Windows")
+	}
+	t.Parallel()
+	tmpDir, err := ioutil.TempDir("", "archiver")
+	ut.AssertEqual(t, nil, err)
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Fail()
+		}
+	}()
+	root := filepath.Join(tmpDir, "tree")
+	ut.AssertEqual(t, nil, os.MkdirAll(filepath.Join(root, "x"), 0700))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(root, "f"), []byte("in"), 0600))
+	ut.AssertEqual(t, nil, os.Symlink(root, filepath.Join(tmpDir, "ext")))
+	ut.AssertEqual(t, nil, os.Symlink(filepath.Join("..", "..", "ext", "f"), filepath.Join(root, "x", "l")))
+
+	// The relative link reaches the tree through a symlink outside of it, so it
+	// must be rewritten to stay inside.
+	expected := map[string]string{
+		"f":                     "",
+		filepath.Join("x", "l"): filepath.Join("..", "f"),
+	}
+	actual, err := walkAll(root, nil)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, actual)
+}
+
+func TestPushDirectorySharedCache(t *testing.T) {
+	if common.IsWindows() {
+		t.Skip("symlinks are not supported on Windows")
+	}
+	// Not parallel since readDir is mocked.
+	lock := sync.Mutex{}
+	reads := map[string]int{}
+	oldReadDir := readDir
+	defer func() {
+		readDir = oldReadDir
+	}()
+	readDir = func(dir string) ([]os.FileInfo, error) {
+		lock.Lock()
+		reads[dir]++
+		lock.Unlock()
+		return oldReadDir(dir)
+	}
+
+	server := isolatedfake.New()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	a := New(context.Background(), isolatedclient.New(nil, ts.URL, "default-gzip"), nil)
+	tmpDir, err := ioutil.TempDir("", "archiver")
+	ut.AssertEqual(t, nil, err)
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Fail()
+		}
+	}()
+	tmpDir, err = filepath.EvalSymlinks(tmpDir)
+	ut.AssertEqual(t, nil, err)
+	shared := filepath.Join(tmpDir, "shared")
+	ut.AssertEqual(t, nil, os.Mkdir(shared, 0700))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(shared, "file"), []byte("foo"), 0600))
+	// Both roots reference the shared directory.
+	var futures []Future
+	for _, name := range []string{"a", "b"} {
+		root := filepath.Join(tmpDir, name)
+		ut.AssertEqual(t, nil, os.Mkdir(root, 0700))
+		ut.AssertEqual(t, nil, os.Symlink(shared, filepath.Join(root, "shared")))
+		futures = append(futures, PushDirectory(a, root, "", &WalkOptions{FollowSymlinks: true}))
+	}
+	for _, future := range futures {
+		future.WaitForHashed()
+		ut.AssertEqual(t, nil, future.Error())
+	}
+	ut.AssertEqual(t, nil, a.Close())
+	ut.AssertEqual(t, 1, reads[shared])
+	ut.AssertEqual(t, nil, server.Error())
+}
+
+// walkAll returns the relative paths enumerated by walk() mapped to their
+// symlink target, if any.
+func walkAll(root string, opts *WalkOptions) (map[string]string, error) {
+	ch := make(chan *walkItem)
+	go func() {
+		defer close(ch)
+		walk(root, opts, nil, ch)
+	}()
+	out := map[string]string{}
+	var err error
+	for item := range ch {
+		if item.err != nil {
+			err = item.err
+			continue
+		}
+		out[item.relPath] = item.link
+	}
+	return out, err
+}
+
+func TestDirCache(t *testing.T) {
+	t.Parallel()
+	tmpDir, err := ioutil.TempDir("", "archiver")
+	ut.AssertEqual(t, nil, err)
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Fail()
+		}
+	}()
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(tmpDir, "a"), []byte("a"), 0600))
+
+	d := &dirCache{}
+	infos, err := d.readDir(tmpDir)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, len(infos))
+
+	// The enumeration is memoized.
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(tmpDir, "b"), []byte("b"), 0600))
+	infos, err = d.readDir(tmpDir)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, len(infos))
+
+	// A nil cache always enumerates.
+	infos, err = (*dirCache)(nil).readDir(tmpDir)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, len(infos))
+}
+
+func BenchmarkWalk(b *testing.B) {
+	benchmarkWalk(b, nil)
+}
+
+func BenchmarkWalkCached(b *testing.B) {
+	benchmarkWalk(b, &dirCache{})
+}
+
+func benchmarkWalk(b *testing.B, cache *dirCache) {
+	tmpDir, err := ioutil.TempDir("", "archiver")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			b.Fail()
+		}
+	}()
+	// Creates 10x10 directories with 10 files each.
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 10; j++ {
+			d := filepath.Join(tmpDir, strconv.Itoa(i), strconv.Itoa(j))
+			if err := os.MkdirAll(d, 0700); err != nil {
+				b.Fatal(err)
+			}
+			for k := 0; k < 10; k++ {
+				if err := ioutil.WriteFile(filepath.Join(d, strconv.Itoa(k)), nil, 0600); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ch := make(chan *walkItem)
+		go func() {
+			defer close(ch)
+			walk(tmpDir, nil, cache, ch)
+		}()
+		total := 0
+		for item := range ch {
+			if item.err != nil {
+				b.Fatal(item.err)
+			}
+			total++
+		}
+		if total != 1000 {
+			b.Fatalf("unexpected %d", total)
+		}
+	}
+}
@@ -14,8 +14,8 @@ import (
 	"github.com/luci/luci-go/client/archiver"
 	"github.com/luci/luci-go/client/internal/common"
 	"github.com/luci/luci-go/client/isolate"
-	"github.com/luci/luci-go/client/isolatedclient"
 	"github.com/maruel/subcommands"
+	"golang.org/x/net/context"
 )
 
 var cmdArchive = &subcommands.Command{
@@ -60,11 +60,14 @@ func (c *archiveRun) main(a subcommands.Application, args []string) error {
 		prefix = ""
 	}
 	start := time.Now()
-	arch := archiver.New(isolatedclient.New(c.isolatedFlags.ServerURL, c.isolatedFlags.Namespace), out)
+	server, err := c.newServer()
+	if err != nil {
+		return err
+	}
+	arch := archiver.New(context.Background(), server, out)
 	common.CancelOnCtrlC(arch)
 	future := isolate.Archive(arch, &c.ArchiveOptions)
 	future.WaitForHashed()
-	var err error
 	if err = future.Error(); err != nil {
 		fmt.Printf("%s%s  %s\n", prefix, filepath.Base(c.Isolate), err)
 	} else {
@@ -78,6 +81,10 @@ func (c *archiveRun) main(a subcommands.Application, args []string) error {
 		stats := arch.Stats()
 		fmt.Fprintf(os.Stderr, "Hits    : %5d (%s)\n", stats.TotalHits(), stats.TotalBytesHits())
 		fmt.Fprintf(os.Stderr, "Misses  : %5d (%s)\n", stats.TotalMisses(), stats.TotalBytesPushed())
+		if c.isolatedFlags.DryRun {
+			fmt.Fprintf(os.Stderr, "Total   : %5d (%s)\n", stats.TotalHits()+stats.TotalMisses(), stats.TotalBytesHits()+stats.TotalBytesPushed())
+		}
+		common.PrintHTTPStats(os.Stderr)
 		fmt.Fprintf(os.Stderr, "Duration: %s\n", common.Round(duration, time.Millisecond))
 	}
 	return err
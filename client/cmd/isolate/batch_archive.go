@@ -16,9 +16,9 @@ import (
 	"github.com/luci/luci-go/client/archiver"
 	"github.com/luci/luci-go/client/internal/common"
 	"github.com/luci/luci-go/client/isolate"
-	"github.com/luci/luci-go/client/isolatedclient"
 	"github.com/luci/luci-go/common/isolated"
 	"github.com/maruel/subcommands"
+	"golang.org/x/net/context"
 )
 
 var cmdBatchArchive = &subcommands.Command{
@@ -123,7 +123,11 @@ func (c *batchArchiveRun) main(a subcommands.Application, args []string) error {
 		prefix = ""
 	}
 	start := time.Now()
-	arch := archiver.New(isolatedclient.New(c.isolatedFlags.ServerURL, c.isolatedFlags.Namespace), out)
+	server, err := c.newServer()
+	if err != nil {
+		return err
+	}
+	arch := archiver.New(context.Background(), server, out)
 	common.CancelOnCtrlC(arch)
 	type tmp struct {
 		name   string
@@ -180,7 +184,7 @@ func (c *batchArchiveRun) main(a subcommands.Application, args []string) error {
 			fmt.Fprintf(os.Stderr, "%s%s  %s\n", prefix, item.name, item.future.Error())
 		}
 	}
-	err := arch.Close()
+	err = arch.Close()
 	duration := time.Since(start)
 	// Only write the file once upload is confirmed.
 	if err == nil && c.dumpJson != "" {
@@ -190,6 +194,10 @@ func (c *batchArchiveRun) main(a subcommands.Application, args []string) error {
 		stats := arch.Stats()
 		fmt.Fprintf(os.Stderr, "Hits    : %5d (%s)\n", stats.TotalHits(), stats.TotalBytesHits())
 		fmt.Fprintf(os.Stderr, "Misses  : %5d (%s)\n", stats.TotalMisses(), stats.TotalBytesPushed())
+		if c.isolatedFlags.DryRun {
+			fmt.Fprintf(os.Stderr, "Total   : %5d (%s)\n", stats.TotalHits()+stats.TotalMisses(), stats.TotalBytesHits()+stats.TotalBytesPushed())
+		}
+		common.PrintHTTPStats(os.Stderr)
 		fmt.Fprintf(os.Stderr, "Duration: %s\n", common.Round(duration, time.Millisecond))
 	}
 	return err
@@ -8,12 +8,14 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"path/filepath"
 	"runtime"
 
 	"github.com/luci/luci-go/client/internal/common"
 	"github.com/luci/luci-go/client/isolate"
 	"github.com/luci/luci-go/client/isolatedclient"
+	"github.com/luci/luci-go/common/auth"
 	"github.com/maruel/subcommands"
 )
 
@@ -37,11 +39,13 @@ func (c *commonFlags) Parse() error {
 type commonServerFlags struct {
 	commonFlags
 	isolatedFlags isolatedclient.Flags
+	authFlags     auth.Flags
 }
 
 func (c *commonServerFlags) Init() {
 	c.commonFlags.Init()
 	c.isolatedFlags.Init(&c.Flags)
+	c.authFlags.Register(&c.Flags)
 }
 
 func (c *commonServerFlags) Parse() error {
@@ -51,6 +55,19 @@ func (c *commonServerFlags) Parse() error {
 	return c.isolatedFlags.Parse()
 }
 
+// newServer returns the IsolateServer selected by the flags. No credentials
+// are needed on dry run.
+func (c *commonServerFlags) newServer() (isolatedclient.IsolateServer, error) {
+	var client *http.Client
+	if !c.isolatedFlags.DryRun {
+		var err error
+		if client, err = common.CreateAuthClient(&c.authFlags); err != nil {
+			return nil, err
+		}
+	}
+	return c.isolatedFlags.NewServer(client), nil
+}
+
 type isolateFlags struct {
 	// TODO(tandrii): move ArchiveOptions from isolate pkg to here.
 	isolate.ArchiveOptions
@@ -62,7 +79,9 @@ func (c *isolateFlags) Init(f *flag.FlagSet) {
 	f.StringVar(&c.Isolate, "i", "", "Alias for --isolate")
 	f.StringVar(&c.Isolated, "isolated", "", ".isolated file to generate or read")
 	f.StringVar(&c.Isolated, "s", "", "Alias for --isolated")
-	f.Var(&c.Blacklist, "blacklist", "List of regexp to use as blacklist filter when uploading directories")
+	f.Var(&c.Blacklist, "blacklist", "List of gitignore-style patterns to use as blacklist filter when uploading directories")
+	f.BoolVar(&c.FollowSymlinks, "follow-symlinks", false,
+		"Archive the content of symlinks pointing outside of a directory instead of the symlinks themselves")
 	f.Var(c.ConfigVariables, "config-variable",
 		`Config variables are used to determine which
 		conditions should be matched when loading a .isolate
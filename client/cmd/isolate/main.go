@@ -9,12 +9,13 @@ import (
 	"os"
 
 	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/common/auth"
 	"github.com/maruel/subcommands"
 )
 
 // version must be updated whenever functional change (behavior, arguments,
 // supported commands) is done.
-const version = "0.2.2"
+const version = "0.2.12"
 
 var application = &subcommands.DefaultApplication{
 	Name:  "isolate",
@@ -25,6 +26,10 @@ var application = &subcommands.DefaultApplication{
 		cmdBatchArchive,
 		cmdCheck,
 		subcommands.CmdHelp,
+		auth.SubcommandInfo(auth.Options{}, "info"),
+		auth.SubcommandLogin(auth.Options{}, "login"),
+		auth.SubcommandLogout(auth.Options{}, "logout"),
+		auth.SubcommandToken(auth.Options{}, "token"),
 		common.CmdVersion(version),
 	},
 }
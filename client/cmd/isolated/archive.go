@@ -12,30 +12,33 @@ import (
 
 	"github.com/luci/luci-go/client/archiver"
 	"github.com/luci/luci-go/client/internal/common"
-	"github.com/luci/luci-go/client/isolatedclient"
 	"github.com/maruel/subcommands"
+	"golang.org/x/net/context"
 )
 
 var cmdArchive = &subcommands.Command{
 	UsageLine: "archive <options>...",
 	ShortDesc: "creates a .isolated file and uploads the tree to an isolate server.",
-	LongDesc:  "All the files listed in the .isolated file are put in the isolate server.",
+	LongDesc:  "All the files listed in the .isolated file are put in the isolate server. Files in directories matching -blacklist are skipped.",
 	CommandRun: func() subcommands.CommandRun {
 		c := archiveRun{}
 		c.commonFlags.Init()
 		c.Flags.Var(&c.dirs, "dirs", "Directory(ies) to archive")
 		c.Flags.Var(&c.files, "files", "Individual file(s) to archive")
 		c.Flags.Var(&c.blacklist, "blacklist",
-			"List of regexp to use as blacklist filter when uploading directories")
+			"List of gitignore-style patterns to use as blacklist filter when uploading directories")
+		c.Flags.BoolVar(&c.followSymlinks, "follow-symlinks", false,
+			"Archive the content of symlinks pointing outside of a directory instead of the symlinks themselves")
 		return &c
 	},
 }
 
 type archiveRun struct {
 	commonFlags
-	dirs      common.Strings
-	files     common.Strings
-	blacklist common.Strings
+	dirs           common.Strings
+	files          common.Strings
+	blacklist      common.Strings
+	followSymlinks bool
 }
 
 func (c *archiveRun) Parse(a subcommands.Application, args []string) error {
@@ -56,7 +59,11 @@ func (c *archiveRun) main(a subcommands.Application, args []string) error {
 		out = nil
 		prefix = ""
 	}
-	arch := archiver.New(isolatedclient.New(c.isolatedFlags.ServerURL, c.isolatedFlags.Namespace), out)
+	server, err := c.newServer()
+	if err != nil {
+		return err
+	}
+	arch := archiver.New(context.Background(), server, out)
 	common.CancelOnCtrlC(arch)
 	futures := []archiver.Future{}
 	names := []string{}
@@ -65,8 +72,9 @@ func (c *archiveRun) main(a subcommands.Application, args []string) error {
 		names = append(names, file)
 	}
 
+	opts := &archiver.WalkOptions{Blacklist: c.blacklist, FollowSymlinks: c.followSymlinks}
 	for _, d := range c.dirs {
-		futures = append(futures, archiver.PushDirectory(arch, d, "", nil))
+		futures = append(futures, archiver.PushDirectory(arch, d, "", opts))
 		names = append(names, d)
 	}
 
@@ -79,12 +87,16 @@ func (c *archiveRun) main(a subcommands.Application, args []string) error {
 		}
 	}
 	// This waits for all uploads.
-	err := arch.Close()
+	err = arch.Close()
 	if !c.defaultFlags.Quiet {
 		duration := time.Since(start)
 		stats := arch.Stats()
 		fmt.Fprintf(os.Stderr, "Hits    : %5d (%s)\n", stats.TotalHits(), stats.TotalBytesHits())
 		fmt.Fprintf(os.Stderr, "Misses  : %5d (%s)\n", stats.TotalMisses(), stats.TotalBytesPushed())
+		if c.isolatedFlags.DryRun {
+			fmt.Fprintf(os.Stderr, "Total   : %5d (%s)\n", stats.TotalHits()+stats.TotalMisses(), stats.TotalBytesHits()+stats.TotalBytesPushed())
+		}
+		common.PrintHTTPStats(os.Stderr)
 		fmt.Fprintf(os.Stderr, "Duration: %s\n", common.Round(duration, time.Millisecond))
 	}
 	return err
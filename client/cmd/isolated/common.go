@@ -5,10 +5,12 @@
 package main
 
 import (
+	"net/http"
 	"runtime"
 
 	"github.com/luci/luci-go/client/internal/common"
 	"github.com/luci/luci-go/client/isolatedclient"
+	"github.com/luci/luci-go/common/auth"
 	"github.com/maruel/subcommands"
 )
 
@@ -20,11 +22,13 @@ type commonFlags struct {
 	subcommands.CommandRunBase
 	defaultFlags  common.Flags
 	isolatedFlags isolatedclient.Flags
+	authFlags     auth.Flags
 }
 
 func (c *commonFlags) Init() {
 	c.defaultFlags.Init(&c.Flags)
 	c.isolatedFlags.Init(&c.Flags)
+	c.authFlags.Register(&c.Flags)
 }
 
 func (c *commonFlags) Parse() error {
@@ -33,3 +37,16 @@ func (c *commonFlags) Parse() error {
 	}
 	return c.isolatedFlags.Parse()
 }
+
+// newServer returns the IsolateServer selected by the flags. No credentials
+// are needed on dry run.
+func (c *commonFlags) newServer() (isolatedclient.IsolateServer, error) {
+	var client *http.Client
+	if !c.isolatedFlags.DryRun {
+		var err error
+		if client, err = common.CreateAuthClient(&c.authFlags); err != nil {
+			return nil, err
+		}
+	}
+	return c.isolatedFlags.NewServer(client), nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/swarming"
+	"github.com/maruel/subcommands"
+	"golang.org/x/net/context"
+)
+
+var cmdBots = &subcommands.Command{
+	UsageLine: "bots <options> [<bot_id>]",
+	ShortDesc: "lists bots",
+	LongDesc:  "Lists the bots on the Swarming server that have all the dimensions specified, or shows a single bot.",
+	CommandRun: func() subcommands.CommandRun {
+		r := &botsRun{}
+		r.Init()
+		return r
+	},
+}
+
+type botsRun struct {
+	commonFlags
+	output     outputFlags
+	dimensions common.KeyValVars
+}
+
+func (c *botsRun) Init() {
+	c.commonFlags.Init()
+	c.output.Init(&c.Flags, 0)
+	c.dimensions = common.KeyValVars{}
+	c.Flags.Var(c.dimensions, "dimension", "Only list the bots with this dimension, as key=value; can be repeated")
+}
+
+func (c *botsRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(a); err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		return errors.New("must provide at most one bot id")
+	}
+	if len(args) == 1 && len(c.dimensions) != 0 {
+		return errors.New("can't use -dimension with a bot id")
+	}
+	return c.output.Parse()
+}
+
+// botState returns a short description of the state of a bot.
+func botState(b *swarming.Bot) string {
+	switch {
+	case b.IsDead:
+		return "dead"
+	case b.Quarantined:
+		return "quarantined"
+	case b.IsBusy:
+		return "busy"
+	default:
+		return "idle"
+	}
+}
+
+// formatDimensions returns the dimensions of a bot as sorted key=value pairs.
+func formatDimensions(dims map[string][]string) string {
+	out := make([]string, 0, len(dims))
+	for k, values := range dims {
+		for _, v := range values {
+			out = append(out, k+"="+v)
+		}
+	}
+	sort.Strings(out)
+	return strings.Join(out, ",")
+}
+
+func (c *botsRun) main(a subcommands.Application, args []string) error {
+	client, err := common.CreateAuthClient(&c.authFlags)
+	if err != nil {
+		return err
+	}
+	s, err := swarming.New(client, c.serverURL)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := common.CtrlCContext(context.Background())
+	defer cancel()
+	var bots []*swarming.Bot
+	if len(args) == 1 {
+		bot, err := s.GetBot(ctx, args[0])
+		if err != nil {
+			return fmt.Errorf("failed to load bot %s: %s", args[0], err)
+		}
+		bots = append(bots, bot)
+	} else if bots, err = s.ListBots(ctx, c.dimensions, c.output.limit); err != nil {
+		return err
+	}
+	if c.output.format == "json" {
+		return printJSON(a.GetOut(), bots)
+	}
+	rows := [][]string{{"ID", "STATE", "LAST SEEN", "TASK", "DIMENSIONS"}}
+	for _, b := range bots {
+		rows = append(rows, []string{b.ID, botState(b), formatTime(b.LastSeenTS), string(b.TaskID), formatDimensions(b.Dimensions)})
+	}
+	return printTable(a.GetOut(), rows)
+}
+
+func (c *botsRun) Run(a subcommands.Application, args []string) int {
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	cl, err := c.defaultFlags.StartTracing()
+	if err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	defer cl.Close()
+	defer c.printStats(a)
+	if err := c.main(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
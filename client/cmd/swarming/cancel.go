@@ -0,0 +1,132 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/swarming"
+	"github.com/maruel/subcommands"
+	"golang.org/x/net/context"
+)
+
+var cmdCancel = &subcommands.Command{
+	UsageLine: "cancel <options> [<task_id>...]",
+	ShortDesc: "cancels tasks",
+	LongDesc: `Cancels tasks that didn't complete yet.
+
+The tasks are either specified as arguments or selected with -tag, in which
+case all the pending and running tasks having all the tags are canceled. Use
+-dry-run to list the tasks that would be canceled.`,
+	CommandRun: func() subcommands.CommandRun {
+		r := &cancelRun{}
+		r.Init()
+		return r
+	},
+}
+
+type cancelRun struct {
+	commonFlags
+	tags   common.Strings
+	dryRun bool
+}
+
+func (c *cancelRun) Init() {
+	c.commonFlags.Init()
+	c.Flags.Var(&c.tags, "tag", "Cancel the pending and running tasks with this tag, as key:value; can be repeated")
+	c.Flags.BoolVar(&c.dryRun, "dry-run", false, "Only print the tasks that would be canceled")
+}
+
+func (c *cancelRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(a); err != nil {
+		return err
+	}
+	if len(c.tags) == 0 && len(args) == 0 {
+		return errors.New("must provide -tag or at least one task id")
+	}
+	if len(c.tags) != 0 && len(args) != 0 {
+		return errors.New("can't use both -tag and task ids")
+	}
+	return nil
+}
+
+// cancelTasks cancels the tasks ids, named names, and prints the ones that
+// were canceled. Tasks that already completed are skipped. Returns the number
+// of tasks that couldn't be canceled because of an error.
+func cancelTasks(ctx context.Context, a subcommands.Application, s *swarming.Swarming, names []string, ids []swarming.TaskID) int {
+	failed := 0
+	for i, id := range ids {
+		ok, err := s.Cancel(ctx, id)
+		if err != nil {
+			fmt.Fprintf(a.GetErr(), "%s: failed to cancel %s: %s\n", a.GetName(), names[i], err)
+			failed++
+		} else if ok {
+			fmt.Fprintf(a.GetOut(), "Canceled %s\n", names[i])
+		}
+	}
+	return failed
+}
+
+func (c *cancelRun) main(a subcommands.Application, args []string) error {
+	client, err := common.CreateAuthClient(&c.authFlags)
+	if err != nil {
+		return err
+	}
+	s, err := swarming.New(client, c.serverURL)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := common.CtrlCContext(context.Background())
+	defer cancel()
+
+	var names []string
+	var ids []swarming.TaskID
+	if len(c.tags) == 0 {
+		for _, arg := range args {
+			names = append(names, arg)
+			ids = append(ids, swarming.TaskID(arg))
+		}
+	} else {
+		tasks, err := s.ListTasks(ctx, &swarming.TaskFilter{State: "pending_running", Tags: c.tags})
+		if err != nil {
+			return err
+		}
+		for _, t := range tasks {
+			names = append(names, fmt.Sprintf("%s (%s)", t.ID, t.Name))
+			ids = append(ids, t.ID)
+		}
+	}
+	if c.dryRun {
+		for _, name := range names {
+			fmt.Fprintf(a.GetOut(), "Would cancel %s\n", name)
+		}
+		return nil
+	}
+	if failed := cancelTasks(ctx, a, s, names, ids); failed != 0 {
+		return fmt.Errorf("failed to cancel %d of %d tasks", failed, len(ids))
+	}
+	return nil
+}
+
+func (c *cancelRun) Run(a subcommands.Application, args []string) int {
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	cl, err := c.defaultFlags.StartTracing()
+	if err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	defer cl.Close()
+	defer c.printStats(a)
+	if err := c.main(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,73 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/luci/luci-go/client/swarming"
+	"github.com/luci/luci-go/client/swarming/swarmingfake"
+	"github.com/maruel/ut"
+	"golang.org/x/net/context"
+)
+
+func TestCancelByTag(t *testing.T) {
+	t.Parallel()
+	server := swarmingfake.New(swarmingfake.Options{})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	for _, v := range []struct{ name, tag string }{{"done", "a:1"}, {"pending", "a:1"}, {"other", "a:2"}} {
+		code, _ := run(t, ts.URL, "trigger", "-dimension", "os=Linux", "-task-name", v.name, "-tag", v.tag, "--", "true")
+		ut.AssertEqual(t, 0, code)
+	}
+	s, err := swarming.New(nil, ts.URL)
+	ut.AssertEqual(t, nil, err)
+	for i := 0; i < 2; i++ {
+		_, err := s.FetchResult(context.Background(), "1")
+		ut.AssertEqual(t, nil, err)
+	}
+
+	code, out := run(t, ts.URL, "cancel", "-tag", "a:1", "-dry-run")
+	ut.AssertEqual(t, 0, code)
+	ut.AssertEqual(t, "Would cancel 2 (pending)\n", out)
+	ut.AssertEqual(t, swarming.Pending, server.Tasks()[1].State)
+
+	code, out = run(t, ts.URL, "cancel", "-tag", "a:1")
+	ut.AssertEqual(t, 0, code)
+	ut.AssertEqual(t, "Canceled 2 (pending)\n", out)
+	tasks := server.Tasks()
+	ut.AssertEqual(t, swarming.Completed, tasks[0].State)
+	ut.AssertEqual(t, swarming.Canceled, tasks[1].State)
+	ut.AssertEqual(t, swarming.Pending, tasks[2].State)
+
+	// A task that already completed is skipped.
+	code, out = run(t, ts.URL, "cancel", "1", "3")
+	ut.AssertEqual(t, 0, code)
+	ut.AssertEqual(t, "Canceled 3\n", out)
+	code, _ = run(t, ts.URL, "cancel", "42")
+	ut.AssertEqual(t, 1, code)
+	ut.AssertEqual(t, nil, server.Error())
+}
+
+func TestRetry(t *testing.T) {
+	t.Parallel()
+	server := swarmingfake.New(swarmingfake.Options{})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	code, _ := run(t, ts.URL, "trigger", "-dimension", "os=Linux", "-task-name", "hi", "-tag", "a:1", "--", "true")
+	ut.AssertEqual(t, 0, code)
+	code, out := run(t, ts.URL, "retry", "-priority", "10", "-tag", "b:2", "1")
+	ut.AssertEqual(t, 0, code)
+	ut.AssertEqual(t, "Retried 1 as 2: "+ts.URL+"/user/task/2\n", out)
+	tasks := server.Tasks()
+	ut.AssertEqual(t, 2, len(tasks))
+	ut.AssertEqual(t, "hi", tasks[1].Name)
+	ut.AssertEqual(t, 10, tasks[1].TaskRequest.Priority)
+	ut.AssertEqual(t, []string{"b:2", "retry_of:1"}, tasks[1].TaskRequest.Tags)
+	ut.AssertEqual(t, nil, server.Error())
+}
@@ -0,0 +1,329 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/isolatedclient"
+	"github.com/luci/luci-go/client/swarming"
+	"github.com/luci/luci-go/common/isolated"
+	"github.com/maruel/subcommands"
+	"golang.org/x/net/context"
+)
+
+var cmdCollect = &subcommands.Command{
+	UsageLine: "collect <options> [<task_id>...]",
+	ShortDesc: "waits for tasks and retrieves their results",
+	LongDesc: `Waits for tasks to complete and retrieves their results.
+
+The tasks are either specified as arguments or loaded from the file written by
+"trigger -dump-json". The output of each task is printed as it becomes
+available. The exit code is the highest exit code of all the tasks.`,
+	CommandRun: func() subcommands.CommandRun {
+		r := &collectRun{}
+		r.Init()
+		return r
+	},
+}
+
+// collectFlags are the flags shared by the commands waiting for tasks.
+type collectFlags struct {
+	timeout       time.Duration
+	summaryJSON   string
+	taskOutputDir string
+	noOutput      bool
+}
+
+func (c *collectFlags) Init(f *flag.FlagSet) {
+	f.DurationVar(&c.timeout, "timeout", 0, "Maximum time to wait for the tasks; 0 means no limit")
+	f.StringVar(&c.summaryJSON, "task-summary-json", "", "Write the results of all the tasks to this file as JSON")
+	f.StringVar(&c.taskOutputDir, "task-output-dir", "", "Download the isolated outputs of the tasks in this directory, one subdirectory per task ID")
+	f.BoolVar(&c.noOutput, "no-output", false, "Do not print the output of the tasks")
+}
+
+func (c *collectFlags) Parse() error {
+	if c.timeout < 0 {
+		return errors.New("-timeout must be non-negative")
+	}
+	if c.taskOutputDir != "" {
+		p, err := filepath.Abs(c.taskOutputDir)
+		if err != nil {
+			return err
+		}
+		c.taskOutputDir = p
+	}
+	return nil
+}
+
+type collectRun struct {
+	commonFlags
+	collectFlags
+	json string
+}
+
+func (c *collectRun) Init() {
+	c.commonFlags.Init()
+	c.collectFlags.Init(&c.Flags)
+	c.Flags.StringVar(&c.json, "json", "", "Load the tasks from this file as written by \"trigger -dump-json\"")
+}
+
+func (c *collectRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(a); err != nil {
+		return err
+	}
+	if err := c.collectFlags.Parse(); err != nil {
+		return err
+	}
+	if c.json == "" && len(args) == 0 {
+		return errors.New("must provide -json or at least one task id")
+	}
+	if c.json != "" && len(args) != 0 {
+		return errors.New("can't use both -json and task ids")
+	}
+	return nil
+}
+
+// tasks returns the tasks to collect, keyed by name.
+func (c *collectRun) tasks(args []string) (map[string]swarming.TaskID, error) {
+	out := map[string]swarming.TaskID{}
+	if c.json == "" {
+		for _, arg := range args {
+			out[arg] = swarming.TaskID(arg)
+		}
+		return out, nil
+	}
+	data := &triggerResults{}
+	if err := common.ReadJSONFile(c.json, data); err != nil {
+		return nil, err
+	}
+	if len(data.Tasks) == 0 {
+		return nil, fmt.Errorf("no task in %s", c.json)
+	}
+	for name, t := range data.Tasks {
+		out[name] = t.TaskID
+	}
+	return out, nil
+}
+
+// Polling interval bounds while waiting for a task. It is reset to the minimum
+// whenever the task makes progress. They are lowered in tests.
+var (
+	minPollInterval = time.Second
+	maxPollInterval = 15 * time.Second
+)
+
+// collectTask polls a task until it completes, printing its output as it is
+// received.
+func collectTask(ctx context.Context, s *swarming.Swarming, id swarming.TaskID, out *taskOutput) (*swarming.TaskResult, error) {
+	sleep := minPollInterval
+	for {
+		r, err := s.FetchResult(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		// There's no output until a bot picks up the task.
+		if out != nil && r.BotID != "" {
+			output, err := s.FetchOutput(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			if out.update(output, r.IsFinal()) {
+				sleep = minPollInterval
+			}
+		}
+		if r.IsFinal() {
+			return r, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(sleep):
+		}
+		if sleep *= 2; sleep > maxPollInterval {
+			sleep = maxPollInterval
+		}
+	}
+}
+
+// taskOutput prints the output of a task as it is received. Only complete
+// lines are printed until the task is done.
+type taskOutput struct {
+	lock    *sync.Mutex // Shared by all the tasks writing to w.
+	w       io.Writer
+	prefix  string
+	printed int
+}
+
+// update prints the part of output not printed yet. Returns true if anything
+// was printed.
+func (t *taskOutput) update(output string, final bool) bool {
+	if len(output) <= t.printed {
+		return false
+	}
+	next := output[t.printed:]
+	if !final {
+		i := strings.LastIndex(next, "\n")
+		if i == -1 {
+			return false
+		}
+		next = next[:i+1]
+	} else if !strings.HasSuffix(next, "\n") {
+		next += "\n"
+	}
+	t.printed += len(next)
+	if t.prefix != "" {
+		next = t.prefix + strings.Replace(strings.TrimSuffix(next, "\n"), "\n", "\n"+t.prefix, -1) + "\n"
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, _ = io.WriteString(t.w, next)
+	return true
+}
+
+// exitCode returns the exit code to report for a task.
+func exitCode(r *swarming.TaskResult) int {
+	worst := 0
+	for _, e := range r.ExitCodes {
+		worst = max(worst, e)
+	}
+	if worst == 0 && (len(r.ExitCodes) == 0 || r.InternalFailure || r.Failure) {
+		// The task didn't run to completion, e.g. it expired, timed out or the
+		// bot died.
+		worst = 1
+	}
+	return worst
+}
+
+func (c *collectRun) main(a subcommands.Application, args []string) (int, error) {
+	tasks, err := c.tasks(args)
+	if err != nil {
+		return 1, err
+	}
+	client, err := common.CreateAuthClient(&c.authFlags)
+	if err != nil {
+		return 1, err
+	}
+	s, err := swarming.New(client, c.serverURL)
+	if err != nil {
+		return 1, err
+	}
+	ctx, cancel := common.CtrlCContext(context.Background())
+	defer cancel()
+
+	names := make([]string, 0, len(tasks))
+	for name := range tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ids := make([]swarming.TaskID, len(names))
+	for i, name := range names {
+		ids[i] = tasks[name]
+	}
+	code, _, err := c.collect(ctx, a, client, s, names, ids)
+	return code, err
+}
+
+// collect waits for the tasks ids, named names, and reports their results.
+// It returns the highest exit code of the tasks and whether the final result
+// of all of them was retrieved.
+func (c *collectFlags) collect(ctx context.Context, a subcommands.Application, client *http.Client, s *swarming.Swarming, names []string, ids []swarming.TaskID) (int, bool, error) {
+	if c.timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	type result struct {
+		r   *swarming.TaskResult
+		err error
+	}
+	results := make([]result, len(names))
+	lock := &sync.Mutex{}
+	var wg sync.WaitGroup
+	for i, name := range names {
+		var out *taskOutput
+		if !c.noOutput {
+			out = &taskOutput{lock: lock, w: a.GetOut()}
+			if len(names) > 1 {
+				out.prefix = "[" + name + "] "
+			}
+		}
+		wg.Add(1)
+		go func(i int, id swarming.TaskID, out *taskOutput) {
+			defer wg.Done()
+			r, err := collectTask(ctx, s, id, out)
+			results[i] = result{r, err}
+		}(i, ids[i], out)
+	}
+	wg.Wait()
+
+	worst := 0
+	complete := true
+	summary := map[string]*swarming.TaskResult{}
+	for i, name := range names {
+		r := results[i]
+		if r.err != nil {
+			fmt.Fprintf(a.GetErr(), "%s: failed to collect %s: %s\n", a.GetName(), name, r.err)
+			worst = max(worst, 1)
+			complete = false
+			continue
+		}
+		summary[name] = r.r
+		code := exitCode(r.r)
+		worst = max(worst, code)
+		fmt.Fprintf(a.GetOut(), "%s: %s, exit code %d in %s after pending %s (exit codes %v, durations %v)\n", name, r.r.State, code, r.r.Duration(), r.r.PendingDuration(), r.r.ExitCodes, r.r.Durations)
+		if c.taskOutputDir != "" && r.r.OutputsRef != nil {
+			ref := r.r.OutputsRef
+			is := isolatedclient.New(client, ref.IsolatedServer, ref.Namespace)
+			dir := filepath.Join(c.taskOutputDir, string(ids[i]))
+			if _, err := isolatedclient.FetchTree(ctx, is, isolated.HexDigest(ref.Isolated), dir); err != nil {
+				fmt.Fprintf(a.GetErr(), "%s: failed to fetch outputs of %s: %s\n", a.GetName(), name, err)
+				worst = max(worst, 1)
+			}
+		}
+	}
+	if c.summaryJSON != "" {
+		if err := common.WriteJSONFile(c.summaryJSON, summary); err != nil {
+			return max(worst, 1), complete, err
+		}
+	}
+	return worst, complete, nil
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (c *collectRun) Run(a subcommands.Application, args []string) int {
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	cl, err := c.defaultFlags.StartTracing()
+	if err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	defer cl.Close()
+	defer c.printStats(a)
+	code, err := c.main(a, args)
+	if err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+	}
+	return code
+}
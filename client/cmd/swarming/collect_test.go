@@ -0,0 +1,46 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/luci/luci-go/client/swarming"
+	"github.com/maruel/ut"
+)
+
+func TestTaskOutput(t *testing.T) {
+	t.Parallel()
+	buf := &bytes.Buffer{}
+	o := &taskOutput{lock: &sync.Mutex{}, w: buf, prefix: "[a] "}
+	ut.AssertEqual(t, false, o.update("", false))
+	// Partial lines are held until completed.
+	ut.AssertEqual(t, false, o.update("foo", false))
+	ut.AssertEqual(t, true, o.update("foo\nbar\nba", false))
+	ut.AssertEqual(t, "[a] foo\n[a] bar\n", buf.String())
+	ut.AssertEqual(t, false, o.update("foo\nbar\nba", false))
+	// Everything is flushed once the task is done.
+	ut.AssertEqual(t, true, o.update("foo\nbar\nbaz", true))
+	ut.AssertEqual(t, "[a] foo\n[a] bar\n[a] baz\n", buf.String())
+}
+
+func TestExitCode(t *testing.T) {
+	t.Parallel()
+	data := []struct {
+		r        swarming.TaskResult
+		expected int
+	}{
+		{swarming.TaskResult{ExitCodes: []int{0}}, 0},
+		{swarming.TaskResult{ExitCodes: []int{0, 3, 2}}, 3},
+		{swarming.TaskResult{ExitCodes: []int{0}, InternalFailure: true}, 1},
+		{swarming.TaskResult{ExitCodes: []int{-1}, Failure: true}, 1},
+		{swarming.TaskResult{}, 1},
+	}
+	for i, line := range data {
+		ut.AssertEqualIndex(t, i, line.expected, exitCode(&line.r))
+	}
+}
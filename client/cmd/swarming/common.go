@@ -5,12 +5,19 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"os"
 	"runtime"
+	"strings"
+	"text/tabwriter"
 
 	"github.com/luci/luci-go/client/internal/common"
 	"github.com/luci/luci-go/client/internal/lhttp"
+	"github.com/luci/luci-go/common/auth"
 	"github.com/maruel/subcommands"
 )
 
@@ -21,12 +28,14 @@ func init() {
 type commonFlags struct {
 	subcommands.CommandRunBase
 	defaultFlags common.Flags
+	authFlags    auth.Flags
 	serverURL    string
 }
 
 // Init initializes common flags.
 func (c *commonFlags) Init() {
 	c.defaultFlags.Init(&c.Flags)
+	c.authFlags.Register(&c.Flags)
 	c.Flags.StringVar(&c.serverURL, "server", os.Getenv("SWARMING_SERVER"), "Server URL; required. Set $SWARMING_SERVER to set a default.")
 }
 
@@ -45,3 +54,52 @@ func (c *commonFlags) Parse(a subcommands.Application) error {
 	c.serverURL = s
 	return nil
 }
+
+// printStats prints the summary of the HTTP requests unless -quiet is used.
+func (c *commonFlags) printStats(a subcommands.Application) {
+	if !c.defaultFlags.Quiet {
+		common.PrintHTTPStats(a.GetErr())
+	}
+}
+
+// outputFlags are the flags shared by the commands listing items.
+type outputFlags struct {
+	limit  int
+	format string
+}
+
+func (o *outputFlags) Init(f *flag.FlagSet, limit int) {
+	f.IntVar(&o.limit, "limit", limit, "Maximum number of items to return; 0 means no limit")
+	f.StringVar(&o.format, "format", "table", "Output format; one of \"table\" or \"json\"")
+}
+
+func (o *outputFlags) Parse() error {
+	if o.limit < 0 {
+		return errors.New("-limit must be non-negative")
+	}
+	if o.format != "table" && o.format != "json" {
+		return fmt.Errorf("invalid -format %q", o.format)
+	}
+	return nil
+}
+
+// printJSON prints v as indented JSON.
+func printJSON(w io.Writer, v interface{}) error {
+	d, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", d)
+	return err
+}
+
+// printTable prints rows as aligned columns, the first row being the header.
+func printTable(w io.Writer, rows [][]string) error {
+	t := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, row := range rows {
+		if _, err := fmt.Fprintln(t, strings.Join(row, "\t")); err != nil {
+			return err
+		}
+	}
+	return t.Flush()
+}
@@ -9,12 +9,13 @@ import (
 	"os"
 
 	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/common/auth"
 	"github.com/maruel/subcommands"
 )
 
 // version must be updated whenever functional change (behavior, arguments,
 // supported commands) is done.
-const version = "0.1"
+const version = "0.14"
 
 var application = &subcommands.DefaultApplication{
 	Name:  "swarming",
@@ -22,7 +23,20 @@ var application = &subcommands.DefaultApplication{
 	// Keep in alphabetical order of their name.
 	Commands: []*subcommands.Command{
 		subcommands.CmdHelp,
+		cmdBots,
+		cmdCancel,
+		cmdCollect,
+		auth.SubcommandInfo(auth.Options{}, "info"),
+		auth.SubcommandLogin(auth.Options{}, "login"),
+		auth.SubcommandLogout(auth.Options{}, "logout"),
+		cmdQuery,
+		cmdReproduce,
 		cmdRequestShow,
+		cmdRetry,
+		cmdRun,
+		cmdTasks,
+		auth.SubcommandToken(auth.Options{}, "token"),
+		cmdTrigger,
 		common.CmdVersion(version),
 	},
 }
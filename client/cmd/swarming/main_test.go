@@ -0,0 +1,158 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/swarming"
+	"github.com/luci/luci-go/client/swarming/swarmingfake"
+	"github.com/luci/luci-go/common/auth"
+	"github.com/maruel/subcommands"
+	"github.com/maruel/ut"
+)
+
+func init() {
+	// Never use real credentials in tests.
+	common.NewAuthClient = func(auth.Options) (*http.Client, error) {
+		return http.DefaultClient, nil
+	}
+	minPollInterval = time.Millisecond
+	maxPollInterval = time.Millisecond
+}
+
+// testApp captures the output of the commands.
+type testApp struct {
+	*subcommands.DefaultApplication
+	out bytes.Buffer
+	err bytes.Buffer
+}
+
+func (t *testApp) GetOut() io.Writer {
+	return &t.out
+}
+
+func (t *testApp) GetErr() io.Writer {
+	return &t.err
+}
+
+// run runs the swarming command with args against the server and returns its
+// exit code and output.
+func run(t *testing.T, server string, args ...string) (int, string) {
+	a := &testApp{DefaultApplication: application}
+	args = append([]string{args[0], "-server", server}, args[1:]...)
+	code := subcommands.Run(a, args)
+	if a.err.Len() != 0 {
+		t.Logf("%s", a.err.String())
+	}
+	return code, a.out.String()
+}
+
+func TestTriggerCollect(t *testing.T) {
+	t.Parallel()
+	tmpDir, err := ioutil.TempDir("", "swarming")
+	ut.AssertEqual(t, nil, err)
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Fail()
+		}
+	}()
+	server := swarmingfake.New(swarmingfake.Options{
+		Run: func(r *swarming.TaskRequest) (int, string) {
+			return 3, "hello\n" + strings.Join(r.Properties.Commands[0], " ") + "\n"
+		},
+	})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	tasksJSON := filepath.Join(tmpDir, "tasks.json")
+	code, out := run(t, ts.URL, "trigger", "-dimension", "os=Linux", "-task-name", "hi", "-dump-json", tasksJSON, "--", "echo", "world")
+	ut.AssertEqual(t, 0, code)
+	ut.AssertEqual(t, "Triggered hi: "+ts.URL+"/user/task/1\n", out)
+
+	summaryJSON := filepath.Join(tmpDir, "summary.json")
+	code, out = run(t, ts.URL, "collect", "-json", tasksJSON, "-task-summary-json", summaryJSON)
+	ut.AssertEqual(t, 3, code)
+	lines := strings.Split(out, "\n")
+	ut.AssertEqual(t, []string{"hello", "echo world"}, lines[:2])
+	ut.AssertEqual(t, true, strings.HasPrefix(lines[2], "hi: COMPLETED, exit code 3 in "))
+
+	summary := map[string]*swarming.TaskResult{}
+	raw, err := ioutil.ReadFile(summaryJSON)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, json.Unmarshal(raw, &summary))
+	ut.AssertEqual(t, []int{3}, summary["hi"].ExitCodes)
+	ut.AssertEqual(t, nil, server.Error())
+}
+
+func TestCollectExpired(t *testing.T) {
+	t.Parallel()
+	server := swarmingfake.New(swarmingfake.Options{
+		Bots: []*swarming.Bot{{ID: "mac", Dimensions: map[string][]string{"os": {"Mac"}}}},
+	})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	code, _ := run(t, ts.URL, "trigger", "-dimension", "os=Linux", "-task-name", "hi", "--", "true")
+	ut.AssertEqual(t, 0, code)
+	code, out := run(t, ts.URL, "collect", "1")
+	ut.AssertEqual(t, 1, code)
+	ut.AssertEqual(t, true, strings.HasPrefix(out, "1: EXPIRED, exit code 1 in "))
+	ut.AssertEqual(t, nil, server.Error())
+}
+
+func TestTasksBots(t *testing.T) {
+	t.Parallel()
+	server := swarmingfake.New(swarmingfake.Options{
+		Bots: []*swarming.Bot{
+			{ID: "linux1", Dimensions: map[string][]string{"os": {"Linux"}}},
+			{ID: "mac1", Dimensions: map[string][]string{"os": {"Mac"}}},
+		},
+	})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	for _, tag := range []string{"a:1", "a:2"} {
+		code, _ := run(t, ts.URL, "trigger", "-dimension", "os=Linux", "-task-name", tag, "-tag", tag, "--", "true")
+		ut.AssertEqual(t, 0, code)
+	}
+	code, out := run(t, ts.URL, "tasks", "-tag", "a:2", "-format", "json")
+	ut.AssertEqual(t, 0, code)
+	var tasks []*swarming.TaskResult
+	ut.AssertEqual(t, nil, json.Unmarshal([]byte(out), &tasks))
+	ut.AssertEqual(t, 1, len(tasks))
+	ut.AssertEqual(t, "a:2", tasks[0].Name)
+
+	code, out = run(t, ts.URL, "tasks", "-state", "pending")
+	ut.AssertEqual(t, 0, code)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	ut.AssertEqual(t, 3, len(lines))
+	ut.AssertEqual(t, true, strings.HasPrefix(lines[1], "2 "))
+
+	code, out = run(t, ts.URL, "bots", "-dimension", "os=Mac")
+	ut.AssertEqual(t, 0, code)
+	lines = strings.Split(strings.TrimSpace(out), "\n")
+	ut.AssertEqual(t, 2, len(lines))
+	ut.AssertEqual(t, true, strings.HasPrefix(lines[1], "mac1 "))
+
+	code, out = run(t, ts.URL, "query", "-limit", "1", "bots")
+	ut.AssertEqual(t, 0, code)
+	var bots []*swarming.Bot
+	ut.AssertEqual(t, nil, json.Unmarshal([]byte(out), &bots))
+	ut.AssertEqual(t, 1, len(bots))
+	ut.AssertEqual(t, "linux1", bots[0].ID)
+	ut.AssertEqual(t, nil, server.Error())
+}
@@ -0,0 +1,108 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/swarming"
+	"github.com/maruel/subcommands"
+	"golang.org/x/net/context"
+)
+
+var cmdQuery = &subcommands.Command{
+	UsageLine: "query <options> <resource>",
+	ShortDesc: "queries a list resource of the Swarming API",
+	LongDesc: `Queries a list resource of the Swarming API and prints all the items as
+JSON, following the cursor.
+
+The resource is relative to /swarming/api/v1/client/ and may contain query
+parameters, e.g. "tasks?state=pending&tag=os:Linux".`,
+	CommandRun: func() subcommands.CommandRun {
+		r := &queryRun{}
+		r.Init()
+		return r
+	},
+}
+
+type queryRun struct {
+	commonFlags
+	limit int
+}
+
+func (c *queryRun) Init() {
+	c.commonFlags.Init()
+	c.Flags.IntVar(&c.limit, "limit", 200, "Maximum number of items to return; 0 means no limit")
+}
+
+func (c *queryRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(a); err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("must provide a single resource")
+	}
+	if c.limit < 0 {
+		return errors.New("-limit must be non-negative")
+	}
+	return nil
+}
+
+func (c *queryRun) main(a subcommands.Application, resource string) error {
+	u, err := url.Parse(strings.TrimLeft(resource, "/"))
+	if err != nil {
+		return err
+	}
+	client, err := common.CreateAuthClient(&c.authFlags)
+	if err != nil {
+		return err
+	}
+	s, err := swarming.New(client, c.serverURL)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := common.CtrlCContext(context.Background())
+	defer cancel()
+	items := []json.RawMessage{}
+	err = s.List(ctx, "/swarming/api/v1/client/"+u.Path, u.Query(), c.limit, func(raw json.RawMessage) (int, error) {
+		var page []json.RawMessage
+		if err := json.Unmarshal(raw, &page); err != nil {
+			return 0, err
+		}
+		items = append(items, page...)
+		return len(page), nil
+	})
+	if err != nil {
+		return err
+	}
+	if c.limit > 0 && len(items) > c.limit {
+		items = items[:c.limit]
+	}
+	return printJSON(a.GetOut(), items)
+}
+
+func (c *queryRun) Run(a subcommands.Application, args []string) int {
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	cl, err := c.defaultFlags.StartTracing()
+	if err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	defer cl.Close()
+	defer c.printStats(a)
+	if err := c.main(a, args[0]); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,385 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/internal/lhttp"
+	"github.com/luci/luci-go/client/internal/throttle"
+	"github.com/luci/luci-go/client/isolatedclient"
+	"github.com/luci/luci-go/client/swarming"
+	"github.com/luci/luci-go/common/isolated"
+	"github.com/maruel/subcommands"
+	"golang.org/x/net/context"
+)
+
+var cmdReproduce = &subcommands.Command{
+	UsageLine: "reproduce <options> <task_id>",
+	ShortDesc: "runs a task locally",
+	LongDesc: `Runs the request of a task locally.
+
+The task's data and isolated inputs are downloaded in the work directory, then
+its commands are run with the same environment variables and timeouts as on a
+bot. The results are reported in the same shape as a task result.`,
+	CommandRun: func() subcommands.CommandRun {
+		r := &reproduceRun{}
+		r.Init()
+		return r
+	},
+}
+
+type reproduceRun struct {
+	commonFlags
+	work        string
+	summaryJSON string
+}
+
+func (c *reproduceRun) Init() {
+	c.commonFlags.Init()
+	c.Flags.StringVar(&c.work, "work", "work", "Directory to download the inputs and run the task in; must not exist")
+	c.Flags.StringVar(&c.summaryJSON, "task-summary-json", "", "Write the result of the task to this file as JSON")
+}
+
+func (c *reproduceRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(a); err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("must only provide a task id")
+	}
+	p, err := filepath.Abs(c.work)
+	if err != nil {
+		return err
+	}
+	c.work = p
+	if _, err := os.Stat(c.work); err == nil {
+		return fmt.Errorf("%s already exists", c.work)
+	}
+	return nil
+}
+
+func (c *reproduceRun) main(a subcommands.Application, taskID string) (int, error) {
+	client, err := common.CreateAuthClient(&c.authFlags)
+	if err != nil {
+		return 1, err
+	}
+	s, err := swarming.New(client, c.serverURL)
+	if err != nil {
+		return 1, err
+	}
+	ctx, cancel := common.CtrlCContext(context.Background())
+	defer cancel()
+	req, err := s.FetchRequest(ctx, swarming.TaskID(taskID))
+	if err != nil {
+		return 1, fmt.Errorf("failed to load task %s: %s", taskID, err)
+	}
+	if err := os.MkdirAll(c.work, 0755); err != nil {
+		return 1, err
+	}
+
+	// Prepare the inputs like a bot does.
+	p := &req.Properties
+	for _, d := range p.Data {
+		if len(d) != 2 {
+			return 1, fmt.Errorf("invalid data item %v", d)
+		}
+		path := filepath.Join(c.work, filepath.FromSlash(d[1]))
+		if !strings.HasPrefix(path, c.work+string(filepath.Separator)) {
+			return 1, fmt.Errorf("invalid data item %v", d)
+		}
+		if err := fetchData(ctx, d[0], path, c.work); err != nil {
+			return 1, fmt.Errorf("failed to fetch %s: %s", d[0], err)
+		}
+	}
+	commands := p.Commands
+	dir := c.work
+	if ref := p.InputsRef; ref != nil {
+		is := isolatedclient.New(client, ref.IsolatedServer, ref.Namespace)
+		i, err := isolatedclient.FetchTree(ctx, is, isolated.HexDigest(ref.Isolated), c.work)
+		if err != nil {
+			return 1, fmt.Errorf("failed to fetch %s: %s", ref.Isolated, err)
+		}
+		if len(i.Command) != 0 {
+			commands = append(commands, append(i.Command, p.ExtraArgs...))
+		}
+		dir = filepath.Join(c.work, filepath.FromSlash(i.RelativeCwd))
+	}
+	if len(commands) == 0 {
+		return 1, errors.New("the task has no command")
+	}
+
+	r := &runner{
+		dir:         dir,
+		env:         mergeEnv(os.Environ(), p.Env),
+		hardTimeout: time.Duration(p.ExecutionTimeoutSecs) * time.Second,
+		ioTimeout:   time.Duration(p.IoTimeoutSecs) * time.Second,
+		out:         a.GetOut(),
+	}
+	result := &swarming.TaskResult{
+		TaskRequest: *req,
+		ID:          swarming.TaskID(taskID),
+		Name:        req.Name,
+		StartedTS:   swarming.Timestamp{Time: time.Now()},
+		State:       swarming.Completed,
+	}
+	for _, cmd := range commands {
+		start := time.Now()
+		code, state, err := r.run(ctx, cmd)
+		if err != nil {
+			return 1, err
+		}
+		result.ExitCodes = append(result.ExitCodes, code)
+		result.Durations = append(result.Durations, time.Since(start).Seconds())
+		result.State = state
+		// Like on a bot, stop at the first failing command.
+		if code != 0 || state != swarming.Completed {
+			result.Failure = true
+			break
+		}
+	}
+	if result.State == swarming.Completed {
+		result.CompletedTS = swarming.Timestamp{Time: time.Now()}
+	} else {
+		result.AbandonedTS = swarming.Timestamp{Time: time.Now()}
+	}
+	code := exitCode(result)
+	fmt.Fprintf(a.GetOut(), "%s: %s, exit code %d in %s (exit codes %v, durations %v)\n", taskID, result.State, code, result.Duration(), result.ExitCodes, result.Durations)
+	if c.summaryJSON != "" {
+		if err := common.WriteJSONFile(c.summaryJSON, result); err != nil {
+			return 1, err
+		}
+	}
+	return code, nil
+}
+
+func (c *reproduceRun) Run(a subcommands.Application, args []string) int {
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	cl, err := c.defaultFlags.StartTracing()
+	if err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	defer cl.Close()
+	defer c.printStats(a)
+	code, err := c.main(a, args[0])
+	if err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+	}
+	return code
+}
+
+// mergeEnv returns base with the variables in env added or overridden.
+func mergeEnv(base []string, env map[string]string) []string {
+	out := make([]string, 0, len(base)+len(env))
+	for _, kv := range base {
+		if _, ok := env[strings.SplitN(kv, "=", 2)[0]]; !ok {
+			out = append(out, kv)
+		}
+	}
+	for k, v := range env {
+		out = append(out, k+"="+v)
+	}
+	return out
+}
+
+// fetchData downloads the zip file at url to path and extracts it in dir.
+//
+// Like on a bot, the request is not authenticated since url may point to any
+// server.
+func fetchData(ctx context.Context, url, path, dir string) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := lhttp.Do(ctx, http.DefaultClient, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http request failed: %s", resp.Status)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, throttle.Default.Reader(resp.Body))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	return unzip(path, dir)
+}
+
+// unzip extracts the zip file src in dir.
+func unzip(src, dir string) error {
+	z, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer z.Close()
+	for _, f := range z.File {
+		dst := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if !strings.HasPrefix(dst, dir+string(filepath.Separator)) {
+			return fmt.Errorf("invalid path %s in %s", f.Name, src)
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(dst, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := extractFile(f, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractFile(f *zip.File, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode()|0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if err2 := w.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// runner runs commands like a bot does.
+type runner struct {
+	dir         string
+	env         []string
+	hardTimeout time.Duration // 0 means no timeout.
+	ioTimeout   time.Duration // 0 means no timeout.
+	out         io.Writer
+}
+
+// activityWriter records the last time something was written.
+type activityWriter struct {
+	w    io.Writer
+	lock *sync.Mutex // Shared between stdout and stderr.
+	last *int64      // UnixNano; accessed atomically.
+}
+
+func (a *activityWriter) Write(p []byte) (int, error) {
+	atomic.StoreInt64(a.last, time.Now().UnixNano())
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.w.Write(p)
+}
+
+// run runs cmd and returns its exit code and the resulting state, either
+// Completed or TimedOut. The process and the processes it started are killed
+// on timeout or when ctx is canceled.
+func (r *runner) run(ctx context.Context, cmd []string) (int, swarming.TaskState, error) {
+	last := time.Now().UnixNano()
+	out := &activityWriter{w: r.out, lock: &sync.Mutex{}, last: &last}
+	p := exec.Command(cmd[0], cmd[1:]...)
+	p.Dir = r.dir
+	p.Env = r.env
+	p.Stdout = out
+	p.Stderr = out
+	// Processes started by the command inherit its output, so they must be
+	// killed too for Wait() to return.
+	newProcessGroup(p)
+	if err := p.Start(); err != nil {
+		return 0, 0, err
+	}
+
+	var timedOut int32
+	done := make(chan struct{})
+	go func() {
+		var hard <-chan time.Time
+		if r.hardTimeout != 0 {
+			t := time.NewTimer(r.hardTimeout)
+			defer t.Stop()
+			hard = t.C
+		}
+		var tick <-chan time.Time
+		if r.ioTimeout != 0 {
+			t := time.NewTicker(checkInterval(r.ioTimeout))
+			defer t.Stop()
+			tick = t.C
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				_ = killProcessTree(p)
+				return
+			case <-hard:
+				atomic.StoreInt32(&timedOut, 1)
+				_ = killProcessTree(p)
+				return
+			case <-tick:
+				if time.Since(time.Unix(0, atomic.LoadInt64(&last))) >= r.ioTimeout {
+					atomic.StoreInt32(&timedOut, 1)
+					_ = killProcessTree(p)
+					return
+				}
+			}
+		}
+	}()
+	err := p.Wait()
+	close(done)
+	if ctx.Err() != nil {
+		return 0, 0, ctx.Err()
+	}
+	code := 0
+	if err != nil {
+		exit, ok := err.(*exec.ExitError)
+		if !ok {
+			return 0, 0, err
+		}
+		code = exit.Sys().(syscall.WaitStatus).ExitStatus()
+	}
+	if atomic.LoadInt32(&timedOut) != 0 {
+		return code, swarming.TimedOut, nil
+	}
+	return code, swarming.Completed, nil
+}
+
+// checkInterval returns how often to check for I/O timeout.
+func checkInterval(ioTimeout time.Duration) time.Duration {
+	d := ioTimeout / 10
+	if d > time.Second {
+		return time.Second
+	}
+	if d <= 0 {
+		return ioTimeout
+	}
+	return d
+}
@@ -0,0 +1,200 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luci/luci-go/client/swarming"
+	"github.com/luci/luci-go/client/swarming/swarmingfake"
+	"github.com/maruel/ut"
+	"golang.org/x/net/context"
+)
+
+// TestHelperProcess isn't a real test; it is the child process run by the
+// tests below.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("SWARMING_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := os.Args
+	for len(args) != 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	args = args[1:]
+	switch args[0] {
+	case "exit":
+		fmt.Printf("FOO=%s\n", os.Getenv("FOO"))
+		code, _ := strconv.Atoi(args[1])
+		os.Exit(code)
+	case "sleep":
+		time.Sleep(time.Minute)
+	case "spawn":
+		// Start a child that keeps the output open after this process died.
+		c := exec.Command(os.Args[0], "-test.run=TestHelperProcess", "--", "sleep")
+		c.Stdout = os.Stdout
+		if err := c.Start(); err != nil {
+			os.Exit(1)
+		}
+		time.Sleep(time.Minute)
+	case "chatty":
+		for start := time.Now(); time.Since(start) < time.Minute; {
+			fmt.Println("still alive")
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	os.Exit(0)
+}
+
+func helperCommand(args ...string) []string {
+	return append([]string{os.Args[0], "-test.run=TestHelperProcess", "--"}, args...)
+}
+
+func newTestRunner(hard, io time.Duration) (*runner, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	r := &runner{
+		env:         mergeEnv(os.Environ(), map[string]string{"SWARMING_HELPER_PROCESS": "1", "FOO": "bar"}),
+		hardTimeout: hard,
+		ioTimeout:   io,
+		out:         buf,
+	}
+	return r, buf
+}
+
+func TestRunnerExitCode(t *testing.T) {
+	t.Parallel()
+	r, buf := newTestRunner(time.Minute, time.Minute)
+	code, state, err := r.run(context.Background(), helperCommand("exit", "3"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 3, code)
+	ut.AssertEqual(t, swarming.Completed, state)
+	ut.AssertEqual(t, "FOO=bar\n", buf.String())
+}
+
+func TestRunnerHardTimeout(t *testing.T) {
+	t.Parallel()
+	// Output doesn't prevent the hard timeout.
+	r, _ := newTestRunner(200*time.Millisecond, time.Minute)
+	_, state, err := r.run(context.Background(), helperCommand("chatty"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, swarming.TimedOut, state)
+}
+
+func TestRunnerIOTimeout(t *testing.T) {
+	t.Parallel()
+	r, _ := newTestRunner(time.Minute, 200*time.Millisecond)
+	_, state, err := r.run(context.Background(), helperCommand("sleep"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, swarming.TimedOut, state)
+
+	// Continuous output prevents the I/O timeout.
+	r, _ = newTestRunner(500*time.Millisecond, 200*time.Millisecond)
+	start := time.Now()
+	_, state, err = r.run(context.Background(), helperCommand("chatty"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, swarming.TimedOut, state)
+	ut.AssertEqual(t, true, time.Since(start) >= 500*time.Millisecond)
+}
+
+func TestRunnerKillsChildren(t *testing.T) {
+	t.Parallel()
+	r, _ := newTestRunner(500*time.Millisecond, 0)
+	start := time.Now()
+	_, state, err := r.run(context.Background(), helperCommand("spawn"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, swarming.TimedOut, state)
+	ut.AssertEqual(t, true, time.Since(start) < 30*time.Second)
+}
+
+func TestRunnerCanceled(t *testing.T) {
+	t.Parallel()
+	r, _ := newTestRunner(0, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, _, err := r.run(ctx, helperCommand("sleep"))
+	ut.AssertEqual(t, context.Canceled, err)
+}
+
+func TestMergeEnv(t *testing.T) {
+	t.Parallel()
+	out := mergeEnv([]string{"A=1", "B=2"}, map[string]string{"B": "3", "C": "4"})
+	sort.Strings(out)
+	ut.AssertEqual(t, []string{"A=1", "B=3", "C=4"}, out)
+}
+
+func writeZip(t *testing.T, path string, files map[string]string) {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		ut.AssertEqual(t, nil, err)
+		_, err = f.Write([]byte(content))
+		ut.AssertEqual(t, nil, err)
+	}
+	ut.AssertEqual(t, nil, w.Close())
+	ut.AssertEqual(t, nil, ioutil.WriteFile(path, buf.Bytes(), 0600))
+}
+
+func TestUnzip(t *testing.T) {
+	t.Parallel()
+	tmpDir, err := ioutil.TempDir("", "swarming")
+	ut.AssertEqual(t, nil, err)
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Fail()
+		}
+	}()
+	src := filepath.Join(tmpDir, "data.zip")
+	writeZip(t, src, map[string]string{"a/b.txt": "hi"})
+	dir := filepath.Join(tmpDir, "out")
+	ut.AssertEqual(t, nil, unzip(src, dir))
+	content, err := ioutil.ReadFile(filepath.Join(dir, "a", "b.txt"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "hi", string(content))
+
+	writeZip(t, src, map[string]string{"../evil": "hi"})
+	ut.AssertEqual(t, fmt.Errorf("invalid path ../evil in %s", src), unzip(src, dir))
+}
+
+func TestReproduce(t *testing.T) {
+	t.Parallel()
+	tmpDir, err := ioutil.TempDir("", "swarming")
+	ut.AssertEqual(t, nil, err)
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Fail()
+		}
+	}()
+	server := swarmingfake.New(swarmingfake.Options{})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	args := []string{"trigger", "-dimension", "os=Linux", "-task-name", "hi", "-env", "SWARMING_HELPER_PROCESS=1", "-env", "FOO=baz", "--"}
+	code, _ := run(t, ts.URL, append(args, helperCommand("exit", "3")...)...)
+	ut.AssertEqual(t, 0, code)
+	work := filepath.Join(tmpDir, "work")
+	code, out := run(t, ts.URL, "reproduce", "-work", work, "1")
+	ut.AssertEqual(t, 3, code)
+	lines := strings.Split(out, "\n")
+	ut.AssertEqual(t, "FOO=baz", lines[0])
+	ut.AssertEqual(t, true, strings.HasPrefix(lines[1], "1: COMPLETED, exit code 3 in "))
+
+	// The work directory must not exist.
+	code, _ = run(t, ts.URL, "reproduce", "-work", work, "1")
+	ut.AssertEqual(t, 1, code)
+	ut.AssertEqual(t, nil, server.Error())
+}
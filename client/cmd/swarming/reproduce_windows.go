@@ -0,0 +1,24 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+// newProcessGroup is a no-op on Windows, where killProcessTree walks the
+// process tree instead.
+func newProcessGroup(cmd *exec.Cmd) {
+}
+
+// killProcessTree kills cmd and all the processes it started.
+func killProcessTree(cmd *exec.Cmd) error {
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run(); err != nil {
+		// Kill at least the process itself.
+		return cmd.Process.Kill()
+	}
+	return nil
+}
@@ -9,8 +9,10 @@ import (
 	"fmt"
 
 	"github.com/kr/pretty"
+	"github.com/luci/luci-go/client/internal/common"
 	"github.com/luci/luci-go/client/swarming"
 	"github.com/maruel/subcommands"
+	"golang.org/x/net/context"
 )
 
 var cmdRequestShow = &subcommands.Command{
@@ -39,11 +41,17 @@ func (r *requestShowRun) Parse(a subcommands.Application, args []string) error {
 }
 
 func (c *requestShowRun) main(a subcommands.Application, taskid string) error {
-	s, err := swarming.New(c.serverURL)
+	client, err := common.CreateAuthClient(&c.authFlags)
 	if err != nil {
 		return err
 	}
-	r, err := s.FetchRequest(swarming.TaskID(taskid))
+	s, err := swarming.New(client, c.serverURL)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := common.CtrlCContext(context.Background())
+	defer cancel()
+	r, err := s.FetchRequest(ctx, swarming.TaskID(taskid))
 	if err != nil {
 		return fmt.Errorf("failed to load task %s: %s", taskid, err)
 	}
@@ -62,6 +70,7 @@ func (c *requestShowRun) Run(a subcommands.Application, args []string) int {
 		return 1
 	}
 	defer cl.Close()
+	defer c.printStats(a)
 	if err := c.main(a, args[0]); err != nil {
 		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
 		return 1
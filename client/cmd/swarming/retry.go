@@ -0,0 +1,92 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/swarming"
+	"github.com/maruel/subcommands"
+	"golang.org/x/net/context"
+)
+
+var cmdRetry = &subcommands.Command{
+	UsageLine: "retry <options> <task_id>",
+	ShortDesc: "triggers a task again",
+	LongDesc: `Triggers a new task with the same request as an existing task.
+
+The new task is tagged with "retry_of:<task_id>" and the tags specified with
+-tag; the tags of the original task are not kept.`,
+	CommandRun: func() subcommands.CommandRun {
+		r := &retryRun{}
+		r.Init()
+		return r
+	},
+}
+
+type retryRun struct {
+	commonFlags
+	tags     common.Strings
+	priority int
+}
+
+func (c *retryRun) Init() {
+	c.commonFlags.Init()
+	c.Flags.Var(&c.tags, "tag", "Tag to assign to the new task, as key:value; can be repeated")
+	c.Flags.IntVar(&c.priority, "priority", -1, "Priority of the new task; lower is more important. Defaults to the priority of the original task")
+}
+
+func (c *retryRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(a); err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("must only provide a task id")
+	}
+	if c.priority > 255 {
+		return errors.New("-priority must be between 0 and 255")
+	}
+	return nil
+}
+
+func (c *retryRun) main(a subcommands.Application, taskID string) error {
+	client, err := common.CreateAuthClient(&c.authFlags)
+	if err != nil {
+		return err
+	}
+	s, err := swarming.New(client, c.serverURL)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := common.CtrlCContext(context.Background())
+	defer cancel()
+	id, err := s.Retry(ctx, swarming.TaskID(taskID), c.tags, c.priority)
+	if err != nil {
+		return fmt.Errorf("failed to retry %s: %s", taskID, err)
+	}
+	fmt.Fprintf(a.GetOut(), "Retried %s as %s: %s/user/task/%s\n", taskID, id, c.serverURL, id)
+	return nil
+}
+
+func (c *retryRun) Run(a subcommands.Application, args []string) int {
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	cl, err := c.defaultFlags.StartTracing()
+	if err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	defer cl.Close()
+	defer c.printStats(a)
+	if err := c.main(a, args[0]); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
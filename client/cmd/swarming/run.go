@@ -0,0 +1,221 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/luci/luci-go/client/archiver"
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/isolate"
+	"github.com/luci/luci-go/client/isolatedclient"
+	"github.com/luci/luci-go/client/swarming"
+	"github.com/luci/luci-go/common/isolated"
+	"github.com/maruel/subcommands"
+	"golang.org/x/net/context"
+)
+
+var cmdRun = &subcommands.Command{
+	UsageLine: "run <options> [-- <extra args>]",
+	ShortDesc: "archives, triggers and collects a task",
+	LongDesc: `Archives a .isolate file, triggers it as one or more shards and waits for
+them to complete.
+
+Each shard gets the environment variables GTEST_SHARD_INDEX and
+GTEST_TOTAL_SHARDS. The output of the shards is printed as it becomes available
+and the exit code is the highest exit code of all the shards. When the command
+stops early, on Ctrl-C, on -timeout or on error, the shards that didn't
+complete yet are canceled.`,
+	CommandRun: func() subcommands.CommandRun {
+		r := &runRun{}
+		r.Init()
+		return r
+	},
+}
+
+type runRun struct {
+	commonFlags
+	taskFlags
+	collectFlags
+	archiveOptions isolate.ArchiveOptions
+	shards         int
+}
+
+func (c *runRun) Init() {
+	c.commonFlags.Init()
+	c.taskFlags.Init(&c.Flags)
+	c.collectFlags.Init(&c.Flags)
+	c.archiveOptions.Init()
+	c.Flags.StringVar(&c.archiveOptions.Isolate, "isolate", "", ".isolate file to archive and run")
+	c.Flags.StringVar(&c.archiveOptions.Isolated, "isolated", "", ".isolated file to generate; defaults to the .isolate file with the .isolated extension")
+	c.Flags.Var(c.archiveOptions.ConfigVariables, "config-variable", "Config variable used to load the .isolate file, as key=value; can be repeated")
+	c.Flags.Var(c.archiveOptions.PathVariables, "path-variable", "Variable used to replace file paths in the .isolate file, as key=value; can be repeated")
+	c.Flags.Var(c.archiveOptions.ExtraVariables, "extra-variable", "Variable replaced in the command and paths of the .isolate file, as key=value; can be repeated")
+	c.Flags.IntVar(&c.shards, "shards", 1, "Number of shards to split the task in")
+}
+
+func (c *runRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(a); err != nil {
+		return err
+	}
+	if err := c.taskFlags.Parse(); err != nil {
+		return err
+	}
+	if err := c.collectFlags.Parse(); err != nil {
+		return err
+	}
+	if err := c.parseIsolateServer(); err != nil {
+		return err
+	}
+	if c.shards < 1 {
+		return errors.New("-shards must be at least 1")
+	}
+	opts := &c.archiveOptions
+	if opts.Isolate == "" {
+		return errors.New("-isolate is required")
+	}
+	for _, vars := range []common.KeyValVars{opts.ConfigVariables, opts.PathVariables, opts.ExtraVariables} {
+		for k := range vars {
+			if !isolate.IsValidVariable(k) {
+				return fmt.Errorf("invalid variable %s", k)
+			}
+		}
+	}
+	if opts.Isolated == "" {
+		opts.Isolated = strings.TrimSuffix(opts.Isolate, filepath.Ext(opts.Isolate)) + ".isolated"
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	opts.PostProcess(cwd)
+	return nil
+}
+
+// cancelTimeout is the maximum time spent canceling the shards on early exit.
+const cancelTimeout = 30 * time.Second
+
+// archive archives the .isolate file and returns the digest of the .isolated
+// file.
+func (c *runRun) archive(ctx context.Context, a subcommands.Application, client *http.Client) (isolated.HexDigest, error) {
+	var out io.Writer
+	if !c.defaultFlags.Quiet {
+		out = a.GetErr()
+	}
+	arch := archiver.New(ctx, isolatedclient.New(client, c.isolateServer, c.namespace), out)
+	common.CancelOnCtrlC(arch)
+	future := isolate.Archive(arch, &c.archiveOptions)
+	future.WaitForHashed()
+	err := future.Error()
+	if err2 := arch.Close(); err == nil {
+		err = err2
+	}
+	return future.Digest(), err
+}
+
+// trigger triggers the shards running the isolated tree digest and returns
+// their names and IDs. On failure, the shards triggered so far are returned.
+func (c *runRun) trigger(ctx context.Context, a subcommands.Application, s *swarming.Swarming, digest isolated.HexDigest, args []string) ([]string, []swarming.TaskID, error) {
+	var names []string
+	var ids []swarming.TaskID
+	for i := 0; i < c.shards; i++ {
+		r := c.request()
+		r.Properties.InputsRef = c.inputsRef(string(digest))
+		r.Properties.ExtraArgs = args
+		if c.shards > 1 {
+			r.Name = fmt.Sprintf("%s:%d:%d", c.taskName, i, c.shards)
+			env := make(map[string]string, len(c.env)+2)
+			for k, v := range c.env {
+				env[k] = v
+			}
+			env["GTEST_SHARD_INDEX"] = strconv.Itoa(i)
+			env["GTEST_TOTAL_SHARDS"] = strconv.Itoa(c.shards)
+			r.Properties.Env = env
+		}
+		id, err := s.Trigger(ctx, r)
+		if err != nil {
+			return names, ids, fmt.Errorf("failed to trigger %s: %s", r.Name, err)
+		}
+		fmt.Fprintf(a.GetOut(), "Triggered %s: %s/user/task/%s\n", r.Name, c.serverURL, id)
+		names = append(names, r.Name)
+		ids = append(ids, id)
+	}
+	return names, ids, nil
+}
+
+// cancelShards cancels the shards that didn't complete yet.
+func cancelShards(a subcommands.Application, s *swarming.Swarming, names []string, ids []swarming.TaskID) {
+	// The context of the command may be canceled or expired at that point.
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+	cancelTasks(ctx, a, s, names, ids)
+}
+
+func (c *runRun) main(a subcommands.Application, args []string) (int, error) {
+	client, err := common.CreateAuthClient(&c.authFlags)
+	if err != nil {
+		return 1, err
+	}
+	s, err := swarming.New(client, c.serverURL)
+	if err != nil {
+		return 1, err
+	}
+	// Ctrl-C stops the archival or the collection, then the shards are
+	// canceled.
+	canceler := common.NewCanceler()
+	defer canceler.Close()
+	common.CancelOnCtrlC(canceler)
+	ctx, cancel := common.CancelerContext(context.Background(), canceler)
+	defer cancel()
+
+	digest, err := c.archive(ctx, a, client)
+	if err != nil {
+		return 1, fmt.Errorf("failed to archive %s: %s", c.archiveOptions.Isolate, err)
+	}
+	fmt.Fprintf(a.GetOut(), "Archived %s: %s\n", filepath.Base(c.archiveOptions.Isolate), digest)
+	if c.taskName == "" {
+		c.taskName = defaultTaskName(c.user, c.dimensions, string(digest))
+	}
+	names, ids, err := c.trigger(ctx, a, s, digest, args)
+	if err != nil {
+		// Don't leave the shards already triggered behind.
+		cancelShards(a, s, names, ids)
+		return 1, err
+	}
+	code, complete, err := c.collect(ctx, a, client, s, names, ids)
+	if !complete {
+		// Collection stopped early, due to Ctrl-C, -timeout or an error.
+		cancelShards(a, s, names, ids)
+		code = max(code, 1)
+	}
+	return code, err
+}
+
+func (c *runRun) Run(a subcommands.Application, args []string) int {
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	cl, err := c.defaultFlags.StartTracing()
+	if err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	defer cl.Close()
+	defer c.printStats(a)
+	code, err := c.main(a, args)
+	if err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+	}
+	return code
+}
@@ -0,0 +1,154 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/luci/luci-go/client/isolatedclient/isolatedfake"
+	"github.com/luci/luci-go/client/swarming"
+	"github.com/luci/luci-go/client/swarming/swarmingfake"
+	"github.com/luci/luci-go/common/isolated"
+	"github.com/maruel/ut"
+	"golang.org/x/net/context"
+)
+
+func TestRunShards(t *testing.T) {
+	t.Parallel()
+	tmpDir, err := ioutil.TempDir("", "swarming")
+	ut.AssertEqual(t, nil, err)
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Fail()
+		}
+	}()
+	isolate := `{
+		'variables': {
+			'command': ['./foo', '<(EXTRA)'],
+			'files': ['foo']
+		}
+	}`
+	isolatePath := filepath.Join(tmpDir, "foo.isolate")
+	ut.AssertEqual(t, nil, ioutil.WriteFile(isolatePath, []byte(isolate), 0600))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(tmpDir, "foo"), []byte("#!/bin/sh\n"), 0700))
+
+	isolateServer := isolatedfake.New()
+	isolateTS := httptest.NewServer(isolateServer)
+	defer isolateTS.Close()
+	server := swarmingfake.New(swarmingfake.Options{
+		Run: func(r *swarming.TaskRequest) (int, string) {
+			// The second shard fails.
+			index, _ := strconv.Atoi(r.Properties.Env["GTEST_SHARD_INDEX"])
+			return index, "shard " + r.Properties.Env["GTEST_SHARD_INDEX"] + " of " + r.Properties.Env["GTEST_TOTAL_SHARDS"] + "\n"
+		},
+	})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	code, out := run(t, ts.URL, "run", "-quiet", "-isolate-server", isolateTS.URL, "-isolate", isolatePath, "-extra-variable", "EXTRA=bar", "-dimension", "os=Linux", "-task-name", "hi", "-shards", "2", "--", "-v")
+	ut.AssertEqual(t, 1, code)
+	lines := strings.Split(out, "\n")
+	ut.AssertEqual(t, true, strings.HasPrefix(lines[0], "Archived foo.isolate: "))
+	ut.AssertEqual(t, []string{
+		"Triggered hi:0:2: " + ts.URL + "/user/task/1",
+		"Triggered hi:1:2: " + ts.URL + "/user/task/2",
+	}, lines[1:3])
+	// The output of the shards is prefixed with their name and interleaved.
+	var output []string
+	for _, l := range lines[3:] {
+		if strings.HasPrefix(l, "[") {
+			output = append(output, l)
+		}
+	}
+	sort.Strings(output)
+	ut.AssertEqual(t, []string{"[hi:0:2] shard 0 of 2", "[hi:1:2] shard 1 of 2"}, output)
+
+	tasks := server.Tasks()
+	ut.AssertEqual(t, 2, len(tasks))
+	for i, task := range tasks {
+		ut.AssertEqualIndex(t, i, swarming.Completed, task.State)
+		ut.AssertEqualIndex(t, i, []string{"-v"}, task.TaskRequest.Properties.ExtraArgs)
+		ref := task.TaskRequest.Properties.InputsRef
+		ut.AssertEqualIndex(t, i, isolateTS.URL, ref.IsolatedServer)
+		_, ok := isolateServer.Contents()[isolated.HexDigest(ref.Isolated)]
+		ut.AssertEqualIndex(t, i, true, ok)
+	}
+	_, err = os.Stat(filepath.Join(tmpDir, "foo.isolated"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, isolateServer.Error())
+	ut.AssertEqual(t, nil, server.Error())
+}
+
+func TestRunTimeout(t *testing.T) {
+	t.Parallel()
+	tmpDir, err := ioutil.TempDir("", "swarming")
+	ut.AssertEqual(t, nil, err)
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Fail()
+		}
+	}()
+	isolatePath := filepath.Join(tmpDir, "foo.isolate")
+	ut.AssertEqual(t, nil, ioutil.WriteFile(isolatePath, []byte(`{'variables': {'command': ['true']}}`), 0600))
+
+	isolateServer := isolatedfake.New()
+	isolateTS := httptest.NewServer(isolateServer)
+	defer isolateTS.Close()
+	// The task stays pending way longer than -timeout.
+	transitions := make([]swarming.TaskState, 10000)
+	for i := range transitions {
+		transitions[i] = swarming.Pending
+	}
+	server := swarmingfake.New(swarmingfake.Options{Transitions: append(transitions, swarming.Completed)})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	code, out := run(t, ts.URL, "run", "-quiet", "-isolate-server", isolateTS.URL, "-isolate", isolatePath, "-dimension", "os=Linux", "-task-name", "hi", "-timeout", "50ms")
+	ut.AssertEqual(t, 1, code)
+	ut.AssertEqual(t, true, strings.HasSuffix(out, "Canceled hi\n"))
+	tasks := server.Tasks()
+	ut.AssertEqual(t, 1, len(tasks))
+	ut.AssertEqual(t, swarming.Canceled, tasks[0].State)
+	ut.AssertEqual(t, nil, isolateServer.Error())
+	ut.AssertEqual(t, nil, server.Error())
+}
+
+func TestCancelShards(t *testing.T) {
+	t.Parallel()
+	server := swarmingfake.New(swarmingfake.Options{})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	s, err := swarming.New(nil, ts.URL)
+	ut.AssertEqual(t, nil, err)
+	ctx := context.Background()
+
+	var ids []swarming.TaskID
+	for _, name := range []string{"done", "pending"} {
+		code, _ := run(t, ts.URL, "trigger", "-dimension", "os=Linux", "-task-name", name, "--", "true")
+		ut.AssertEqual(t, 0, code)
+		ids = append(ids, swarming.TaskID(strconv.Itoa(len(ids)+1)))
+	}
+	for i := 0; i < 2; i++ {
+		_, err := s.FetchResult(ctx, ids[0])
+		ut.AssertEqual(t, nil, err)
+	}
+
+	// Only the task that didn't complete is canceled.
+	a := &testApp{DefaultApplication: application}
+	cancelShards(a, s, []string{"done", "pending"}, ids)
+	ut.AssertEqual(t, "Canceled pending\n", a.out.String())
+	ut.AssertEqual(t, "", a.err.String())
+	tasks := server.Tasks()
+	ut.AssertEqual(t, swarming.Completed, tasks[0].State)
+	ut.AssertEqual(t, swarming.Canceled, tasks[1].State)
+	ut.AssertEqual(t, nil, server.Error())
+}
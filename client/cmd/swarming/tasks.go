@@ -0,0 +1,135 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/swarming"
+	"github.com/maruel/subcommands"
+	"golang.org/x/net/context"
+)
+
+var cmdTasks = &subcommands.Command{
+	UsageLine: "tasks <options>",
+	ShortDesc: "lists tasks",
+	LongDesc:  "Lists the tasks on the Swarming server, most recent first, optionally filtered by tags, state and creation time.",
+	CommandRun: func() subcommands.CommandRun {
+		r := &tasksRun{}
+		r.Init()
+		return r
+	},
+}
+
+type tasksRun struct {
+	commonFlags
+	output outputFlags
+	name   string
+	state  string
+	tags   common.Strings
+	start  string
+	end    string
+}
+
+func (c *tasksRun) Init() {
+	c.commonFlags.Init()
+	c.output.Init(&c.Flags, 200)
+	c.Flags.StringVar(&c.name, "name", "", "Only list the tasks with this exact name")
+	c.Flags.StringVar(&c.state, "state", "all", "Only list the tasks in this state; one of "+strings.Join(swarming.TaskFilterStates, ", "))
+	c.Flags.Var(&c.tags, "tag", "Only list the tasks with this tag, as key:value; can be repeated")
+	c.Flags.StringVar(&c.start, "start", "", "Only list the tasks created after this time, either as \"YYYY-MM-DD hh:mm:ss\" in UTC or as a duration ago, e.g. \"24h\"")
+	c.Flags.StringVar(&c.end, "end", "", "Only list the tasks created before this time; same format as -start")
+}
+
+func (c *tasksRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(a); err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return errors.New("unexpected arguments")
+	}
+	return c.output.Parse()
+}
+
+// parseTime parses either a timestamp in the server's format or a duration
+// before now.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(swarming.TimestampFormat, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	return t, nil
+}
+
+func (c *tasksRun) main(a subcommands.Application) error {
+	now := time.Now()
+	f := &swarming.TaskFilter{Name: c.name, State: c.state, Tags: c.tags, Limit: c.output.limit}
+	var err error
+	if f.Start, err = parseTime(c.start, now); err != nil {
+		return err
+	}
+	if f.End, err = parseTime(c.end, now); err != nil {
+		return err
+	}
+	client, err := common.CreateAuthClient(&c.authFlags)
+	if err != nil {
+		return err
+	}
+	s, err := swarming.New(client, c.serverURL)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := common.CtrlCContext(context.Background())
+	defer cancel()
+	tasks, err := s.ListTasks(ctx, f)
+	if err != nil {
+		return err
+	}
+	if c.output.format == "json" {
+		return printJSON(a.GetOut(), tasks)
+	}
+	rows := [][]string{{"ID", "STATE", "CREATED", "PENDING", "BOT", "NAME"}}
+	for _, t := range tasks {
+		rows = append(rows, []string{string(t.ID), t.State.String(), formatTime(t.CreatedTS), t.PendingDuration().String(), t.BotID, t.Name})
+	}
+	return printTable(a.GetOut(), rows)
+}
+
+// formatTime formats a timestamp for a table.
+func formatTime(t swarming.Timestamp) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+func (c *tasksRun) Run(a subcommands.Application, args []string) int {
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	cl, err := c.defaultFlags.StartTracing()
+	if err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	defer cl.Close()
+	defer c.printStats(a)
+	if err := c.main(a); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
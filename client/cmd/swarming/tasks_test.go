@@ -0,0 +1,33 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/maruel/ut"
+)
+
+func TestParseTime(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	data := []struct {
+		in       string
+		expected time.Time
+		err      error
+	}{
+		{"", time.Time{}, nil},
+		{"24h", now.Add(-24 * time.Hour), nil},
+		{"2015-10-20 01:02:03", time.Date(2015, 10, 20, 1, 2, 3, 0, time.UTC), nil},
+		{"yesterday", time.Time{}, errors.New("invalid time \"yesterday\"")},
+	}
+	for i, line := range data {
+		actual, err := parseTime(line.in, now)
+		ut.AssertEqualIndex(t, i, line.err, err)
+		ut.AssertEqualIndex(t, i, line.expected, actual)
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/internal/lhttp"
+	"github.com/luci/luci-go/client/swarming"
+	"github.com/maruel/subcommands"
+	"golang.org/x/net/context"
+)
+
+var cmdTrigger = &subcommands.Command{
+	UsageLine: "trigger <options> [-- <command or extra args>]",
+	ShortDesc: "triggers a task",
+	LongDesc: `Triggers a Swarming task.
+
+The task runs either the isolated tree specified with -isolated, in which case
+the positional arguments are appended to its command, or the command specified
+as positional arguments.`,
+	CommandRun: func() subcommands.CommandRun {
+		r := &triggerRun{}
+		r.Init()
+		return r
+	},
+}
+
+// taskFlags are the flags describing a task, shared by the commands
+// triggering tasks.
+type taskFlags struct {
+	isolateServer string
+	namespace     string
+	dimensions    common.KeyValVars
+	env           common.KeyValVars
+	priority      int
+	expiration    int
+	hardTimeout   int
+	ioTimeout     int
+	tags          common.Strings
+	idempotent    bool
+	taskName      string
+	user          string
+}
+
+func (t *taskFlags) Init(f *flag.FlagSet) {
+	t.dimensions = common.KeyValVars{}
+	t.env = common.KeyValVars{}
+	f.StringVar(&t.isolateServer, "isolate-server", os.Getenv("ISOLATE_SERVER"), "Isolate server hosting the isolated tree; defaults to value of $ISOLATE_SERVER")
+	f.StringVar(&t.namespace, "namespace", "default-gzip", "Namespace of the isolated tree on the Isolate server")
+	f.Var(t.dimensions, "dimension", "Dimension to select the bot, as key=value; can be repeated")
+	f.Var(t.env, "env", "Environment variable to set, as key=value; can be repeated")
+	f.IntVar(&t.priority, "priority", 100, "Priority of the task; lower is more important")
+	f.IntVar(&t.expiration, "expiration", 6*60*60, "Seconds to allow the task to be pending for a bot to run before the task is canceled")
+	f.IntVar(&t.hardTimeout, "hard-timeout", 60*60, "Seconds to allow the task to complete")
+	f.IntVar(&t.ioTimeout, "io-timeout", 20*60, "Seconds to allow the task to be silent")
+	f.Var(&t.tags, "tag", "Tag to assign to the task, as key:value; can be repeated")
+	f.BoolVar(&t.idempotent, "idempotent", false, "The task can be deduplicated with a previous identical successful task")
+	f.StringVar(&t.taskName, "task-name", "", "Display name of the task; defaults to a name derived from the isolated tree")
+	f.StringVar(&t.user, "user", os.Getenv("USER"), "User the task is run on behalf of")
+}
+
+func (t *taskFlags) Parse() error {
+	if len(t.dimensions) == 0 {
+		return errors.New("at least one -dimension is required")
+	}
+	if t.priority < 0 || t.priority > 255 {
+		return errors.New("-priority must be between 0 and 255")
+	}
+	return nil
+}
+
+// parseIsolateServer validates -isolate-server, which is required when the
+// task uses an isolated tree.
+func (t *taskFlags) parseIsolateServer() error {
+	if t.isolateServer == "" {
+		return errors.New("-isolate-server is required")
+	}
+	s, err := lhttp.CheckURL(t.isolateServer)
+	if err != nil {
+		return err
+	}
+	t.isolateServer = s
+	return nil
+}
+
+// request returns the request for the task, without its inputs.
+func (t *taskFlags) request() *swarming.TaskRequest {
+	return &swarming.TaskRequest{
+		ExpirationSecs: t.expiration,
+		Name:           t.taskName,
+		Priority:       t.priority,
+		Properties: swarming.TaskRequestProperties{
+			Dimensions:           t.dimensions,
+			Env:                  t.env,
+			ExecutionTimeoutSecs: t.hardTimeout,
+			GracePeriodSecs:      30,
+			Idempotent:           t.idempotent,
+			IoTimeoutSecs:        t.ioTimeout,
+		},
+		Tags: t.tags,
+		User: t.user,
+	}
+}
+
+// inputsRef returns the reference to the isolated tree isolated.
+func (t *taskFlags) inputsRef(isolated string) *swarming.FilesRef {
+	return &swarming.FilesRef{
+		Isolated:       isolated,
+		IsolatedServer: t.isolateServer,
+		Namespace:      t.namespace,
+	}
+}
+
+type triggerRun struct {
+	commonFlags
+	taskFlags
+	isolated string
+	dumpJSON string
+}
+
+func (c *triggerRun) Init() {
+	c.commonFlags.Init()
+	c.taskFlags.Init(&c.Flags)
+	c.Flags.StringVar(&c.isolated, "isolated", "", "Hash of the .isolated file to run")
+	c.Flags.StringVar(&c.dumpJSON, "dump-json", "", "Write the triggered task IDs to this file as JSON")
+}
+
+func (c *triggerRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(a); err != nil {
+		return err
+	}
+	if err := c.taskFlags.Parse(); err != nil {
+		return err
+	}
+	if c.isolated == "" {
+		if len(args) == 0 {
+			return errors.New("must provide -isolated or a command")
+		}
+		if c.taskName == "" {
+			return errors.New("-task-name is required when not using -isolated")
+		}
+	} else {
+		if err := c.parseIsolateServer(); err != nil {
+			return err
+		}
+		if c.taskName == "" {
+			c.taskName = defaultTaskName(c.user, c.dimensions, c.isolated)
+		}
+	}
+	return nil
+}
+
+// triggerResults is the content of the file written by -dump-json.
+type triggerResults struct {
+	Tasks map[string]triggeredTask `json:"tasks"`
+}
+
+type triggeredTask struct {
+	TaskID  swarming.TaskID `json:"task_id"`
+	ViewURL string          `json:"view_url"`
+}
+
+// defaultTaskName returns a task name that is unique for a user, dimensions
+// and isolated hash.
+func defaultTaskName(user string, dimensions map[string]string, isolated string) string {
+	dims := make([]string, 0, len(dimensions))
+	for k, v := range dimensions {
+		dims = append(dims, k+"="+v)
+	}
+	sort.Strings(dims)
+	return fmt.Sprintf("%s/%s/%s", user, strings.Join(dims, "_"), isolated)
+}
+
+func (c *triggerRun) request(args []string) *swarming.TaskRequest {
+	r := c.taskFlags.request()
+	if c.isolated != "" {
+		r.Properties.InputsRef = c.inputsRef(c.isolated)
+		r.Properties.ExtraArgs = args
+	} else {
+		r.Properties.Commands = [][]string{args}
+	}
+	return r
+}
+
+func (c *triggerRun) main(a subcommands.Application, args []string) error {
+	client, err := common.CreateAuthClient(&c.authFlags)
+	if err != nil {
+		return err
+	}
+	s, err := swarming.New(client, c.serverURL)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := common.CtrlCContext(context.Background())
+	defer cancel()
+	id, err := s.Trigger(ctx, c.request(args))
+	if err != nil {
+		return fmt.Errorf("failed to trigger %s: %s", c.taskName, err)
+	}
+	viewURL := c.serverURL + "/user/task/" + string(id)
+	fmt.Fprintf(a.GetOut(), "Triggered %s: %s\n", c.taskName, viewURL)
+	if c.dumpJSON != "" {
+		out := &triggerResults{map[string]triggeredTask{c.taskName: {id, viewURL}}}
+		return common.WriteJSONFile(c.dumpJSON, out)
+	}
+	return nil
+}
+
+func (c *triggerRun) Run(a subcommands.Application, args []string) int {
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	cl, err := c.defaultFlags.StartTracing()
+	if err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	defer cl.Close()
+	defer c.printStats(a)
+	if err := c.main(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
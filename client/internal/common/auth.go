@@ -0,0 +1,26 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package common
+
+import (
+	"net/http"
+
+	"github.com/luci/luci-go/common/auth"
+)
+
+// CreateAuthClient returns an http.Client authenticated with the credentials
+// selected by f if they are available, http.DefaultClient otherwise.
+func CreateAuthClient(f *auth.Flags) (*http.Client, error) {
+	opts, err := f.Options()
+	if err != nil {
+		return nil, err
+	}
+	return NewAuthClient(opts)
+}
+
+// NewAuthClient is mocked in tests.
+var NewAuthClient = func(opts auth.Options) (*http.Client, error) {
+	return auth.AuthenticatedClient(auth.OptionalLogin, auth.NewAuthenticator(opts))
+}
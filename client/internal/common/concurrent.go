@@ -10,6 +10,8 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+
+	"golang.org/x/net/context"
 )
 
 // ErrCanceled is the default reason (error) for cancelation of Cancelable.
@@ -94,22 +96,57 @@ type Canceler interface {
 	Channel() <-chan error
 }
 
-// CancelOnCtrlC makes a Canceler to be canceled on Ctrl-C (os.Interrupt).
+// CtrlCContext returns a context that is canceled on Ctrl-C (os.Interrupt).
 //
-// It is fine to call this function multiple times on multiple Canceler.
-func CancelOnCtrlC(c Canceler) {
+// The returned cancel function must be called once done with the context to
+// release resources.
+func CtrlCContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
 	interrupted := make(chan os.Signal, 1)
 	signal.Notify(interrupted, os.Interrupt)
 	go func() {
 		defer signal.Stop(interrupted)
 		select {
 		case <-interrupted:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// CancelOnCtrlC makes a Canceler to be canceled on Ctrl-C (os.Interrupt).
+//
+// It is fine to call this function multiple times on multiple Canceler.
+func CancelOnCtrlC(c Canceler) {
+	ctx, cancel := CtrlCContext(context.Background())
+	go func() {
+		defer cancel()
+		select {
+		case <-ctx.Done():
 			c.Cancel(errors.New("Ctrl-C"))
 		case <-c.Channel():
 		}
 	}()
 }
 
+// CancelerContext returns a context that is canceled when c is canceled or
+// closed, so that context aware code like retry.Config.Do() stops on Ctrl-C.
+//
+// The returned cancel function must be called once done with the context to
+// release resources.
+func CancelerContext(parent context.Context, c Canceler) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-c.Channel():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
 // NewCanceler returns a new instance of canceler.
 //
 // Call Cancel() once no longer used to release resources.
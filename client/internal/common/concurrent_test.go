@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/maruel/ut"
+	"golang.org/x/net/context"
 )
 
 func TestGoroutinePool(t *testing.T) {
@@ -161,6 +162,32 @@ func TestCancelable(t *testing.T) {
 	assertClosed(t, c)
 }
 
+func TestCancelerContext(t *testing.T) {
+	t.Parallel()
+	c := newCanceler()
+	defer c.Close()
+	ctx, cancel := CancelerContext(context.Background(), c)
+	defer cancel()
+	select {
+	case <-ctx.Done():
+		t.Fatal()
+	default:
+	}
+	c.Cancel(nil)
+	<-ctx.Done()
+	ut.AssertEqual(t, context.Canceled, ctx.Err())
+}
+
+func TestCancelerContextCancel(t *testing.T) {
+	t.Parallel()
+	c := newCanceler()
+	defer c.Close()
+	ctx, cancel := CancelerContext(context.Background(), c)
+	cancel()
+	<-ctx.Done()
+	ut.AssertEqual(t, nil, c.CancelationReason())
+}
+
 func TestCancelableDoubleCancel(t *testing.T) {
 	t.Parallel()
 	errReason := errors.New("reason")
@@ -13,6 +13,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/luci/luci-go/client/internal/lhttp"
 	"github.com/luci/luci-go/client/internal/tracer"
 )
 
@@ -20,12 +21,14 @@ type Flags struct {
 	Quiet     bool
 	Verbose   bool
 	TracePath string
+	HTTPDump  string
 }
 
 func (d *Flags) Init(f *flag.FlagSet) {
 	f.BoolVar(&d.Quiet, "quiet", false, "Get less output")
 	f.BoolVar(&d.Verbose, "verbose", false, "Get more output")
 	f.StringVar(&d.TracePath, "trace", "", "Name of trace file to generate")
+	f.StringVar(&d.HTTPDump, "http-dump", "", "Directory where to write a copy of each HTTP request and response, without credentials, for bug reports")
 }
 
 func (d *Flags) Parse() error {
@@ -43,6 +46,17 @@ func (d *Flags) Parse() error {
 		}
 		d.TracePath = p
 	}
+	if d.HTTPDump != "" {
+		p, err := filepath.Abs(d.HTTPDump)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(p, 0700); err != nil {
+			return err
+		}
+		d.HTTPDump = p
+		lhttp.DumpDir = p
+	}
 	return nil
 }
 
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/luci/luci-go/client/internal/imported"
+	"github.com/luci/luci-go/client/internal/lhttp"
 )
 
 var units = []string{"b", "Kib", "Mib", "Gib", "Tib", "Pib", "Eib", "Zib", "Yib"}
@@ -61,6 +62,15 @@ func Round(value time.Duration, resolution time.Duration) time.Duration {
 	return value / resolution * resolution
 }
 
+// PrintHTTPStats prints a summary of the HTTP requests done so far to w, if
+// any.
+func PrintHTTPStats(w io.Writer) {
+	if h := lhttp.GetStats(); h.Requests != 0 {
+		fmt.Fprintf(w, "HTTP    : %5d (%d retries, %d failures, %s sent, %s received in %s)\n",
+			h.Requests, h.Retries, h.Failures, Size(h.BytesSent), Size(h.BytesReceived), Round(h.Duration, time.Millisecond))
+	}
+}
+
 // IsTerminal returns true if the specified io.Writer is a terminal.
 func IsTerminal(out io.Writer) bool {
 	f, ok := out.(*os.File)
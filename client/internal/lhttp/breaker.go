@@ -0,0 +1,216 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package lhttp
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Breaker defines the circuit breaker parameters used for every host. Set to
+// nil to disable circuit breaking. It is fine to update this variable on start
+// up.
+var Breaker = &BreakerConfig{
+	Window:       30 * time.Second,
+	MinRequests:  20,
+	ErrorRate:    0.5,
+	OpenDuration: 10 * time.Second,
+}
+
+// BreakerConfig defines when the circuit breaker of a host opens.
+//
+// The circuit breaker opens when the rate of failed requests over the last
+// Window exceeds ErrorRate. A request failed when it got no response, for
+// example on a connection error, or when it got a HTTP 5xx response. While
+// open, all requests to the host fail fast with a *CircuitOpenError. After
+// OpenDuration, a single request is let through to probe the host; the breaker
+// closes if it succeeds and reopens otherwise.
+type BreakerConfig struct {
+	Window       time.Duration // Duration over which the error rate is computed.
+	MinRequests  int           // Minimum number of requests in Window to open.
+	ErrorRate    float64       // Error rate in [0, 1] at which the breaker opens.
+	OpenDuration time.Duration // Duration the breaker stays open before probing.
+}
+
+// BreakerState is the state of the circuit breaker of a host.
+type BreakerState int
+
+// Circuit breaker states.
+const (
+	BreakerClosed   BreakerState = iota // Requests are sent normally.
+	BreakerOpen                         // Requests fail fast.
+	BreakerHalfOpen                     // A single probe request is allowed.
+)
+
+func (b BreakerState) String() string {
+	switch b {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("BreakerState(%d)", int(b))
+	}
+}
+
+// CircuitOpenError is returned when a request is not sent because the circuit
+// breaker of its host is open.
+type CircuitOpenError struct {
+	Host    string
+	RetryAt time.Time // Time at which a request may be allowed again.
+}
+
+func (c *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open for %s; retry at %s", c.Host, c.RetryAt.Format(time.RFC3339))
+}
+
+// HostState returns the state of the circuit breaker of host.
+func HostState(host string) BreakerState {
+	if b := getBreaker(host); b != nil {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		b.update(now())
+		return b.state
+	}
+	return BreakerClosed
+}
+
+// CheckHost returns a *CircuitOpenError if the circuit breaker of the host of
+// rawurl is open. It can be used to fail fast before consuming a stream.
+//
+// It does not reserve the probe request when the breaker is half-open.
+func CheckHost(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if b := getBreaker(u.Host); b != nil {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		t := now()
+		b.update(t)
+		if b.state == BreakerOpen {
+			return &CircuitOpenError{b.host, b.openedAt.Add(b.config.OpenDuration)}
+		}
+	}
+	return nil
+}
+
+// Private details.
+
+// now is the clock used by the circuit breakers.
+var now = time.Now
+
+var (
+	breakersLock sync.Mutex
+	breakers     = map[string]*breaker{}
+)
+
+// getBreaker returns the circuit breaker of host or nil if disabled.
+func getBreaker(host string) *breaker {
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+	if b, ok := breakers[host]; ok {
+		return b
+	}
+	if Breaker == nil {
+		return nil
+	}
+	b := &breaker{host: host, config: Breaker, start: now()}
+	breakers[host] = b
+	return b
+}
+
+type breaker struct {
+	host   string
+	config *BreakerConfig
+
+	lock     sync.Mutex
+	state    BreakerState
+	start    time.Time // Start of the current window.
+	requests int
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// update transitions from open to half-open once OpenDuration elapsed.
+func (b *breaker) update(t time.Time) {
+	if b.state == BreakerOpen && t.Sub(b.openedAt) >= b.config.OpenDuration {
+		b.state = BreakerHalfOpen
+		b.probing = false
+	}
+}
+
+// allow returns a *CircuitOpenError if the request must not be sent. When nil
+// is returned, either done() or cancel() must be called.
+func (b *breaker) allow(t time.Time) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.update(t)
+	switch b.state {
+	case BreakerOpen:
+		return &CircuitOpenError{b.host, b.openedAt.Add(b.config.OpenDuration)}
+	case BreakerHalfOpen:
+		if b.probing {
+			return &CircuitOpenError{b.host, t.Add(b.config.OpenDuration)}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// done records the result of a request.
+func (b *breaker) done(t time.Time, failed bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		// The request was started before the breaker opened.
+		return
+	case BreakerHalfOpen:
+		b.probing = false
+		if failed {
+			b.open(t)
+		} else {
+			b.state = BreakerClosed
+			b.start = t
+			b.requests = 0
+			b.failures = 0
+		}
+		return
+	}
+	if t.Sub(b.start) > b.config.Window {
+		b.start = t
+		b.requests = 0
+		b.failures = 0
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+	if b.config.ErrorRate > 0 && b.requests >= b.config.MinRequests && float64(b.failures) >= b.config.ErrorRate*float64(b.requests) {
+		b.open(t)
+	}
+}
+
+// cancel releases the probe reservation without recording a result, for
+// example when the request was canceled.
+func (b *breaker) cancel() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == BreakerHalfOpen {
+		b.probing = false
+	}
+}
+
+func (b *breaker) open(t time.Time) {
+	b.state = BreakerOpen
+	b.openedAt = t
+}
@@ -0,0 +1,139 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package lhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/maruel/ut"
+	"golang.org/x/net/context"
+)
+
+func TestBreaker(t *testing.T) {
+	config := &BreakerConfig{
+		Window:       time.Minute,
+		MinRequests:  4,
+		ErrorRate:    0.5,
+		OpenDuration: 10 * time.Second,
+	}
+	t0 := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := &breaker{host: "host", config: config, start: t0}
+
+	// Not enough requests yet.
+	for i := 0; i < 3; i++ {
+		ut.AssertEqual(t, nil, b.allow(t0))
+		b.done(t0, true)
+	}
+	ut.AssertEqual(t, BreakerClosed, b.state)
+	ut.AssertEqual(t, nil, b.allow(t0))
+	b.done(t0, false)
+	ut.AssertEqual(t, BreakerOpen, b.state)
+
+	// Fails fast.
+	expected := &CircuitOpenError{"host", t0.Add(10 * time.Second)}
+	ut.AssertEqual(t, expected, b.allow(t0.Add(time.Second)))
+
+	// Half-open; only one probe is allowed.
+	t1 := t0.Add(10 * time.Second)
+	ut.AssertEqual(t, nil, b.allow(t1))
+	ut.AssertEqual(t, BreakerHalfOpen, b.state)
+	ut.AssertEqual(t, &CircuitOpenError{"host", t1.Add(10 * time.Second)}, b.allow(t1))
+
+	// A canceled probe doesn't change the state.
+	b.cancel()
+	ut.AssertEqual(t, nil, b.allow(t1))
+
+	// A failed probe reopens.
+	b.done(t1, true)
+	ut.AssertEqual(t, BreakerOpen, b.state)
+
+	// A successful probe closes.
+	t2 := t1.Add(10 * time.Second)
+	ut.AssertEqual(t, nil, b.allow(t2))
+	b.done(t2, false)
+	ut.AssertEqual(t, BreakerClosed, b.state)
+	ut.AssertEqual(t, 0, b.requests)
+}
+
+func TestBreakerWindow(t *testing.T) {
+	config := &BreakerConfig{
+		Window:       time.Minute,
+		MinRequests:  2,
+		ErrorRate:    0.5,
+		OpenDuration: 10 * time.Second,
+	}
+	t0 := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := &breaker{host: "host", config: config, start: t0}
+	b.done(t0, true)
+	// The previous failure is forgotten.
+	b.done(t0.Add(2*time.Minute), false)
+	b.done(t0.Add(2*time.Minute), false)
+	ut.AssertEqual(t, BreakerClosed, b.state)
+	ut.AssertEqual(t, 2, b.requests)
+	ut.AssertEqual(t, 0, b.failures)
+}
+
+func TestBreakerRequests(t *testing.T) {
+	oldBreaker := Breaker
+	defer func() {
+		Breaker = oldBreaker
+	}()
+	Breaker = &BreakerConfig{
+		Window:       time.Minute,
+		MinRequests:  3,
+		ErrorRate:    1,
+		OpenDuration: time.Hour,
+	}
+	serverCalls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverCalls++
+		w.WriteHeader(500)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	ut.AssertEqual(t, nil, err)
+
+	ut.AssertEqual(t, nil, CheckHost(ts.URL))
+	_, err = GetJSON(context.Background(), fast, http.DefaultClient, ts.URL, nil)
+	ut.AssertEqual(t, 3, serverCalls)
+	ut.AssertEqual(t, BreakerOpen, HostState(u.Host))
+
+	// The server is not contacted anymore.
+	_, err = GetJSON(context.Background(), fast, http.DefaultClient, ts.URL, nil)
+	_, ok := err.(*CircuitOpenError)
+	ut.AssertEqual(t, true, ok)
+	ut.AssertEqual(t, 3, serverCalls)
+	_, ok = CheckHost(ts.URL).(*CircuitOpenError)
+	ut.AssertEqual(t, true, ok)
+}
+
+func TestBreakerTransportError(t *testing.T) {
+	oldBreaker := Breaker
+	defer func() {
+		Breaker = oldBreaker
+	}()
+	Breaker = &BreakerConfig{
+		Window:       time.Minute,
+		MinRequests:  2,
+		ErrorRate:    1,
+		OpenDuration: time.Hour,
+	}
+	// Nothing listens on the port anymore so the connection is refused.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.Close()
+	u, err := url.Parse(ts.URL)
+	ut.AssertEqual(t, nil, err)
+
+	for i := 0; i < 2; i++ {
+		_, err = GetJSON(context.Background(), fast, http.DefaultClient, ts.URL, nil)
+		_, ok := err.(*url.Error)
+		ut.AssertEqual(t, true, ok)
+	}
+	ut.AssertEqual(t, BreakerOpen, HostState(u.Host))
+}
@@ -11,12 +11,18 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/luci/luci-go/client/internal/retry"
+	"github.com/luci/luci-go/client/internal/tracer"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
 )
 
 // Handler is called once or multiple times for each HTTP request that is tried.
@@ -37,13 +43,16 @@ type Retriable interface {
 //
 // handler should return retry.Error in case of retriable error, for example if
 // a TCP connection is teared off while receiving the content.
-func NewRequest(c *http.Client, req *http.Request, handler Handler) (Retriable, error) {
+//
+// The in-flight HTTP request is aborted when ctx is canceled.
+func NewRequest(ctx context.Context, c *http.Client, req *http.Request, handler Handler) (Retriable, error) {
 	// Handle req.Body if specified. It has to implement io.Seeker.
 	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
 		return nil, fmt.Errorf("unsupported protocol scheme \"%s\"", req.URL.Scheme)
 	}
 	newReq := *req
 	out := &retriable{
+		ctx:       ctx,
 		handler:   handler,
 		c:         c,
 		req:       &newReq,
@@ -54,30 +63,60 @@ func NewRequest(c *http.Client, req *http.Request, handler Handler) (Retriable,
 		if out.seekBody, ok = req.Body.(io.Seeker); !ok {
 			return nil, errors.New("req.Body must implement io.Seeker")
 		}
-		// Make sure the body is not closed when calling http.Client.Do().
-		out.req.Body = ioutil.NopCloser(req.Body)
+		out.body = req.Body
+		out.length = req.ContentLength
 	}
 	return out, nil
 }
 
 // NewRequestJSON returns a retriable request calling a JSON endpoint.
-func NewRequestJSON(c *http.Client, url, method string, in, out interface{}) (Retriable, error) {
-	var body io.Reader
-	if in != nil {
-		encoded, err := json.Marshal(in)
-		if err != nil {
+//
+// The request body is gzip compressed if the server advertised support for it.
+// The response is decoded as it is received.
+func NewRequestJSON(ctx context.Context, c *http.Client, url, method string, in, out interface{}) (Retriable, error) {
+	if in == nil {
+		return NewRequestJSONReader(ctx, c, url, method, nil, out)
+	}
+	encoded, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	return NewRequestJSONReader(ctx, c, url, method, &reader{bytes.NewReader(encoded)}, out)
+}
+
+// NewRequestJSONReader is like NewRequestJSON except that the request is
+// already encoded in body. It is closed by the returned Retriable if it
+// implements io.Closer.
+//
+// Use a Spool for large requests to keep memory usage bounded.
+func NewRequestJSONReader(ctx context.Context, c *http.Client, url, method string, body io.ReadSeeker, out interface{}) (Retriable, error) {
+	var b io.Reader
+	var size int64
+	if body != nil {
+		var err error
+		if size, err = body.Seek(0, os.SEEK_END); err != nil {
 			return nil, err
 		}
-		body = newReader(encoded)
+		if _, err = body.Seek(0, os.SEEK_SET); err != nil {
+			return nil, err
+		}
+		// http.NewRequest() wraps a body without Close() into a type that hides
+		// Seek().
+		if _, ok := body.(io.Closer); ok {
+			b = body
+		} else {
+			b = &reader{body}
+		}
 	}
-	req, err := http.NewRequest(method, url, body)
+	req, err := http.NewRequest(method, url, b)
 	if err != nil {
 		return nil, err
 	}
-	if in != nil {
+	if body != nil {
+		req.ContentLength = size
 		req.Header.Set("Content-Type", jsonContentType)
 	}
-	return NewRequest(c, req, func(resp *http.Response) error {
+	r, err := NewRequest(ctx, c, req, func(resp *http.Response) error {
 		defer resp.Body.Close()
 		if ct := strings.ToLower(resp.Header.Get("Content-Type")); ct != jsonContentType {
 			// Non-retriable.
@@ -90,32 +129,72 @@ func NewRequestJSON(c *http.Client, url, method string, in, out interface{}) (Re
 		}
 		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
 			// Retriable.
-			return retry.Error{fmt.Errorf("bad response %s: %s", url, err)}
+			return retry.Error{Err: fmt.Errorf("bad response %s: %s", url, err)}
 		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	r.(*retriable).compressible = true
+	return r, nil
 }
 
 // GetJSON is a shorthand. It returns the HTTP status code and error if any.
-func GetJSON(config *retry.Config, c *http.Client, url string, out interface{}) (int, error) {
-	req, err := NewRequestJSON(c, url, "GET", nil, out)
+func GetJSON(ctx context.Context, config *retry.Config, c *http.Client, url string, out interface{}) (int, error) {
+	req, err := NewRequestJSON(ctx, c, url, "GET", nil, out)
 	if err != nil {
 		return 0, err
 	}
-	err = config.Do(req)
+	err = config.Do(ctx, req)
 	return req.Status(), err
 }
 
 // PostJSON is a shorthand. It returns the HTTP status code and error if any.
-func PostJSON(config *retry.Config, c *http.Client, url string, in, out interface{}) (int, error) {
-	req, err := NewRequestJSON(c, url, "POST", in, out)
+func PostJSON(ctx context.Context, config *retry.Config, c *http.Client, url string, in, out interface{}) (int, error) {
+	req, err := NewRequestJSON(ctx, c, url, "POST", in, out)
+	if err != nil {
+		return 0, err
+	}
+	err = config.Do(ctx, req)
+	return req.Status(), err
+}
+
+// PostJSONReader is a shorthand. It returns the HTTP status code and error if
+// any.
+func PostJSONReader(ctx context.Context, config *retry.Config, c *http.Client, url string, in io.ReadSeeker, out interface{}) (int, error) {
+	req, err := NewRequestJSONReader(ctx, c, url, "POST", in, out)
 	if err != nil {
 		return 0, err
 	}
-	err = config.Do(req)
+	err = config.Do(ctx, req)
 	return req.Status(), err
 }
 
+// Do sends req once with c, like http.Client.Do(). req.Body doesn't need to be
+// seekable so it is suitable to stream an upload, which can't be retried.
+//
+// The request is traced and accounted in GetStats() once the response body is
+// closed.
+func Do(ctx context.Context, c *http.Client, req *http.Request) (*http.Response, error) {
+	end := tracer.Span(req, "http", tracer.Args{"method": req.Method, "path": req.URL.Path})
+	s := &requestStats{start: time.Now(), end: end}
+	if req.Body != nil {
+		s.sent.r = req.Body
+		r := *req
+		r.Body = &readCloser{&s.sent, req.Body}
+		req = &r
+	}
+	resp, err := ctxhttp.Do(ctx, c, req)
+	if err != nil {
+		s.done(0, err)
+		return nil, err
+	}
+	s.received.r = resp.Body
+	resp.Body = &statsBody{Closer: resp.Body, s: s, status: resp.StatusCode}
+	return resp, nil
+}
+
 // Private details.
 
 const jsonContentType = "application/json; charset=utf-8"
@@ -128,7 +207,7 @@ func newReader(p []byte) io.ReadCloser {
 }
 
 type reader struct {
-	*bytes.Reader
+	io.ReadSeeker
 }
 
 func (r *reader) Close() error {
@@ -136,12 +215,17 @@ func (r *reader) Close() error {
 }
 
 type retriable struct {
-	handler   Handler
-	c         *http.Client
-	req       *http.Request
-	closeBody io.Closer
-	seekBody  io.Seeker
-	status    int
+	ctx          context.Context
+	handler      Handler
+	c            *http.Client
+	req          *http.Request
+	body         io.Reader
+	length       int64 // Uncompressed length of body.
+	compressible bool  // body can be gzip compressed.
+	closeBody    io.Closer
+	seekBody     io.Seeker
+	status       int
+	tries        int
 }
 
 func (r *retriable) Close() error {
@@ -153,29 +237,116 @@ func (r *retriable) Close() error {
 
 // Warning: it returns an error on HTTP >=400. This is different than
 // http.Client.Do() but hell it makes coding simpler.
-func (r *retriable) Do() error {
+//
+// Each try is traced and accounted in GetStats(). It fails fast with a
+// *CircuitOpenError when the host is deemed unhealthy.
+func (r *retriable) Do() (err error) {
+	// unhealthy is set when the host failed to handle the request.
+	unhealthy := false
+	b := getBreaker(r.req.URL.Host)
+	if b != nil {
+		if err := b.allow(now()); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil && err == r.ctx.Err() {
+				b.cancel()
+			} else {
+				b.done(now(), unhealthy)
+			}
+		}()
+	}
+	r.tries++
+	end := tracer.Span(r, "http", tracer.Args{"method": r.req.Method, "path": r.req.URL.Path, "try": r.tries})
+	start := time.Now()
+	var resp *http.Response
+	var reqBody []byte
+	var respBody *bytes.Buffer
+	compressed := false
+	sent := &counter{}
+	received := &counter{}
+	defer func() {
+		addStats(r.tries > 1, err != nil, sent.count(), received.count(), time.Since(start))
+		end(tracer.Args{"status": r.status, "err": err, "sent": sent.count(), "received": received.count()})
+		if respBody != nil {
+			if resp != nil {
+				// Make sure the whole response is dumped.
+				_, _ = io.Copy(ioutil.Discard, resp.Body)
+			}
+			if err2 := dump(DumpDir, r.req, reqBody, resp, respBody.Bytes(), err); err2 != nil {
+				log.Printf("failed to dump HTTP request: %s", err2)
+			}
+		}
+	}()
 	if r.seekBody != nil {
 		if _, err := r.seekBody.Seek(0, os.SEEK_SET); err != nil {
 			// Can't be retried.
 			return err
 		}
+		if DumpDir != "" {
+			if reqBody, err = ioutil.ReadAll(r.body); err != nil {
+				return err
+			}
+			if _, err := r.seekBody.Seek(0, os.SEEK_SET); err != nil {
+				return err
+			}
+		}
+		sent.r = r.body
+		compressed = r.compressible && r.length >= minCompressSize && acceptsGzip(r.req.URL.Host)
+		if compressed {
+			gz := gzipReader(r.body)
+			defer gz.Close()
+			sent.r = gz
+			r.req.Header.Set("Content-Encoding", "gzip")
+			r.req.ContentLength = -1
+		} else {
+			r.req.Header.Del("Content-Encoding")
+			r.req.ContentLength = r.length
+		}
+		// Make sure the body is not closed when calling http.Client.Do().
+		r.req.Body = ioutil.NopCloser(sent)
 	}
-	resp, err := r.c.Do(r.req)
+	if DumpDir != "" {
+		respBody = &bytes.Buffer{}
+	}
+	resp, err = ctxhttp.Do(r.ctx, r.c, r.req)
 	if resp != nil {
 		r.status = resp.StatusCode
+		learnGzip(r.req.URL.Host, resp)
+		received.r = resp.Body
+		if respBody != nil {
+			received.r = io.TeeReader(resp.Body, respBody)
+		}
+		resp.Body = &readCloser{received, resp.Body}
 	} else {
 		r.status = 0
 	}
 	if err != nil {
+		if err == r.ctx.Err() {
+			// Canceled or deadline exceeded, don't retry.
+			return err
+		}
+		unhealthy = true
 		// Any TCP level failure can be retried but malformed URL should nt.
 		if err2, ok := err.(*url.Error); ok {
 			return err2
 		}
-		return retry.Error{err}
+		return retry.Error{Err: err}
+	}
+	if compressed && resp.StatusCode == http.StatusUnsupportedMediaType {
+		// The server doesn't support compressed requests after all; retry
+		// without compression.
+		setAcceptsGzip(r.req.URL.Host, false)
+		return retry.Error{Err: fmt.Errorf("http request failed: %s (HTTP %d)", http.StatusText(resp.StatusCode), resp.StatusCode)}
 	}
+	unhealthy = resp.StatusCode >= 500
 	// If the HTTP status code means the request should be retried.
 	if resp.StatusCode == 408 || resp.StatusCode == 429 || resp.StatusCode >= 500 {
-		return retry.Error{fmt.Errorf("http request failed: %s (HTTP %d)", http.StatusText(resp.StatusCode), resp.StatusCode)}
+		err := retry.Error{Err: fmt.Errorf("http request failed: %s (HTTP %d)", http.StatusText(resp.StatusCode), resp.StatusCode)}
+		if resp.StatusCode == 429 || resp.StatusCode == 503 {
+			err.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+		return err
 	}
 	// Any other failure code is a hard failure.
 	if resp.StatusCode >= 400 {
@@ -189,3 +360,22 @@ func (r *retriable) Do() error {
 func (r *retriable) Status() int {
 	return r.status
 }
+
+// parseRetryAfter returns the duration specified by a Retry-After header
+// value, which is either a number of seconds or a HTTP date. Returns 0 if the
+// value is absent or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(value); err == nil {
+		if s < 0 {
+			return 0
+		}
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
@@ -18,6 +18,7 @@ import (
 
 	"github.com/luci/luci-go/client/internal/retry"
 	"github.com/maruel/ut"
+	"golang.org/x/net/context"
 )
 
 func TestNewRequestGET(t *testing.T) {
@@ -40,7 +41,7 @@ func TestNewRequestGET(t *testing.T) {
 	ut.AssertEqual(t, nil, err)
 
 	clientCalls := 0
-	clientReq, err := NewRequest(http.DefaultClient, httpReq, func(resp *http.Response) error {
+	clientReq, err := NewRequest(context.Background(), http.DefaultClient, httpReq, func(resp *http.Response) error {
 		clientCalls++
 		content, err := ioutil.ReadAll(resp.Body)
 		ut.AssertEqual(t, nil, err)
@@ -50,7 +51,7 @@ func TestNewRequestGET(t *testing.T) {
 	})
 	ut.AssertEqual(t, nil, err)
 
-	ut.AssertEqual(t, nil, fast.Do(clientReq))
+	ut.AssertEqual(t, nil, fast.Do(context.Background(), clientReq))
 	ut.AssertEqual(t, 200, clientReq.Status())
 	ut.AssertEqual(t, 2, serverCalls)
 	ut.AssertEqual(t, 1, clientCalls)
@@ -77,7 +78,7 @@ func TestNewRequestPOST(t *testing.T) {
 	ut.AssertEqual(t, nil, err)
 
 	clientCalls := 0
-	clientReq, err := NewRequest(http.DefaultClient, httpReq, func(resp *http.Response) error {
+	clientReq, err := NewRequest(context.Background(), http.DefaultClient, httpReq, func(resp *http.Response) error {
 		clientCalls++
 		content, err := ioutil.ReadAll(resp.Body)
 		ut.AssertEqual(t, nil, err)
@@ -87,7 +88,7 @@ func TestNewRequestPOST(t *testing.T) {
 	})
 	ut.AssertEqual(t, nil, err)
 
-	ut.AssertEqual(t, nil, fast.Do(clientReq))
+	ut.AssertEqual(t, nil, fast.Do(context.Background(), clientReq))
 	ut.AssertEqual(t, 200, clientReq.Status())
 	ut.AssertEqual(t, 2, serverCalls)
 	ut.AssertEqual(t, 1, clientCalls)
@@ -102,7 +103,7 @@ func TestNewRequestNotSeeker(t *testing.T) {
 	httpReq, err := http.NewRequest("POST", ts.URL, bytes.NewReader([]byte("foo bar")))
 	ut.AssertEqual(t, nil, err)
 
-	clientReq, err := NewRequest(http.DefaultClient, httpReq, func(resp *http.Response) error {
+	clientReq, err := NewRequest(context.Background(), http.DefaultClient, httpReq, func(resp *http.Response) error {
 		t.Fail()
 		return nil
 	})
@@ -115,7 +116,7 @@ func TestNewRequestBadURL(t *testing.T) {
 	httpReq, err := http.NewRequest("GET", "invalid url", nil)
 	ut.AssertEqual(t, nil, err)
 
-	clientReq, err := NewRequest(http.DefaultClient, httpReq, func(resp *http.Response) error {
+	clientReq, err := NewRequest(context.Background(), http.DefaultClient, httpReq, func(resp *http.Response) error {
 		t.Fail()
 		return nil
 	})
@@ -134,18 +135,18 @@ func TestNewRequestGETFail(t *testing.T) {
 	httpReq, err := http.NewRequest("GET", ts.URL, nil)
 	ut.AssertEqual(t, nil, err)
 
-	clientReq, err := NewRequest(http.DefaultClient, httpReq, func(resp *http.Response) error {
+	clientReq, err := NewRequest(context.Background(), http.DefaultClient, httpReq, func(resp *http.Response) error {
 		t.Fail()
 		return nil
 	})
 
-	ut.AssertEqual(t, retry.Error{errors.New("http request failed: Internal Server Error (HTTP 500)")}, fast.Do(clientReq))
+	ut.AssertEqual(t, retry.Error{Err: errors.New("http request failed: Internal Server Error (HTTP 500)")}, fast.Do(context.Background(), clientReq))
 	ut.AssertEqual(t, 500, clientReq.Status())
 	ut.AssertEqual(t, fast.MaxTries, serverCalls)
 }
 
 func TestNewRequestJSONBadURL(t *testing.T) {
-	clientReq, err := NewRequestJSON(http.DefaultClient, "GET", "invalid url", nil, nil)
+	clientReq, err := NewRequestJSON(context.Background(), http.DefaultClient, "GET", "invalid url", nil, nil)
 	ut.AssertEqual(t, errors.New("unsupported protocol scheme \"\""), err)
 	ut.AssertEqual(t, nil, clientReq)
 }
@@ -166,7 +167,7 @@ func TestGetJSON(t *testing.T) {
 	defer ts.Close()
 
 	actual := map[string]string{}
-	status, err := GetJSON(fast, http.DefaultClient, ts.URL, &actual)
+	status, err := GetJSON(context.Background(), fast, http.DefaultClient, ts.URL, &actual)
 	ut.AssertEqual(t, nil, err)
 	ut.AssertEqual(t, 200, status)
 	ut.AssertEqual(t, map[string]string{"success": "yeah"}, actual)
@@ -184,8 +185,8 @@ func TestGetJSONBadResult(t *testing.T) {
 	defer ts.Close()
 
 	actual := map[string]string{}
-	status, err := GetJSON(fast, http.DefaultClient, ts.URL, &actual)
-	ut.AssertEqual(t, retry.Error{errors.New("bad response " + ts.URL + ": invalid character 'y' looking for beginning of value")}, err)
+	status, err := GetJSON(context.Background(), fast, http.DefaultClient, ts.URL, &actual)
+	ut.AssertEqual(t, retry.Error{Err: errors.New("bad response " + ts.URL + ": invalid character 'y' looking for beginning of value")}, err)
 	ut.AssertEqual(t, 200, status)
 	ut.AssertEqual(t, map[string]string{}, actual)
 	ut.AssertEqual(t, fast.MaxTries, serverCalls)
@@ -201,8 +202,8 @@ func TestGetJSONBadResultIgnore(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	status, err := GetJSON(fast, http.DefaultClient, ts.URL, nil)
-	ut.AssertEqual(t, retry.Error{errors.New("bad response " + ts.URL + ": invalid character 'y' looking for beginning of value")}, err)
+	status, err := GetJSON(context.Background(), fast, http.DefaultClient, ts.URL, nil)
+	ut.AssertEqual(t, retry.Error{Err: errors.New("bad response " + ts.URL + ": invalid character 'y' looking for beginning of value")}, err)
 	ut.AssertEqual(t, 200, status)
 }
 
@@ -213,7 +214,7 @@ func TestGetJSONBadContentTypeIgnore(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	status, err := GetJSON(fast, http.DefaultClient, ts.URL, nil)
+	status, err := GetJSON(context.Background(), fast, http.DefaultClient, ts.URL, nil)
 	ut.AssertEqual(t, errors.New("unexpected Content-Type, expected \"application/json; charset=utf-8\", got \"text/plain; charset=utf-8\""), err)
 	ut.AssertEqual(t, 200, status)
 }
@@ -235,13 +236,101 @@ func TestPostJSON(t *testing.T) {
 
 	in := map[string]string{"in": "all"}
 	actual := map[string]string{}
-	status, err := PostJSON(fast, http.DefaultClient, ts.URL, in, &actual)
+	status, err := PostJSON(context.Background(), fast, http.DefaultClient, ts.URL, in, &actual)
 	ut.AssertEqual(t, nil, err)
 	ut.AssertEqual(t, 200, status)
 	ut.AssertEqual(t, map[string]string{"success": "yeah"}, actual)
 	ut.AssertEqual(t, 2, serverCalls)
 }
 
+func TestPostJSONReader(t *testing.T) {
+	// First call returns HTTP 500, second succeeds; the spooled body is resent.
+	serverCalls := 0
+	ts := httptest.NewServer(handlerJSON(t, func(body io.Reader) interface{} {
+		serverCalls++
+		data := map[string]string{}
+		ut.ExpectEqual(t, nil, json.NewDecoder(body).Decode(&data))
+		ut.ExpectEqual(t, map[string]string{"in": "all"}, data)
+		if serverCalls == 1 {
+			return nil
+		}
+		return map[string]string{"success": "yeah"}
+	}))
+	defer ts.Close()
+
+	in := NewSpool(4)
+	defer in.Close()
+	_, err := io.WriteString(in, `{"in":"all"}`)
+	ut.AssertEqual(t, nil, err)
+	actual := map[string]string{}
+	status, err := PostJSONReader(context.Background(), fast, http.DefaultClient, ts.URL, in, &actual)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 200, status)
+	ut.AssertEqual(t, map[string]string{"success": "yeah"}, actual)
+	ut.AssertEqual(t, 2, serverCalls)
+}
+
+func TestNewRequestRetryAfter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(429)
+	}))
+	defer ts.Close()
+
+	httpReq, err := http.NewRequest("GET", ts.URL, nil)
+	ut.AssertEqual(t, nil, err)
+	clientReq, err := NewRequest(context.Background(), http.DefaultClient, httpReq, func(resp *http.Response) error {
+		t.Fail()
+		return nil
+	})
+	ut.AssertEqual(t, nil, err)
+	expected := retry.Error{
+		Err:        errors.New("http request failed: Too Many Requests (HTTP 429)"),
+		RetryAfter: 2 * time.Minute,
+	}
+	ut.AssertEqual(t, expected, clientReq.Do())
+}
+
+func TestNewRequestCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Cancel while the request is in-flight.
+		cancel()
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	httpReq, err := http.NewRequest("GET", ts.URL, nil)
+	ut.AssertEqual(t, nil, err)
+	clientReq, err := NewRequest(ctx, http.DefaultClient, httpReq, func(resp *http.Response) error {
+		t.Fail()
+		return nil
+	})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, context.Canceled, slow.Do(ctx, clientReq))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	data := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"10", 10 * time.Second},
+		{"-1", 0},
+		{"soon", 0},
+		{"Wed, 21 Oct 2015 07:29:00 GMT", time.Minute},
+		{"Wed, 21 Oct 2015 07:27:00 GMT", 0},
+	}
+	for i, line := range data {
+		ut.AssertEqualIndex(t, i, line.expected, parseRetryAfter(line.value, now))
+	}
+}
+
 // Private details.
 
 var fast = &retry.Config{
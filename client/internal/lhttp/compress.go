@@ -0,0 +1,81 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package lhttp
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Private details.
+
+// minCompressSize is the minimum size of a request body to be compressed.
+const minCompressSize = 1024
+
+var (
+	gzipHostsLock sync.Mutex
+	// gzipHosts are the hosts that advertised support for gzip compressed
+	// requests.
+	gzipHosts = map[string]bool{}
+)
+
+func acceptsGzip(host string) bool {
+	gzipHostsLock.Lock()
+	defer gzipHostsLock.Unlock()
+	return gzipHosts[host]
+}
+
+func setAcceptsGzip(host string, accepts bool) {
+	gzipHostsLock.Lock()
+	defer gzipHostsLock.Unlock()
+	gzipHosts[host] = accepts
+}
+
+// learnGzip records if the server advertises support for gzip compressed
+// requests via the Accept-Encoding response header, as specified in RFC 7694.
+func learnGzip(host string, resp *http.Response) {
+	for _, v := range resp.Header[http.CanonicalHeaderKey("Accept-Encoding")] {
+		for _, e := range strings.Split(v, ",") {
+			if strings.TrimSpace(strings.SplitN(e, ";", 2)[0]) == "gzip" {
+				setAcceptsGzip(host, true)
+				return
+			}
+		}
+	}
+}
+
+// gzipReader returns a reader of the gzip compressed content of src. The
+// returned reader must be closed to stop the compressing goroutine; Close
+// returns once it stopped reading src.
+func gzipReader(src io.Reader) io.ReadCloser {
+	r, w := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		gz := gzip.NewWriter(w)
+		_, err := io.Copy(gz, src)
+		if err2 := gz.Close(); err == nil {
+			err = err2
+		}
+		_ = w.CloseWithError(err)
+	}()
+	return &gzipBody{r, done}
+}
+
+// gzipBody is the reader returned by gzipReader.
+type gzipBody struct {
+	*io.PipeReader
+	done chan struct{} // Closed when the compressing goroutine exits.
+}
+
+func (g *gzipBody) Close() error {
+	// Closing the pipe makes the goroutine fail its next write.
+	err := g.PipeReader.Close()
+	<-g.done
+	return err
+}
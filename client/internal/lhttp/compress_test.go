@@ -0,0 +1,138 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package lhttp
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/maruel/ut"
+	"golang.org/x/net/context"
+)
+
+func TestLearnGzip(t *testing.T) {
+	data := []struct {
+		header   []string
+		expected bool
+	}{
+		{nil, false},
+		{[]string{"identity"}, false},
+		{[]string{"gzip"}, true},
+		{[]string{"deflate, gzip;q=1.0"}, true},
+		{[]string{"deflate", " gzip "}, true},
+		{[]string{"gzipped"}, false},
+	}
+	for i, line := range data {
+		host := fmt.Sprintf("learn%d", i)
+		resp := &http.Response{Header: http.Header{}}
+		for _, v := range line.header {
+			resp.Header.Add("Accept-Encoding", v)
+		}
+		learnGzip(host, resp)
+		ut.AssertEqualIndex(t, i, line.expected, acceptsGzip(host))
+	}
+}
+
+func TestGzipReader(t *testing.T) {
+	r := gzipReader(strings.NewReader("foo bar"))
+	defer r.Close()
+	gz, err := gzip.NewReader(r)
+	ut.AssertEqual(t, nil, err)
+	content := make([]byte, 16)
+	n, _ := io.ReadFull(gz, content)
+	ut.AssertEqual(t, "foo bar", string(content[:n]))
+}
+
+func TestPostJSONCompressed(t *testing.T) {
+	// The first request is sent as-is. The server advertises gzip support so the
+	// following one is compressed.
+	in := map[string]string{"in": strings.Repeat("a", minCompressSize)}
+	var encodings []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			ut.AssertEqual(t, nil, err)
+			body = gz
+		}
+		data := map[string]string{}
+		ut.ExpectEqual(t, nil, json.NewDecoder(body).Decode(&data))
+		ut.ExpectEqual(t, in, data)
+		w.Header().Set("Accept-Encoding", "gzip")
+		w.Header().Set("Content-Type", jsonContentType)
+		ut.ExpectEqual(t, nil, json.NewEncoder(w).Encode(map[string]string{}))
+	}))
+	defer ts.Close()
+
+	for i := 0; i < 2; i++ {
+		_, err := PostJSON(context.Background(), fast, http.DefaultClient, ts.URL, in, nil)
+		ut.AssertEqual(t, nil, err)
+	}
+	ut.AssertEqual(t, []string{"", "gzip"}, encodings)
+}
+
+func TestPostJSONCompressedUnsupported(t *testing.T) {
+	// The server claims gzip support but rejects compressed requests; the
+	// request is retried uncompressed.
+	in := map[string]string{"in": strings.Repeat("a", minCompressSize)}
+	var encodings []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		if r.Header.Get("Content-Encoding") != "" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Type", jsonContentType)
+		ut.ExpectEqual(t, nil, json.NewEncoder(w).Encode(map[string]string{}))
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	ut.AssertEqual(t, nil, err)
+	setAcceptsGzip(u.Host, true)
+
+	_, err = PostJSON(context.Background(), fast, http.DefaultClient, ts.URL, in, nil)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"gzip", ""}, encodings)
+	ut.AssertEqual(t, false, acceptsGzip(u.Host))
+}
+
+func TestPostJSONCompressedRetried(t *testing.T) {
+	// The server fails before reading the body, while the compressing goroutine
+	// may still read the spool. Run with -race to check the goroutine is
+	// stopped before the spool is rewound for the next try.
+	tries := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tries++; tries < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		w.Header().Set("Content-Type", jsonContentType)
+		ut.ExpectEqual(t, nil, json.NewEncoder(w).Encode(map[string]string{}))
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	ut.AssertEqual(t, nil, err)
+	setAcceptsGzip(u.Host, true)
+
+	// Random data is slow to compress.
+	spool := NewSpool(1 << 30)
+	defer spool.Close()
+	_, err = io.CopyN(spool, rand.New(rand.NewSource(0)), 4<<20)
+	ut.AssertEqual(t, nil, err)
+	_, err = PostJSONReader(context.Background(), fast, http.DefaultClient, ts.URL, spool, nil)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 3, tries)
+}
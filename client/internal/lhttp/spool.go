@@ -0,0 +1,115 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package lhttp
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Spool is a seekable request body that is buffered in memory up to a limit
+// and spooled to a temporary file past this limit. It permits retrying large
+// requests while keeping memory usage bounded.
+//
+// The content must be written before being read. Close() must be called to
+// delete the temporary file, if any.
+type Spool struct {
+	maxMemory int64
+	data      []byte
+	f         *os.File
+	size      int64
+	pos       int64
+}
+
+// NewSpool returns a Spool that keeps at most maxMemory bytes in memory.
+func NewSpool(maxMemory int64) *Spool {
+	return &Spool{maxMemory: maxMemory}
+}
+
+// Write appends p to the content.
+func (s *Spool) Write(p []byte) (int, error) {
+	if s.f == nil && s.size+int64(len(p)) > s.maxMemory {
+		f, err := ioutil.TempFile("", "lhttp")
+		if err != nil {
+			return 0, err
+		}
+		s.f = f
+		if _, err := f.Write(s.data); err != nil {
+			return 0, err
+		}
+		s.data = nil
+	}
+	if s.f != nil {
+		n, err := s.f.Write(p)
+		s.size += int64(n)
+		return n, err
+	}
+	s.data = append(s.data, p...)
+	s.size += int64(len(p))
+	return len(p), nil
+}
+
+// Size returns the number of bytes written.
+func (s *Spool) Size() int64 {
+	return s.size
+}
+
+// Read implements io.Reader.
+func (s *Spool) Read(p []byte) (int, error) {
+	if s.pos >= s.size {
+		return 0, io.EOF
+	}
+	if s.f == nil {
+		n := copy(p, s.data[s.pos:])
+		s.pos += int64(n)
+		return n, nil
+	}
+	if int64(len(p)) > s.size-s.pos {
+		p = p[:s.size-s.pos]
+	}
+	n, err := s.f.ReadAt(p, s.pos)
+	s.pos += int64(n)
+	if err == io.EOF && n != 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (s *Spool) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_SET:
+	case os.SEEK_CUR:
+		offset += s.pos
+	case os.SEEK_END:
+		offset += s.size
+	default:
+		return s.pos, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return s.pos, errors.New("negative position")
+	}
+	s.pos = offset
+	return offset, nil
+}
+
+// Close deletes the temporary file, if any. It is fine to call it multiple
+// times.
+func (s *Spool) Close() error {
+	s.data = nil
+	s.size = 0
+	s.pos = 0
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	if err2 := os.Remove(s.f.Name()); err == nil {
+		err = err2
+	}
+	s.f = nil
+	return err
+}
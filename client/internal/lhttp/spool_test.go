@@ -0,0 +1,82 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package lhttp
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestSpoolMemory(t *testing.T) {
+	t.Parallel()
+	s := NewSpool(16)
+	_, err := s.Write([]byte("foo "))
+	ut.AssertEqual(t, nil, err)
+	_, err = s.Write([]byte("bar"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, (*os.File)(nil), s.f)
+	ut.AssertEqual(t, int64(7), s.Size())
+
+	content, err := ioutil.ReadAll(s)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "foo bar", string(content))
+	ut.AssertEqual(t, nil, s.Close())
+}
+
+func TestSpoolDisk(t *testing.T) {
+	t.Parallel()
+	s := NewSpool(4)
+	_, err := s.Write([]byte("foo "))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, (*os.File)(nil), s.f)
+	_, err = s.Write([]byte("bar"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, false, s.f == nil)
+	name := s.f.Name()
+	ut.AssertEqual(t, int64(7), s.Size())
+
+	content, err := ioutil.ReadAll(s)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "foo bar", string(content))
+
+	ut.AssertEqual(t, nil, s.Close())
+	_, err = os.Stat(name)
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+	// Close() is idempotent.
+	ut.AssertEqual(t, nil, s.Close())
+}
+
+func TestSpoolSeek(t *testing.T) {
+	t.Parallel()
+	for _, max := range []int64{0, 1024} {
+		s := NewSpool(max)
+		_, err := s.Write([]byte("foo bar"))
+		ut.AssertEqual(t, nil, err)
+
+		pos, err := s.Seek(-3, os.SEEK_END)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, int64(4), pos)
+		content, err := ioutil.ReadAll(s)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, "bar", string(content))
+
+		pos, err = s.Seek(1, os.SEEK_SET)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, int64(1), pos)
+		pos, err = s.Seek(1, os.SEEK_CUR)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, int64(2), pos)
+		content, err = ioutil.ReadAll(s)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, "o bar", string(content))
+
+		_, err = s.Seek(-1, os.SEEK_SET)
+		ut.AssertEqual(t, false, err == nil)
+		ut.AssertEqual(t, nil, s.Close())
+	}
+}
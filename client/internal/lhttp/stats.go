@@ -0,0 +1,158 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package lhttp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/luci/luci-go/client/internal/tracer"
+)
+
+// DumpDir is the directory where a sanitized copy of each HTTP request and
+// response is written for debugging purposes. Nothing is written when empty.
+// It is fine to update this variable on start up.
+var DumpDir string
+
+// Stats is the aggregate statistics of all the HTTP requests done by this
+// package.
+type Stats struct {
+	Requests      int64         // Number of tries, including retries.
+	Retries       int64         // Number of tries that were retries.
+	Failures      int64         // Number of tries that failed.
+	BytesSent     int64         // Request bodies.
+	BytesReceived int64         // Response bodies.
+	Duration      time.Duration // Cumulative duration of all tries.
+}
+
+// GetStats returns a copy of the aggregate statistics since the process
+// started.
+func GetStats() Stats {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	return stats
+}
+
+// Private details.
+
+var (
+	statsLock sync.Mutex
+	stats     Stats
+	dumpID    int64
+)
+
+func addStats(retry, failed bool, sent, received int64, duration time.Duration) {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	stats.Requests++
+	if retry {
+		stats.Retries++
+	}
+	if failed {
+		stats.Failures++
+	}
+	stats.BytesSent += sent
+	stats.BytesReceived += received
+	stats.Duration += duration
+}
+
+// counter counts the bytes read through it.
+//
+// The request body may still be read by the transport after the response was
+// received, so n is accessed atomically.
+type counter struct {
+	r io.Reader
+	n int64
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func (c *counter) count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// requestStats accounts a request sent with Do().
+type requestStats struct {
+	start    time.Time
+	end      func(tracer.Args)
+	sent     counter
+	received counter
+}
+
+func (s *requestStats) done(status int, err error) {
+	addStats(false, err != nil || status >= 400, s.sent.count(), s.received.count(), time.Since(s.start))
+	s.end(tracer.Args{"status": status, "err": err, "sent": s.sent.count(), "received": s.received.count()})
+}
+
+// statsBody is a response body that accounts the request once closed.
+type statsBody struct {
+	io.Closer // The original body.
+	s         *requestStats
+	status    int
+	once      sync.Once
+}
+
+func (b *statsBody) Read(p []byte) (int, error) {
+	return b.s.received.Read(p)
+}
+
+func (b *statsBody) Close() error {
+	err := b.Closer.Close()
+	b.once.Do(func() { b.s.done(b.status, nil) })
+	return err
+}
+
+// readCloser reads from a reader but closes another object.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// dump writes a sanitized copy of a request and its response in DumpDir.
+//
+// body is the request body and resp.Body is expected to be fully read. The
+// Authorization header is removed.
+func dump(dir string, req *http.Request, body []byte, resp *http.Response, respBody []byte, err error) error {
+	r := *req
+	r.Header = http.Header{}
+	for k, v := range req.Header {
+		if http.CanonicalHeaderKey(k) != "Authorization" {
+			r.Header[k] = v
+		}
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	out, err2 := httputil.DumpRequest(&r, true)
+	if err2 != nil {
+		return err2
+	}
+	b := bytes.NewBuffer(out)
+	b.WriteString("\n\n")
+	if resp != nil {
+		rs, err2 := httputil.DumpResponse(resp, false)
+		if err2 != nil {
+			return err2
+		}
+		b.Write(rs)
+		b.Write(respBody)
+		b.WriteString("\n")
+	}
+	if err != nil {
+		fmt.Fprintf(b, "\nError: %s\n", err)
+	}
+	name := fmt.Sprintf("%06d-%s.txt", atomic.AddInt64(&dumpID, 1), req.Method)
+	return ioutil.WriteFile(filepath.Join(dir, name), b.Bytes(), 0600)
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package lhttp
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maruel/ut"
+	"golang.org/x/net/context"
+)
+
+func TestStats(t *testing.T) {
+	serverCalls := 0
+	ts := httptest.NewServer(handlerJSON(t, func(body io.Reader) interface{} {
+		serverCalls++
+		if serverCalls == 1 {
+			return nil
+		}
+		return map[string]string{"success": "yeah"}
+	}))
+	defer ts.Close()
+
+	before := GetStats()
+	_, err := PostJSON(context.Background(), fast, http.DefaultClient, ts.URL, map[string]string{"in": "all"}, nil)
+	ut.AssertEqual(t, nil, err)
+	after := GetStats()
+	ut.AssertEqual(t, int64(2), after.Requests-before.Requests)
+	ut.AssertEqual(t, int64(1), after.Retries-before.Retries)
+	ut.AssertEqual(t, int64(1), after.Failures-before.Failures)
+	ut.AssertEqual(t, int64(2*len(`{"in":"all"}`)), after.BytesSent-before.BytesSent)
+	ut.AssertEqual(t, int64(len(`{"success":"yeah"}`)+1), after.BytesReceived-before.BytesReceived)
+}
+
+func TestDump(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "lhttp")
+	ut.AssertEqual(t, nil, err)
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Fail()
+		}
+	}()
+	DumpDir = tmpDir
+	defer func() {
+		DumpDir = ""
+	}()
+	auth := ""
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		handlerJSON(t, func(body io.Reader) interface{} {
+			return map[string]string{"success": "yeah"}
+		}).ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	// Like the oauth2 transport, the credentials are only set on a copy of the
+	// request.
+	c := &http.Client{Transport: bearerTransport("secret")}
+	_, err = PostJSON(context.Background(), fast, c, ts.URL, map[string]string{"in": "all"}, nil)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "Bearer secret", auth)
+
+	files, err := ioutil.ReadDir(tmpDir)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, len(files))
+	ut.AssertEqual(t, true, strings.HasSuffix(files[0].Name(), "-POST.txt"))
+	content, err := ioutil.ReadFile(filepath.Join(tmpDir, files[0].Name()))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, false, strings.Contains(string(content), "secret"))
+	ut.AssertEqual(t, true, strings.Contains(string(content), `{"in":"all"}`))
+	ut.AssertEqual(t, true, strings.Contains(string(content), `{"success":"yeah"}`))
+}
+
+func TestDoStats(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte("done"))
+	}))
+	defer ts.Close()
+
+	before := GetStats()
+	req, err := http.NewRequest("PUT", ts.URL, strings.NewReader("payload"))
+	ut.AssertEqual(t, nil, err)
+	resp, err := Do(context.Background(), http.DefaultClient, req)
+	ut.AssertEqual(t, nil, err)
+	_, err = ioutil.ReadAll(resp.Body)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, resp.Body.Close())
+	ut.AssertEqual(t, nil, resp.Body.Close())
+	after := GetStats()
+	ut.AssertEqual(t, int64(1), after.Requests-before.Requests)
+	ut.AssertEqual(t, int64(0), after.Failures-before.Failures)
+	ut.AssertEqual(t, int64(len("payload")), after.BytesSent-before.BytesSent)
+	ut.AssertEqual(t, int64(len("done")), after.BytesReceived-before.BytesReceived)
+}
+
+// bearerTransport adds an Authorization header to a copy of each request.
+type bearerTransport string
+
+func (b bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := *req
+	r.Header = http.Header{}
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", "Bearer "+string(b))
+	return http.DefaultTransport.RoundTrip(&r)
+}
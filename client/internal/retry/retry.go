@@ -6,52 +6,139 @@ package retry
 
 import (
 	"io"
+	"math/rand"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 // Default defines the default retry parameters that should be used throughout
 // the program. It is fine to update this variable on start up.
 var Default = &Config{
-	10,
-	100 * time.Millisecond,
-	500 * time.Millisecond,
-	5 * time.Second,
+	MaxTries:    10,
+	SleepMax:    10 * time.Second,
+	SleepBase:   100 * time.Millisecond,
+	MaxDuration: 5 * time.Minute,
 }
 
 // Config defines the retry properties.
+//
+// The sleep between tries grows exponentially from SleepBase and is capped at
+// SleepMax. The effective sleep is randomly selected between 0 and this value
+// ("full jitter"), so that clients failing at the same time do not retry in
+// lockstep.
+//
+// A Retry-After hint from the server replaces the exponential value and is
+// honored in full, even above SleepMax. Up to 10% is added to it so that the
+// clients told to wait for the same duration do not retry in lockstep.
+//
+// MaxDuration is a deadline, not a cap on the sleeps: when the next sleep would
+// end past it, Do() gives up immediately and returns the last error.
 type Config struct {
-	MaxTries            int           // Maximum number of retries.
-	SleepMax            time.Duration // Maximum duration of a single sleep.
-	SleepBase           time.Duration // Base sleep duration.
-	SleepMultiplicative time.Duration // Incremental sleep duration for each additional try.
+	MaxTries    int           // Maximum number of tries.
+	SleepMax    time.Duration // Maximum duration of a single sleep.
+	SleepBase   time.Duration // Base sleep duration; doubled at each try.
+	MaxDuration time.Duration // Maximum total duration including sleeps; 0 means no limit.
+
+	// SleepMultiplicative makes the sleep grow linearly, by this duration at
+	// each try, instead of doubling.
+	//
+	// Deprecated: the exponential growth is preferred; use SleepBase only.
+	SleepMultiplicative time.Duration
+
+	// Clock is used to sleep between tries. Defaults to the system clock.
+	Clock Clock
+	// Rand returns a random number in [0, n). Defaults to rand.Int63n.
+	Rand func(n int64) int64
 }
 
 // Do runs a Retriable, potentially retrying it multiple times.
-func (c *Config) Do(r Retriable) (err error) {
+//
+// It stops retrying when ctx is canceled and returns ctx.Err() in this case.
+// A retry.Error with RetryAfter set overrides the sleep duration. No retry is
+// attempted if the sleep would exceed MaxDuration.
+func (c *Config) Do(ctx context.Context, r Retriable) (err error) {
 	defer func() {
 		if err2 := r.Close(); err == nil {
 			err = err2
 		}
 	}()
+	clock := c.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+	start := clock.Now()
 	for i := 0; i < c.MaxTries; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
 		err = r.Do()
-		if _, ok := err.(Error); !ok {
+		e, ok := err.(Error)
+		if !ok {
 			return err
 		}
-		if i != c.MaxTries-1 {
-			s := c.SleepBase + time.Duration(i)*c.SleepMultiplicative
-			if s > c.SleepMax {
-				s = c.SleepMax
-			}
-			time.Sleep(s)
+		if i == c.MaxTries-1 {
+			break
+		}
+		var s time.Duration
+		if e.RetryAfter > 0 {
+			s = c.retryAfter(e.RetryAfter)
+		} else {
+			s = c.sleep(i)
+		}
+		if c.MaxDuration > 0 && clock.Now().Add(s).Sub(start) > c.MaxDuration {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(s):
 		}
 	}
 	return
 }
 
+// sleep returns the jittered sleep duration after the try i, starting at 0.
+func (c *Config) sleep(i int) time.Duration {
+	s := c.SleepBase
+	if c.SleepMultiplicative > 0 {
+		s += time.Duration(i) * c.SleepMultiplicative
+	} else {
+		for j := 0; j < i && s < c.SleepMax; j++ {
+			s *= 2
+		}
+	}
+	if s > c.SleepMax {
+		s = c.SleepMax
+	}
+	if s <= 0 {
+		return 0
+	}
+	return time.Duration(c.rand(int64(s) + 1))
+}
+
+// retryAfter returns the jittered sleep duration for a Retry-After hint of d.
+//
+// It is not capped at SleepMax; MaxDuration and the context deadline bound it.
+func (c *Config) retryAfter(d time.Duration) time.Duration {
+	return d + time.Duration(c.rand(int64(d/10)+1))
+}
+
+func (c *Config) rand(n int64) int64 {
+	if c.Rand != nil {
+		return c.Rand(n)
+	}
+	return rand.Int63n(n)
+}
+
 // Error is an error that can be retried.
 type Error struct {
 	Err error
+	// RetryAfter is the duration to wait before retrying, as hinted by the
+	// server. 0 means to use the normal backoff.
+	RetryAfter time.Duration
 }
 
 func (e Error) Error() string {
@@ -64,3 +151,22 @@ type Retriable interface {
 	io.Closer
 	Do() error
 }
+
+// Clock is the source of time used by Config. It can be mocked for testing.
+type Clock interface {
+	Now() time.Time
+	// After is like time.After().
+	After(d time.Duration) <-chan time.Time
+}
+
+// Private details.
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -10,32 +10,165 @@ import (
 	"time"
 
 	"github.com/maruel/ut"
+	"golang.org/x/net/context"
 )
 
 func TestDoOnce(t *testing.T) {
-	c := &Config{1, 0, 0, 0}
+	c := &Config{MaxTries: 1}
 	r := &retriable{}
-	ut.AssertEqual(t, nil, c.Do(r))
+	ut.AssertEqual(t, nil, c.Do(context.Background(), r))
 	ut.AssertEqual(t, 1, r.closed)
 	ut.AssertEqual(t, 1, r.tries)
 }
 
 func TestDoRetryExceeded(t *testing.T) {
-	c := &Config{1, 0, 0, 0}
+	c := &Config{MaxTries: 1}
 	r := &retriable{errs: []error{errRetry}}
-	ut.AssertEqual(t, errRetry, c.Do(r))
+	ut.AssertEqual(t, errRetry, c.Do(context.Background(), r))
 	ut.AssertEqual(t, 1, r.closed)
 	ut.AssertEqual(t, 1, r.tries)
 }
 
 func TestDoRetry(t *testing.T) {
-	c := &Config{2, 0, time.Millisecond, 0}
+	c := &Config{MaxTries: 2, SleepBase: time.Millisecond}
 	r := &retriable{errs: []error{errRetry}}
-	ut.AssertEqual(t, nil, c.Do(r))
+	ut.AssertEqual(t, nil, c.Do(context.Background(), r))
 	ut.AssertEqual(t, 1, r.closed)
 	ut.AssertEqual(t, 2, r.tries)
 }
 
+func TestDoBackoff(t *testing.T) {
+	clock := newFakeClock()
+	c := &Config{
+		MaxTries:  6,
+		SleepMax:  50 * time.Millisecond,
+		SleepBase: 10 * time.Millisecond,
+		Clock:     clock,
+		Rand:      maxRand,
+	}
+	r := &retriable{errs: []error{errRetry, errRetry, errRetry, errRetry, errRetry, errRetry}}
+	ut.AssertEqual(t, errRetry, c.Do(context.Background(), r))
+	ut.AssertEqual(t, 6, r.tries)
+	expected := []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		40 * time.Millisecond,
+		50 * time.Millisecond,
+		50 * time.Millisecond,
+	}
+	ut.AssertEqual(t, expected, clock.sleeps)
+}
+
+func TestDoJitter(t *testing.T) {
+	clock := newFakeClock()
+	var limits []int64
+	c := &Config{
+		MaxTries:  3,
+		SleepMax:  time.Second,
+		SleepBase: 10 * time.Millisecond,
+		Clock:     clock,
+		Rand: func(n int64) int64 {
+			limits = append(limits, n)
+			return n / 2
+		},
+	}
+	r := &retriable{errs: []error{errRetry, errRetry}}
+	ut.AssertEqual(t, nil, c.Do(context.Background(), r))
+	ut.AssertEqual(t, []int64{int64(10*time.Millisecond) + 1, int64(20*time.Millisecond) + 1}, limits)
+	ut.AssertEqual(t, []time.Duration{5 * time.Millisecond, 10 * time.Millisecond}, clock.sleeps)
+}
+
+func TestDoMaxDuration(t *testing.T) {
+	clock := newFakeClock()
+	c := &Config{
+		MaxTries:    10,
+		SleepMax:    time.Minute,
+		SleepBase:   time.Second,
+		MaxDuration: 5 * time.Second,
+		Clock:       clock,
+		Rand:        maxRand,
+	}
+	r := &retriable{errs: []error{errRetry, errRetry, errRetry, errRetry}}
+	ut.AssertEqual(t, errRetry, c.Do(context.Background(), r))
+	// 1s + 2s fit in the budget, 1s + 2s + 4s doesn't.
+	ut.AssertEqual(t, 3, r.tries)
+	ut.AssertEqual(t, []time.Duration{time.Second, 2 * time.Second}, clock.sleeps)
+}
+
+func TestDoRetryAfter(t *testing.T) {
+	clock := newFakeClock()
+	c := &Config{
+		MaxTries:  3,
+		SleepMax:  2 * time.Minute,
+		SleepBase: time.Second,
+		Clock:     clock,
+		Rand:      maxRand,
+	}
+	err := Error{Err: errors.New("throttled"), RetryAfter: time.Minute}
+	r := &retriable{errs: []error{err, errRetry}}
+	ut.AssertEqual(t, nil, c.Do(context.Background(), r))
+	// The hint is jittered by up to 10%.
+	ut.AssertEqual(t, []time.Duration{66 * time.Second, 2 * time.Second}, clock.sleeps)
+}
+
+func TestDoRetryAfterAboveSleepMax(t *testing.T) {
+	clock := newFakeClock()
+	c := &Config{
+		MaxTries:  2,
+		SleepMax:  10 * time.Second,
+		SleepBase: time.Second,
+		Clock:     clock,
+		Rand:      maxRand,
+	}
+	// The hint is honored in full even if larger than SleepMax.
+	err := Error{Err: errors.New("throttled"), RetryAfter: time.Minute}
+	r := &retriable{errs: []error{err}}
+	ut.AssertEqual(t, nil, c.Do(context.Background(), r))
+	ut.AssertEqual(t, []time.Duration{66 * time.Second}, clock.sleeps)
+}
+
+func TestDoRetryAfterMaxDuration(t *testing.T) {
+	clock := newFakeClock()
+	c := &Config{
+		MaxTries:    2,
+		SleepMax:    10 * time.Second,
+		SleepBase:   time.Second,
+		MaxDuration: time.Minute,
+		Clock:       clock,
+		Rand:        maxRand,
+	}
+	// An hour long hint makes the client give up right away.
+	err := Error{Err: errors.New("throttled"), RetryAfter: time.Hour}
+	r := &retriable{errs: []error{err}}
+	ut.AssertEqual(t, err, c.Do(context.Background(), r))
+	ut.AssertEqual(t, 0, len(clock.sleeps))
+}
+
+func TestDoSleepMultiplicative(t *testing.T) {
+	clock := newFakeClock()
+	c := &Config{
+		MaxTries:            4,
+		SleepMax:            time.Second,
+		SleepBase:           100 * time.Millisecond,
+		SleepMultiplicative: 500 * time.Millisecond,
+		Clock:               clock,
+		Rand:                maxRand,
+	}
+	r := &retriable{errs: []error{errRetry, errRetry, errRetry, errRetry}}
+	ut.AssertEqual(t, errRetry, c.Do(context.Background(), r))
+	expected := []time.Duration{100 * time.Millisecond, 600 * time.Millisecond, time.Second}
+	ut.AssertEqual(t, expected, clock.sleeps)
+}
+
+func TestDoCanceled(t *testing.T) {
+	c := &Config{MaxTries: 3, SleepMax: time.Hour, SleepBase: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &retriable{errs: []error{errRetry, errRetry}, onDo: cancel}
+	ut.AssertEqual(t, context.Canceled, c.Do(ctx, r))
+	ut.AssertEqual(t, 1, r.closed)
+	ut.AssertEqual(t, 1, r.tries)
+}
+
 func TestError(t *testing.T) {
 	ut.AssertEqual(t, "please try again", errRetry.Error())
 }
@@ -43,12 +176,13 @@ func TestError(t *testing.T) {
 // Private details.
 
 var errYo = errors.New("yo")
-var errRetry = Error{errors.New("please try again")}
+var errRetry = Error{Err: errors.New("please try again")}
 
 type retriable struct {
 	closed int
 	tries  int
 	errs   []error
+	onDo   func()
 }
 
 func (r *retriable) Close() error {
@@ -61,6 +195,9 @@ func (r *retriable) Close() error {
 
 func (r *retriable) Do() error {
 	r.tries++
+	if r.onDo != nil {
+		r.onDo()
+	}
 	if len(r.errs) != 0 {
 		err := r.errs[0]
 		r.errs = r.errs[1:]
@@ -68,3 +205,30 @@ func (r *retriable) Do() error {
 	}
 	return nil
 }
+
+// maxRand disables the jitter.
+func maxRand(n int64) int64 {
+	return n - 1
+}
+
+// fakeClock records the sleeps and returns immediately.
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.sleeps = append(f.sleeps, d)
+	f.now = f.now.Add(d)
+	c := make(chan time.Time, 1)
+	c <- f.now
+	return c
+}
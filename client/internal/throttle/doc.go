@@ -0,0 +1,12 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package throttle implements a bandwidth limiter shared by concurrent
+// transfers.
+//
+// It is a token bucket: every byte read through a throttled reader consumes a
+// token and tokens are replenished at a fixed rate. Readers that exceed the
+// budget are put to sleep, so the aggregate throughput of all readers sharing
+// a Limiter converges to the configured rate.
+package throttle
@@ -0,0 +1,129 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package throttle
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Default is the process wide Limiter. It is unlimited by default. It is fine
+// to call SetRate() on it on start up.
+var Default = New(0)
+
+// Limiter limits the aggregate throughput of all the readers created with
+// Reader().
+//
+// A nil Limiter is valid and never throttles.
+type Limiter struct {
+	// Immutable.
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	// Mutable.
+	lock   sync.Mutex
+	rate   int64     // Bytes per second; 0 means unlimited.
+	tokens float64   // Available bytes; negative when in debt.
+	last   time.Time // Last time tokens were replenished.
+}
+
+// New returns a Limiter that limits the throughput to bytesPerSecond.
+//
+// If bytesPerSecond is 0, the throughput is not limited.
+func New(bytesPerSecond int64) *Limiter {
+	l := &Limiter{now: time.Now, sleep: time.Sleep}
+	l.SetRate(bytesPerSecond)
+	return l
+}
+
+// SetRate changes the throughput limit. 0 disables throttling.
+func (l *Limiter) SetRate(bytesPerSecond int64) {
+	if bytesPerSecond < 0 {
+		bytesPerSecond = 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rate = bytesPerSecond
+	// Start with a full bucket, e.g. 1 second worth of data.
+	l.tokens = float64(bytesPerSecond)
+	l.last = l.now()
+}
+
+// Rate returns the current throughput limit in bytes per second.
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rate
+}
+
+// Wait blocks until n bytes can be transferred without exceeding the rate.
+//
+// Concurrent callers are served in the order they called Wait(): each call
+// reserves its bytes immediately and sleeps for the debt accumulated up to
+// that point.
+func (l *Limiter) Wait(n int) {
+	if d := l.reserve(n); d > 0 {
+		l.sleep(d)
+	}
+}
+
+// Reader returns a reader that throttles reads from r.
+//
+// If l is nil or unlimited at the time of the read, r is read at full speed.
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{r: r, l: l}
+}
+
+// Private details.
+
+// maxChunk is the maximum number of bytes read at once by a throttled reader.
+// This ensures that a large buffer passed to Read() doesn't create a large
+// burst followed by a long sleep.
+const maxChunk = 32 * 1024
+
+func (l *Limiter) reserve(n int) time.Duration {
+	if l == nil || n <= 0 {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rate == 0 {
+		return 0
+	}
+	now := l.now()
+	rate := float64(l.rate)
+	l.tokens += now.Sub(l.last).Seconds() * rate
+	if l.tokens > rate {
+		// Cap the burst to 1 second worth of data.
+		l.tokens = rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / rate * float64(time.Second))
+}
+
+type reader struct {
+	r io.Reader
+	l *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > maxChunk {
+		p = p[:maxChunk]
+	}
+	n, err := r.r.Read(p)
+	r.l.Wait(n)
+	return n, err
+}
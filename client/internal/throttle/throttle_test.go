@@ -0,0 +1,99 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package throttle
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/maruel/ut"
+)
+
+func TestNil(t *testing.T) {
+	t.Parallel()
+	var l *Limiter
+	l.Wait(1000)
+	ut.AssertEqual(t, int64(0), l.Rate())
+	r := bytes.NewReader([]byte("foo"))
+	ut.AssertEqual(t, r, l.Reader(r))
+}
+
+func TestUnlimited(t *testing.T) {
+	t.Parallel()
+	l, c := newFake(0)
+	l.Wait(1 << 30)
+	ut.AssertEqual(t, []time.Duration(nil), c.slept)
+}
+
+func TestWait(t *testing.T) {
+	t.Parallel()
+	l, c := newFake(100)
+	// The bucket starts full.
+	l.Wait(100)
+	ut.AssertEqual(t, []time.Duration(nil), c.slept)
+	// 50 bytes in debt.
+	l.Wait(50)
+	ut.AssertEqual(t, []time.Duration{500 * time.Millisecond}, c.slept)
+	// The fake sleep advanced the clock, so the debt was repaid.
+	l.Wait(100)
+	ut.AssertEqual(t, []time.Duration{500 * time.Millisecond, time.Second}, c.slept)
+}
+
+func TestBurstIsCapped(t *testing.T) {
+	t.Parallel()
+	l, c := newFake(100)
+	l.Wait(100)
+	// A long idle period doesn't accumulate more than 1 second of tokens.
+	c.now = c.now.Add(time.Hour)
+	l.Wait(200)
+	ut.AssertEqual(t, []time.Duration{time.Second}, c.slept)
+}
+
+func TestReader(t *testing.T) {
+	t.Parallel()
+	l, c := newFake(maxChunk)
+	data := make([]byte, 3*maxChunk)
+	content, err := ioutil.ReadAll(l.Reader(bytes.NewReader(data)))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, data, content)
+	total := time.Duration(0)
+	for _, d := range c.slept {
+		total += d
+	}
+	// The first chunk is free, the 2 others are throttled.
+	ut.AssertEqual(t, 2*time.Second, total)
+}
+
+func TestSetRate(t *testing.T) {
+	t.Parallel()
+	l, c := newFake(100)
+	ut.AssertEqual(t, int64(100), l.Rate())
+	l.SetRate(-1)
+	ut.AssertEqual(t, int64(0), l.Rate())
+	l.Wait(1000)
+	ut.AssertEqual(t, []time.Duration(nil), c.slept)
+}
+
+// Private details.
+
+type fakeClock struct {
+	now   time.Time
+	slept []time.Duration
+}
+
+func newFake(rate int64) (*Limiter, *fakeClock) {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	l := &Limiter{
+		now: func() time.Time { return c.now },
+		sleep: func(d time.Duration) {
+			c.slept = append(c.slept, d)
+			c.now = c.now.Add(d)
+		},
+	}
+	l.SetRate(rate)
+	return l, c
+}
@@ -51,6 +51,7 @@ type ArchiveOptions struct {
 	PathVariables   common.KeyValVars `json:"path_variables"`
 	ExtraVariables  common.KeyValVars `json:"extra_variables"`
 	ConfigVariables common.KeyValVars `json:"config_variables"`
+	FollowSymlinks  bool              `json:"follow_symlinks"`
 }
 
 // Init initializes with non-nil values.
@@ -227,6 +228,7 @@ func archive(arch archiver.Archiver, opts *ArchiveOptions, displayName string) (
 	if err != nil {
 		return nil, err
 	}
+	walkOpts := &archiver.WalkOptions{Blacklist: opts.Blacklist, FollowSymlinks: opts.FollowSymlinks}
 	// Handle each dependency, either a file or a directory..
 	fileFutures := make([]archiver.Future, 0, filesCount)
 	dirFutures := make([]archiver.Future, 0, dirsCount)
@@ -240,7 +242,7 @@ func archive(arch archiver.Archiver, opts *ArchiveOptions, displayName string) (
 			if err != nil {
 				return nil, err
 			}
-			dirFutures = append(dirFutures, archiver.PushDirectory(arch, dep, relPath, opts.Blacklist))
+			dirFutures = append(dirFutures, archiver.PushDirectory(arch, dep, relPath, walkOpts))
 		} else {
 			// Grab the stats right away.
 			info, err := os.Lstat(dep)
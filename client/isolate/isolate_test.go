@@ -20,6 +20,7 @@ import (
 	"github.com/luci/luci-go/client/isolatedclient/isolatedfake"
 	"github.com/luci/luci-go/common/isolated"
 	"github.com/maruel/ut"
+	"golang.org/x/net/context"
 )
 
 func init() {
@@ -52,7 +53,7 @@ func TestArchive(t *testing.T) {
 	server := isolatedfake.New()
 	ts := httptest.NewServer(server)
 	defer ts.Close()
-	a := archiver.New(isolatedclient.New(ts.URL, "default-gzip"), nil)
+	a := archiver.New(context.Background(), isolatedclient.New(nil, ts.URL, "default-gzip"), nil)
 
 	// Setup temporary directory.
 	//   /base/bar
@@ -186,7 +187,7 @@ func TestArchive(t *testing.T) {
 // Test that if the isolate file is not found, the error is properly propagated.
 func TestArchiveFileNotFoundReturnsError(t *testing.T) {
 	t.Parallel()
-	a := archiver.New(isolatedclient.New("http://unused", "default-gzip"), nil)
+	a := archiver.New(context.Background(), isolatedclient.New(nil, "http://unused", "default-gzip"), nil)
 	opts := &ArchiveOptions{
 		Isolate:  "/this-file-does-not-exist",
 		Isolated: "/this-file-doesnt-either",
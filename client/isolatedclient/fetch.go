@@ -0,0 +1,145 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolatedclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/luci/luci-go/common/isolated"
+	"github.com/luci/luci-go/common/parallel"
+	"golang.org/x/net/context"
+)
+
+// maxConcurrentFetch is the maximum number of files downloaded concurrently
+// by FetchTree.
+const maxConcurrentFetch = 16
+
+// FetchTree downloads the isolated tree root and all the files it references
+// into outDir.
+//
+// It returns the root .isolated file with its includes merged in, so the
+// caller can use its Command and RelativeCwd.
+func FetchTree(ctx context.Context, is IsolateServer, root isolated.HexDigest, outDir string) (*isolated.Isolated, error) {
+	out := &isolated.Isolated{Files: map[string]isolated.File{}}
+	if err := fetchIsolated(ctx, is, root, out, map[isolated.HexDigest]bool{}); err != nil {
+		return nil, err
+	}
+	if err := checkFiles(out.Files); err != nil {
+		return nil, err
+	}
+	sem := make(chan struct{}, maxConcurrentFetch)
+	err := parallel.FanOutIn(func(c chan<- func() error) {
+		for name, f := range out.Files {
+			name, f := name, f
+			c <- func() error {
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				return fetchFile(ctx, is, filepath.Join(outDir, filepath.FromSlash(name)), f)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Private details.
+
+// fetchIsolated fetches the .isolated file digest and its includes and merges
+// them into out. Entries already in out take precedence, as do earlier
+// includes over later ones.
+//
+// stack holds the .isolated files being fetched by the callers. A file may be
+// included more than once, only including itself is an error.
+func fetchIsolated(ctx context.Context, is IsolateServer, digest isolated.HexDigest, out *isolated.Isolated, stack map[isolated.HexDigest]bool) error {
+	if stack[digest] {
+		return fmt.Errorf("include cycle on %s", digest)
+	}
+	stack[digest] = true
+	defer delete(stack, digest)
+	buf := &bytes.Buffer{}
+	if err := is.Fetch(ctx, digest, buf); err != nil {
+		return err
+	}
+	i := &isolated.Isolated{}
+	if err := json.Unmarshal(buf.Bytes(), i); err != nil {
+		return fmt.Errorf("invalid isolated file %s: %s", digest, err)
+	}
+	if out.Command == nil {
+		out.Command = i.Command
+		out.RelativeCwd = i.RelativeCwd
+	}
+	if out.ReadOnly == nil {
+		out.ReadOnly = i.ReadOnly
+	}
+	if out.Algo == "" {
+		out.Algo = i.Algo
+		out.Version = i.Version
+	}
+	for name, f := range i.Files {
+		if _, ok := out.Files[name]; !ok {
+			out.Files[name] = f
+		}
+	}
+	for _, include := range i.Includes {
+		if err := fetchIsolated(ctx, is, include, out, stack); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFiles returns an error if a file of the tree would be written outside
+// of the output directory.
+//
+// Names must be clean relative paths. Since the files are written
+// concurrently, a file must also not be below a symlink of the tree, as it
+// would be written wherever the symlink points to.
+func checkFiles(files map[string]isolated.File) error {
+	for name := range files {
+		if name == "" || path.IsAbs(name) || path.Clean(name) != name || name == ".." || strings.HasPrefix(name, "../") ||
+			strings.Contains(name, "\\") || filepath.VolumeName(filepath.FromSlash(name)) != "" {
+			return fmt.Errorf("invalid file name %q", name)
+		}
+	}
+	for name := range files {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if f, ok := files[dir]; ok && f.Link != nil {
+				return fmt.Errorf("%q is below the symlink %q", name, dir)
+			}
+		}
+	}
+	return nil
+}
+
+// fetchFile downloads a single file or creates a symlink at path.
+func fetchFile(ctx context.Context, is IsolateServer, path string, f isolated.File) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if f.Link != nil {
+		return os.Symlink(filepath.FromSlash(*f.Link), path)
+	}
+	mode := os.FileMode(0644)
+	if f.Mode != nil {
+		mode = os.FileMode(*f.Mode) & os.ModePerm
+	}
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	err = is.Fetch(ctx, f.Digest, dst)
+	if err2 := dst.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
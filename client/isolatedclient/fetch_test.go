@@ -0,0 +1,159 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolatedclient
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/luci/luci-go/client/isolatedclient/isolatedfake"
+	"github.com/luci/luci-go/common/isolated"
+	"github.com/maruel/ut"
+	"golang.org/x/net/context"
+)
+
+func TestFetchTree(t *testing.T) {
+	t.Parallel()
+	tmpDir, err := ioutil.TempDir("", "isolatedclient")
+	ut.AssertEqual(t, nil, err)
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Fail()
+		}
+	}()
+	server := isolatedfake.New()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	client := New(nil, ts.URL, "default-gzip")
+
+	foo := []byte("foo")
+	bar := []byte("bar")
+	server.Inject(foo)
+	server.Inject(bar)
+	mode := 0700
+	link := "a/foo"
+	fooSize := int64(len(foo))
+	barSize := int64(len(bar))
+	include := &isolated.Isolated{
+		Algo:    "sha-1",
+		Command: []string{"ignored"},
+		Files: map[string]isolated.File{
+			"a/foo": {Digest: isolated.HashBytes(bar), Size: &barSize},
+			"b/bar": {Digest: isolated.HashBytes(bar), Size: &barSize},
+		},
+		Version: isolated.IsolatedFormatVersion,
+	}
+	includeRaw, err := json.Marshal(include)
+	ut.AssertEqual(t, nil, err)
+	server.Inject(includeRaw)
+	root := &isolated.Isolated{
+		Algo:    "sha-1",
+		Command: []string{"run"},
+		Files: map[string]isolated.File{
+			// Overrides the include's entry.
+			"a/foo": {Digest: isolated.HashBytes(foo), Mode: &mode, Size: &fooSize},
+			"link":  {Link: &link},
+		},
+		Includes:    []isolated.HexDigest{isolated.HashBytes(includeRaw)},
+		RelativeCwd: "a",
+		Version:     isolated.IsolatedFormatVersion,
+	}
+	rootRaw, err := json.Marshal(root)
+	ut.AssertEqual(t, nil, err)
+	server.Inject(rootRaw)
+
+	out, err := FetchTree(context.Background(), client, isolated.HashBytes(rootRaw), tmpDir)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"run"}, out.Command)
+	ut.AssertEqual(t, "a", out.RelativeCwd)
+	ut.AssertEqual(t, 3, len(out.Files))
+
+	content, err := ioutil.ReadFile(filepath.Join(tmpDir, "a", "foo"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, foo, content)
+	content, err = ioutil.ReadFile(filepath.Join(tmpDir, "b", "bar"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, bar, content)
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(filepath.Join(tmpDir, "a", "foo"))
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, os.FileMode(0700), fi.Mode().Perm())
+		target, err := os.Readlink(filepath.Join(tmpDir, "link"))
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, filepath.Join("a", "foo"), target)
+	}
+	ut.AssertEqual(t, nil, server.Error())
+}
+
+func TestFetchTreeDiamond(t *testing.T) {
+	t.Parallel()
+	tmpDir, err := ioutil.TempDir("", "isolatedclient")
+	ut.AssertEqual(t, nil, err)
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Fail()
+		}
+	}()
+	server := isolatedfake.New()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	client := New(nil, ts.URL, "default-gzip")
+
+	foo := []byte("foo")
+	server.Inject(foo)
+	fooSize := int64(len(foo))
+	inject := func(i *isolated.Isolated) isolated.HexDigest {
+		i.Algo = "sha-1"
+		i.Version = isolated.IsolatedFormatVersion
+		raw, err := json.Marshal(i)
+		ut.AssertEqual(t, nil, err)
+		server.Inject(raw)
+		return isolated.HashBytes(raw)
+	}
+	// Both a and b include common.
+	common := inject(&isolated.Isolated{
+		Files: map[string]isolated.File{"foo": {Digest: isolated.HashBytes(foo), Size: &fooSize}},
+	})
+	a := inject(&isolated.Isolated{Includes: []isolated.HexDigest{common}})
+	b := inject(&isolated.Isolated{Includes: []isolated.HexDigest{common}})
+	root := inject(&isolated.Isolated{Command: []string{"run"}, Includes: []isolated.HexDigest{a, b}})
+
+	out, err := FetchTree(context.Background(), client, root, tmpDir)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, len(out.Files))
+	content, err := ioutil.ReadFile(filepath.Join(tmpDir, "foo"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, foo, content)
+	ut.AssertEqual(t, nil, server.Error())
+}
+
+func TestCheckFiles(t *testing.T) {
+	t.Parallel()
+	link := "/etc"
+	data := []struct {
+		files map[string]isolated.File
+		ok    bool
+	}{
+		{map[string]isolated.File{"a/b": {}, "link": {Link: &link}}, true},
+		{map[string]isolated.File{"": {}}, false},
+		{map[string]isolated.File{"/a": {}}, false},
+		{map[string]isolated.File{"..": {}}, false},
+		{map[string]isolated.File{"../a": {}}, false},
+		{map[string]isolated.File{"a/../../b": {}}, false},
+		{map[string]isolated.File{"a//b": {}}, false},
+		{map[string]isolated.File{`a\..\..\b`: {}}, false},
+		{map[string]isolated.File{"c:/a": {}}, runtime.GOOS != "windows"},
+		{map[string]isolated.File{"a/b/c": {}, "a": {Link: &link}}, false},
+		{map[string]isolated.File{"a/b": {}, "a": {Link: &link}}, false},
+	}
+	for i, line := range data {
+		ut.AssertEqualIndex(t, i, line.ok, checkFiles(line.files) == nil)
+	}
+}
@@ -7,16 +7,26 @@ package isolatedclient
 import (
 	"errors"
 	"flag"
+	"fmt"
+	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
 
 	"github.com/luci/luci-go/client/internal/lhttp"
+	"github.com/luci/luci-go/client/internal/throttle"
 	"github.com/luci/luci-go/client/isolatedclient/isolatedfake"
 )
 
 type Flags struct {
-	ServerURL string
-	Namespace string
+	ServerURL    string
+	Namespace    string
+	MaxBandwidth int64
+	DryRun       bool
+	OutputStore  string
+
+	envErr error
 }
 
 func (c *Flags) Init(f *flag.FlagSet) {
@@ -25,24 +35,65 @@ func (c *Flags) Init(f *flag.FlagSet) {
 		"Isolate server to use; defaults to value of $ISOLATE_SERVER; use special value 'fake' to use a fake server")
 	f.StringVar(&c.ServerURL, "I", i, "Alias for -isolate-server")
 	f.StringVar(&c.Namespace, "namespace", "default-gzip", "")
+	var b int64
+	if v := os.Getenv("ISOLATE_MAX_BANDWIDTH"); v != "" {
+		var err error
+		if b, err = strconv.ParseInt(v, 10, 64); err != nil {
+			c.envErr = fmt.Errorf("invalid $ISOLATE_MAX_BANDWIDTH %q", v)
+		}
+	}
+	f.Int64Var(&c.MaxBandwidth, "max-bandwidth", b,
+		"Maximum bandwidth in bytes per second shared by all transfers; defaults to value of $ISOLATE_MAX_BANDWIDTH; 0 means unlimited")
+	f.BoolVar(&c.DryRun, "dry-run", false,
+		"Do not contact any isolate server; only calculate the hashes")
+	f.StringVar(&c.OutputStore, "output-store", "",
+		"Do not contact any isolate server; store the archived content in this local directory instead. Implies -dry-run")
 }
 
 func (c *Flags) Parse() error {
-	if c.ServerURL == "" {
-		return errors.New("-isolate-server must be specified")
+	if c.envErr != nil {
+		return c.envErr
 	}
-	if c.ServerURL == "fake" {
-		ts := httptest.NewServer(isolatedfake.New())
-		c.ServerURL = ts.URL
-	} else {
-		if s, err := lhttp.CheckURL(c.ServerURL); err != nil {
+	if c.OutputStore != "" {
+		c.DryRun = true
+		p, err := filepath.Abs(c.OutputStore)
+		if err != nil {
 			return err
+		}
+		c.OutputStore = p
+	}
+	// No server is contacted on dry run.
+	if !c.DryRun {
+		if c.ServerURL == "" {
+			return errors.New("-isolate-server must be specified")
+		}
+		if c.ServerURL == "fake" {
+			ts := httptest.NewServer(isolatedfake.New())
+			c.ServerURL = ts.URL
 		} else {
-			c.ServerURL = s
+			if s, err := lhttp.CheckURL(c.ServerURL); err != nil {
+				return err
+			} else {
+				c.ServerURL = s
+			}
 		}
 	}
 	if c.Namespace == "" {
 		return errors.New("-namespace must be specified.")
 	}
+	if c.MaxBandwidth < 0 {
+		return errors.New("-max-bandwidth must be non-negative.")
+	}
+	throttle.Default.SetRate(c.MaxBandwidth)
 	return nil
 }
+
+// NewServer returns the IsolateServer to use as specified by the flags.
+//
+// client is used to contact the server and is ignored on dry run.
+func (c *Flags) NewServer(client *http.Client) IsolateServer {
+	if c.DryRun {
+		return NewLocal(c.OutputStore)
+	}
+	return New(client, c.ServerURL, c.Namespace)
+}
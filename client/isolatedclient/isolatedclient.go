@@ -5,7 +5,11 @@
 package isolatedclient
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -13,20 +17,34 @@ import (
 
 	"github.com/luci/luci-go/client/internal/lhttp"
 	"github.com/luci/luci-go/client/internal/retry"
+	"github.com/luci/luci-go/client/internal/throttle"
 	"github.com/luci/luci-go/client/internal/tracer"
 	"github.com/luci/luci-go/common/isolated"
+	"golang.org/x/net/context"
 )
 
 // IsolateServer is the low-level client interface to interact with an Isolate
 // server.
+//
+// In-flight requests are aborted when ctx is canceled.
 type IsolateServer interface {
-	ServerCapabilities() (*isolated.ServerCapabilities, error)
+	ServerCapabilities(ctx context.Context) (*isolated.ServerCapabilities, error)
 	// Contains looks up cache presence on the server of multiple items.
 	//
 	// The returned list is in the same order as 'items', with entries nil for
 	// items that were present.
-	Contains(items []*isolated.DigestItem) ([]*PushState, error)
-	Push(state *PushState, src io.Reader) error
+	Contains(ctx context.Context, items []*isolated.DigestItem) ([]*PushState, error)
+	// Push uploads the content of src.
+	//
+	// It returns a *lhttp.CircuitOpenError when the server is deemed unhealthy,
+	// so the call can be retried later. src may have been partially read by
+	// then so it must be rewound before retrying.
+	Push(ctx context.Context, state *PushState, src io.Reader) error
+	// Fetch downloads the uncompressed content of digest into dest.
+	//
+	// The content is verified against digest as it is written; on mismatch an
+	// error is returned after dest received the invalid content.
+	Fetch(ctx context.Context, digest isolated.HexDigest, dest io.Writer) error
 }
 
 // PushState is per-item state passed from IsolateServer.Contains() to
@@ -35,14 +53,23 @@ type IsolateServer interface {
 // Its content is implementation specific.
 type PushState struct {
 	status    isolated.PreuploadStatus
+	digest    isolated.HexDigest
 	size      int64
 	uploaded  bool
 	finalized bool
 }
 
 // New returns a new IsolateServer client.
-func New(host, namespace string) IsolateServer {
+//
+// client is used for the Isolate server API calls, which usually require
+// credentials; http.DefaultClient is used if nil. Transfers to and from Cloud
+// Storage never use it since their URLs are already signed.
+func New(client *http.Client, host, namespace string) IsolateServer {
+	if client == nil {
+		client = http.DefaultClient
+	}
 	i := &isolateServer{
+		client:    client,
 		url:       strings.TrimRight(host, "/"),
 		namespace: namespace,
 	}
@@ -53,33 +80,34 @@ func New(host, namespace string) IsolateServer {
 // Private details.
 
 type isolateServer struct {
+	client    *http.Client
 	url       string
 	namespace string
 }
 
-func (i *isolateServer) postJSON(resource string, in, out interface{}) error {
+func (i *isolateServer) postJSON(ctx context.Context, resource string, in, out interface{}) error {
 	if len(resource) == 0 || resource[0] != '/' {
 		return errors.New("resource must start with '/'")
 	}
-	_, err := lhttp.PostJSON(retry.Default, http.DefaultClient, i.url+resource, in, out)
+	_, err := lhttp.PostJSON(ctx, retry.Default, i.client, i.url+resource, in, out)
 	return err
 }
 
-func (i *isolateServer) ServerCapabilities() (*isolated.ServerCapabilities, error) {
+func (i *isolateServer) ServerCapabilities(ctx context.Context) (*isolated.ServerCapabilities, error) {
 	out := &isolated.ServerCapabilities{}
-	if err := i.postJSON("/_ah/api/isolateservice/v1/server_details", map[string]string{}, out); err != nil {
+	if err := i.postJSON(ctx, "/_ah/api/isolateservice/v1/server_details", map[string]string{}, out); err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
-func (i *isolateServer) Contains(items []*isolated.DigestItem) (out []*PushState, err error) {
+func (i *isolateServer) Contains(ctx context.Context, items []*isolated.DigestItem) (out []*PushState, err error) {
 	end := tracer.Span(i, "contains", tracer.Args{"number": len(items)})
 	defer func() { end(tracer.Args{"err": err}) }()
 	in := isolated.DigestCollection{Items: items}
 	in.Namespace.Namespace = i.namespace
 	data := &isolated.UrlCollection{}
-	if err = i.postJSON("/_ah/api/isolateservice/v1/preupload", in, data); err != nil {
+	if err = i.postJSON(ctx, "/_ah/api/isolateservice/v1/preupload", in, data); err != nil {
 		return nil, err
 	}
 	out = make([]*PushState, len(items))
@@ -87,18 +115,23 @@ func (i *isolateServer) Contains(items []*isolated.DigestItem) (out []*PushState
 		index := int(e.Index)
 		out[index] = &PushState{
 			status: e,
+			digest: items[index].Digest,
 			size:   items[index].Size,
 		}
 	}
 	return out, nil
 }
 
-func (i *isolateServer) Push(state *PushState, src io.Reader) (err error) {
+func (i *isolateServer) Push(ctx context.Context, state *PushState, src io.Reader) (err error) {
 	// This push operation may be a retry after failed finalization call below,
 	// no need to reupload contents in that case.
 	if !state.uploaded {
+		// Fail fast before consuming src.
+		if err = lhttp.CheckHost(i.url); err != nil {
+			return
+		}
 		// PUT file to uploadURL.
-		if err = i.doPush(state, src); err != nil {
+		if err = i.doPush(ctx, state, src); err != nil {
 			return
 		}
 		state.uploaded = true
@@ -113,7 +146,7 @@ func (i *isolateServer) Push(state *PushState, src io.Reader) (err error) {
 		// the data safely reached Google Storage (GS provides MD5 and CRC32C of
 		// stored files).
 		in := isolated.FinalizeRequest{state.status.UploadTicket}
-		if err = i.postJSON("/_ah/api/isolateservice/v1/finalize_gs_upload", in, nil); err != nil {
+		if err = i.postJSON(ctx, "/_ah/api/isolateservice/v1/finalize_gs_upload", in, nil); err != nil {
 			return
 		}
 	}
@@ -121,11 +154,89 @@ func (i *isolateServer) Push(state *PushState, src io.Reader) (err error) {
 	return
 }
 
-func (i *isolateServer) doPush(state *PushState, src io.Reader) (err error) {
+func (i *isolateServer) Fetch(ctx context.Context, digest isolated.HexDigest, dest io.Writer) (err error) {
+	end := tracer.Span(i, "fetch", tracer.Args{"digest": digest})
+	defer func() { end(tracer.Args{"err": err}) }()
+	in := &isolated.RetrieveRequest{Digest: digest}
+	in.Namespace.Namespace = i.namespace
+	out := &isolated.RetrievedContent{}
+	if err = i.postJSON(ctx, "/_ah/api/isolateservice/v1/retrieve", in, out); err != nil {
+		return
+	}
+	if out.URL == "" {
+		return decompress(dest, bytes.NewReader(out.Content), digest)
+	}
+
+	// Download from GCS. Like for uploads, the URL is signed so the request
+	// must not be authenticated.
+	request, err2 := http.NewRequest("GET", out.URL, nil)
+	if err2 != nil {
+		return err2
+	}
+	resp, err3 := lhttp.Do(ctx, http.DefaultClient, request)
+	if err3 != nil {
+		return err3
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch %s: %s", digest, resp.Status)
+	}
+	// Throttle the compressed stream since it is what goes on the wire.
+	return decompress(dest, throttle.Default.Reader(resp.Body), digest)
+}
+
+// decompress writes the decompressed content of src to dest and verifies it
+// matches digest.
+func decompress(dest io.Writer, src io.Reader, digest isolated.HexDigest) error {
+	d := isolated.GetDecompressor(src)
+	if d == nil {
+		return fmt.Errorf("invalid compressed content for %s", digest)
+	}
+	defer d.Close()
+	h := isolated.GetHash()
+	if _, err := io.Copy(io.MultiWriter(dest, h), d); err != nil {
+		return err
+	}
+	if isolated.Sum(h) != digest {
+		return fmt.Errorf("invalid hash for %s", digest)
+	}
+	return nil
+}
+
+// maxInlineMemory is the maximum size of a store_inline request kept in
+// memory; larger requests are spooled to disk.
+const maxInlineMemory = 1024 * 1024
+
+// newStorageRequest returns an encoded isolated.StorageRequest. content is
+// base64 encoded as it is read.
+func newStorageRequest(ticket string, content io.Reader) (*lhttp.Spool, error) {
+	s := lhttp.NewSpool(maxInlineMemory)
+	t, err := json.Marshal(ticket)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fmt.Fprintf(s, "{\"upload_ticket\":%s,\"content\":\"", t); err == nil {
+		e := base64.NewEncoder(base64.StdEncoding, s)
+		if _, err = io.Copy(e, content); err == nil {
+			if err = e.Close(); err == nil {
+				_, err = io.WriteString(s, "\"}")
+			}
+		}
+	}
+	if err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (i *isolateServer) doPush(ctx context.Context, state *PushState, src io.Reader) (err error) {
 	end := tracer.Span(i, "push", tracer.Args{"size": state.size})
 	defer func() { end(tracer.Args{"err": err}) }()
-	reader, writer := io.Pipe()
-	defer reader.Close()
+	pipeReader, writer := io.Pipe()
+	defer pipeReader.Close()
+	// Throttle the compressed stream since it is what goes on the wire.
+	reader := throttle.Default.Reader(pipeReader)
 	compressor := isolated.GetCompressor(writer)
 	c := make(chan error)
 	go func() {
@@ -145,12 +256,14 @@ func (i *isolateServer) doPush(state *PushState, src io.Reader) (err error) {
 
 	// DB upload.
 	if state.status.GSUploadURL == "" {
-		content, err2 := ioutil.ReadAll(reader)
+		// Spool the request so it can be retried without holding the whole
+		// content in memory.
+		body, err2 := newStorageRequest(state.status.UploadTicket, reader)
 		if err2 != nil {
 			return err2
 		}
-		in := &isolated.StorageRequest{state.status.UploadTicket, content}
-		if err = i.postJSON("/_ah/api/isolateservice/v1/store_inline", in, nil); err != nil {
+		defer body.Close()
+		if _, err = lhttp.PostJSONReader(ctx, retry.Default, i.client, i.url+"/_ah/api/isolateservice/v1/store_inline", body, nil); err != nil {
 			return err
 		}
 		tracer.CounterAdd(i, "bytesUploaded", float64(state.size))
@@ -163,7 +276,9 @@ func (i *isolateServer) doPush(state *PushState, src io.Reader) (err error) {
 		return err5
 	}
 	request.Header.Set("Content-Type", "application/octet-stream")
-	resp, err6 := http.DefaultClient.Do(request)
+	// The upload URL is signed so the request must not be authenticated; it
+	// would leak the credentials to Cloud Storage.
+	resp, err6 := lhttp.Do(ctx, http.DefaultClient, request)
 	if err6 != nil {
 		return err6
 	}
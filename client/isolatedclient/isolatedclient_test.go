@@ -12,6 +12,7 @@ import (
 	"github.com/luci/luci-go/client/isolatedclient/isolatedfake"
 	"github.com/luci/luci-go/common/isolated"
 	"github.com/maruel/ut"
+	"golang.org/x/net/context"
 )
 
 func TestIsolateServerCaps(t *testing.T) {
@@ -19,8 +20,8 @@ func TestIsolateServerCaps(t *testing.T) {
 	server := isolatedfake.New()
 	ts := httptest.NewServer(server)
 	defer ts.Close()
-	client := New(ts.URL, "default-gzip")
-	caps, err := client.ServerCapabilities()
+	client := New(nil, ts.URL, "default-gzip")
+	caps, err := client.ServerCapabilities(context.Background())
 	ut.AssertEqual(t, nil, err)
 	ut.AssertEqual(t, &isolated.ServerCapabilities{"v1"}, caps)
 	ut.AssertEqual(t, nil, server.Error())
@@ -47,14 +48,14 @@ func TestIsolateServer(t *testing.T) {
 	server := isolatedfake.New()
 	ts := httptest.NewServer(server)
 	defer ts.Close()
-	client := New(ts.URL, "default-gzip")
+	client := New(nil, ts.URL, "default-gzip")
 
 	files := makeItems("foo", "bar")
-	states, err := client.Contains(files.digests)
+	states, err := client.Contains(context.Background(), files.digests)
 	ut.AssertEqual(t, nil, err)
 	ut.AssertEqual(t, len(files.digests), len(states))
 	for index, state := range states {
-		err = client.Push(state, bytes.NewBuffer(files.contents[index]))
+		err = client.Push(context.Background(), state, bytes.NewBuffer(files.contents[index]))
 		ut.AssertEqual(t, nil, err)
 	}
 	// foo and bar.
@@ -63,11 +64,16 @@ func TestIsolateServer(t *testing.T) {
 		"62cdb7020ff920e5aa642c3d4066950dd1f01f4d": {0x62, 0x61, 0x72},
 	}
 	ut.AssertEqual(t, expected, server.Contents())
-	states, err = client.Contains(files.digests)
+	states, err = client.Contains(context.Background(), files.digests)
 	ut.AssertEqual(t, nil, err)
 	ut.AssertEqual(t, len(files.digests), len(states))
 	for _, state := range states {
 		ut.AssertEqual(t, (*PushState)(nil), state)
 	}
+	for index, d := range files.digests {
+		buf := &bytes.Buffer{}
+		ut.AssertEqual(t, nil, client.Fetch(context.Background(), d.Digest, buf))
+		ut.AssertEqual(t, files.contents[index], buf.Bytes())
+	}
 	ut.AssertEqual(t, nil, server.Error())
 }
@@ -70,6 +70,7 @@ func New() IsolatedFake {
 	server.handleJSON("/_ah/api/isolateservice/v1/preupload", server.preupload)
 	server.handleJSON("/_ah/api/isolateservice/v1/finalize_gs_upload", server.finalizeGSUpload)
 	server.handleJSON("/_ah/api/isolateservice/v1/store_inline", server.storeInline)
+	server.handleJSON("/_ah/api/isolateservice/v1/retrieve", server.retrieve)
 
 	// Fail on anything else.
 	server.mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
@@ -191,3 +192,27 @@ func (server *isolatedFake) storeInline(body io.Reader) interface{} {
 	server.contents[digest] = raw
 	return map[string]string{"ok": "true"}
 }
+
+func (server *isolatedFake) retrieve(body io.Reader) interface{} {
+	data := &isolated.RetrieveRequest{}
+	if err := json.NewDecoder(body).Decode(data); err != nil {
+		server.Fail(err)
+	}
+
+	server.lock.Lock()
+	raw, ok := server.contents[data.Digest]
+	server.lock.Unlock()
+	if !ok {
+		server.Fail(fmt.Errorf("unknown digest %#v", data.Digest))
+		return map[string]string{}
+	}
+	buf := &bytes.Buffer{}
+	comp := isolated.GetCompressor(buf)
+	if _, err := comp.Write(raw); err != nil {
+		server.Fail(err)
+	}
+	if err := comp.Close(); err != nil {
+		server.Fail(err)
+	}
+	return &isolated.RetrievedContent{Content: buf.Bytes()}
+}
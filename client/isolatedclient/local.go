@@ -0,0 +1,116 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolatedclient
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/luci/luci-go/client/internal/tracer"
+	"github.com/luci/luci-go/common/isolated"
+	"golang.org/x/net/context"
+)
+
+// NewLocal returns an IsolateServer that doesn't talk to any server. It is
+// meant to calculate the exact hashes an archival would produce without
+// uploading anything.
+//
+// If dir is empty, the content is read and discarded; every item is reported
+// as missing and can't be fetched. Otherwise the uncompressed content is
+// stored in dir, one file per item named after its digest, which is the same
+// layout as the disk cache in common/cache. Items already present in dir are
+// reported as present.
+func NewLocal(dir string) IsolateServer {
+	l := &localServer{dir: dir}
+	tracer.NewPID(l, "isolatedclient:local")
+	return l
+}
+
+// Private details.
+
+type localServer struct {
+	dir string
+}
+
+func (l *localServer) ServerCapabilities(ctx context.Context) (*isolated.ServerCapabilities, error) {
+	return &isolated.ServerCapabilities{ServerVersion: "local"}, nil
+}
+
+func (l *localServer) Contains(ctx context.Context, items []*isolated.DigestItem) ([]*PushState, error) {
+	out := make([]*PushState, len(items))
+	for index, item := range items {
+		if l.dir != "" {
+			if _, err := os.Stat(l.itemPath(item.Digest)); err == nil {
+				continue
+			}
+		}
+		out[index] = &PushState{digest: item.Digest, size: item.Size}
+	}
+	return out, nil
+}
+
+func (l *localServer) Push(ctx context.Context, state *PushState, src io.Reader) (err error) {
+	end := tracer.Span(l, "push", tracer.Args{"size": state.size})
+	defer func() { end(tracer.Args{"err": err}) }()
+	if l.dir == "" {
+		_, err = io.Copy(ioutil.Discard, src)
+		return
+	}
+	if err = os.MkdirAll(l.dir, 0700); err != nil {
+		return
+	}
+	// Write to a temporary file first, so a partially written item is never
+	// considered present.
+	f, err := ioutil.TempFile(l.dir, "tmp")
+	if err != nil {
+		return
+	}
+	h := isolated.GetHash()
+	_, err = io.Copy(f, io.TeeReader(src, h))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil && isolated.Sum(h) != state.digest {
+		err = fmt.Errorf("invalid hash for %s", state.digest)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), l.itemPath(state.digest))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return
+	}
+	state.uploaded = true
+	state.finalized = true
+	return
+}
+
+func (l *localServer) Fetch(ctx context.Context, digest isolated.HexDigest, dest io.Writer) (err error) {
+	end := tracer.Span(l, "fetch", tracer.Args{"digest": digest})
+	defer func() { end(tracer.Args{"err": err}) }()
+	if l.dir == "" {
+		return fmt.Errorf("%s is not available locally", digest)
+	}
+	f, err := os.Open(l.itemPath(digest))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h := isolated.GetHash()
+	if _, err = io.Copy(io.MultiWriter(dest, h), f); err != nil {
+		return
+	}
+	if isolated.Sum(h) != digest {
+		err = fmt.Errorf("invalid hash for %s", digest)
+	}
+	return
+}
+
+func (l *localServer) itemPath(digest isolated.HexDigest) string {
+	return filepath.Join(l.dir, string(digest))
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolatedclient
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/ut"
+	"golang.org/x/net/context"
+)
+
+func TestLocalDiscard(t *testing.T) {
+	t.Parallel()
+	client := NewLocal("")
+	caps, err := client.ServerCapabilities(context.Background())
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "local", caps.ServerVersion)
+
+	files := makeItems("foo", "bar")
+	for i := 0; i < 2; i++ {
+		// Nothing is ever kept.
+		states, err := client.Contains(context.Background(), files.digests)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, len(files.digests), len(states))
+		for index, state := range states {
+			ut.AssertEqual(t, nil, client.Push(context.Background(), state, bytes.NewBuffer(files.contents[index])))
+		}
+	}
+}
+
+func TestLocalStore(t *testing.T) {
+	t.Parallel()
+	tmpDir, err := ioutil.TempDir("", "isolatedclient")
+	ut.AssertEqual(t, nil, err)
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Fail()
+		}
+	}()
+	store := filepath.Join(tmpDir, "store")
+	client := NewLocal(store)
+
+	files := makeItems("foo", "bar")
+	states, err := client.Contains(context.Background(), files.digests)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, len(files.digests), len(states))
+	for index, state := range states {
+		ut.AssertEqual(t, nil, client.Push(context.Background(), state, bytes.NewBuffer(files.contents[index])))
+	}
+	for index, d := range files.digests {
+		content, err := ioutil.ReadFile(filepath.Join(store, string(d.Digest)))
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, files.contents[index], content)
+	}
+	states, err = client.Contains(context.Background(), files.digests)
+	ut.AssertEqual(t, nil, err)
+	for _, state := range states {
+		ut.AssertEqual(t, (*PushState)(nil), state)
+	}
+	for index, d := range files.digests {
+		buf := &bytes.Buffer{}
+		ut.AssertEqual(t, nil, client.Fetch(context.Background(), d.Digest, buf))
+		ut.AssertEqual(t, files.contents[index], buf.Bytes())
+	}
+
+	// Corrupted content is rejected and not stored.
+	corrupted := makeItems("baz")
+	states, err = client.Contains(context.Background(), corrupted.digests)
+	ut.AssertEqual(t, nil, err)
+	err = client.Push(context.Background(), states[0], bytes.NewBufferString("bad"))
+	ut.AssertEqual(t, fmt.Errorf("invalid hash for %s", corrupted.digests[0].Digest), err)
+	_, err = os.Stat(filepath.Join(store, string(corrupted.digests[0].Digest)))
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+	entries, err := ioutil.ReadDir(store)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, len(entries))
+}
@@ -0,0 +1,191 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package swarming
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TaskFilter selects the tasks returned by ListTasks. The zero value returns
+// all the tasks.
+type TaskFilter struct {
+	// Name is the exact task name to match, if set.
+	Name string
+	// State is one of the values of TaskFilterStates, if set.
+	State string
+	// Tags are "key:value" tags that must all be present on the tasks.
+	Tags []string
+	// Start and End limit the tasks to the ones created in this range, if set.
+	Start time.Time
+	End   time.Time
+	// Limit is the maximum number of tasks to return; 0 means no limit.
+	Limit int
+}
+
+// TaskFilterStates are the valid values for TaskFilter.State.
+var TaskFilterStates = []string{
+	"all", "pending", "running", "pending_running", "completed",
+	"completed_success", "completed_failure", "expired", "timed_out",
+	"bot_died", "canceled",
+}
+
+// Bot describes a Swarming bot.
+type Bot struct {
+	Dimensions  map[string][]string `json:"dimensions"`
+	ExternalIP  string              `json:"external_ip"`
+	FirstSeenTS Timestamp           `json:"first_seen_ts"`
+	ID          string              `json:"id"`
+	IsBusy      bool                `json:"is_busy"`
+	IsDead      bool                `json:"is_dead"`
+	LastSeenTS  Timestamp           `json:"last_seen_ts"`
+	Quarantined bool                `json:"quarantined"`
+	TaskID      TaskID              `json:"task_id"`
+	TaskName    string              `json:"task_name"`
+	Version     string              `json:"version"`
+}
+
+// ListTasks returns the tasks matching filter, most recent first.
+func (s *Swarming) ListTasks(ctx context.Context, filter *TaskFilter) ([]*TaskResult, error) {
+	params := url.Values{}
+	if filter.Name != "" {
+		params.Set("name", filter.Name)
+	}
+	if filter.State != "" {
+		if !isValidFilterState(filter.State) {
+			return nil, fmt.Errorf("invalid task state filter %q", filter.State)
+		}
+		params.Set("state", filter.State)
+	}
+	for _, t := range filter.Tags {
+		params.Add("tag", t)
+	}
+	if !filter.Start.IsZero() {
+		params.Set("start", filter.Start.UTC().Format(TimestampFormat))
+	}
+	if !filter.End.IsZero() {
+		params.Set("end", filter.End.UTC().Format(TimestampFormat))
+	}
+	var out []*TaskResult
+	err := s.List(ctx, "/swarming/api/v1/client/tasks", params, filter.Limit, func(items json.RawMessage) (int, error) {
+		var page []*TaskResult
+		if err := json.Unmarshal(items, &page); err != nil {
+			return 0, err
+		}
+		out = append(out, page...)
+		return len(page), nil
+	})
+	if filter.Limit > 0 && len(out) > filter.Limit {
+		out = out[:filter.Limit]
+	}
+	return out, err
+}
+
+// ListBots returns the bots that have all the dimensions specified, sorted by
+// ID. limit is the maximum number of bots to return; 0 means no limit.
+func (s *Swarming) ListBots(ctx context.Context, dimensions map[string]string, limit int) ([]*Bot, error) {
+	params := url.Values{}
+	keys := make([]string, 0, len(dimensions))
+	for k := range dimensions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		params.Add("dimensions", k+":"+dimensions[k])
+	}
+	var out []*Bot
+	err := s.List(ctx, "/swarming/api/v1/client/bots", params, limit, func(items json.RawMessage) (int, error) {
+		var page []*Bot
+		if err := json.Unmarshal(items, &page); err != nil {
+			return 0, err
+		}
+		out = append(out, page...)
+		return len(page), nil
+	})
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out, err
+}
+
+// GetBot returns the bot id.
+func (s *Swarming) GetBot(ctx context.Context, id string) (*Bot, error) {
+	out := &Bot{}
+	err := s.getJSON(ctx, "/swarming/api/v1/client/bot/"+pathEscape(id), out)
+	return out, err
+}
+
+// List fetches a paginated list resource, following the cursor until all the
+// items or at least limit items were fetched; limit 0 means no limit.
+//
+// page is called with the JSON encoded items of each page and must return the
+// number of items it decoded.
+func (s *Swarming) List(ctx context.Context, resource string, params url.Values, limit int, page func(items json.RawMessage) (int, error)) error {
+	if limit < 0 {
+		return errors.New("limit must be non-negative")
+	}
+	p := url.Values{}
+	for k, v := range params {
+		p[k] = v
+	}
+	count := 0
+	for {
+		pageSize := maxPageSize
+		if limit > 0 && limit-count < pageSize {
+			pageSize = limit - count
+		}
+		p.Set("limit", strconv.Itoa(pageSize))
+		data := &listPage{}
+		if err := s.getJSON(ctx, resource+"?"+p.Encode(), data); err != nil {
+			return err
+		}
+		if len(data.Items) != 0 {
+			n, err := page(data.Items)
+			if err != nil {
+				return fmt.Errorf("bad response from %s: %s", resource, err)
+			}
+			count += n
+		}
+		if data.Cursor == "" || (limit > 0 && count >= limit) {
+			return nil
+		}
+		p.Set("cursor", data.Cursor)
+	}
+}
+
+// Private details.
+
+// maxPageSize is the number of items to request per page.
+const maxPageSize = 100
+
+// listPage is a page returned by a list resource.
+type listPage struct {
+	Cursor string          `json:"cursor"`
+	Items  json.RawMessage `json:"items"`
+}
+
+func isValidFilterState(s string) bool {
+	for _, v := range TaskFilterStates {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// pathEscape escapes s so it can be used as a single path segment in a URL.
+func pathEscape(s string) string {
+	// url.QueryEscape also escapes '/' but encodes spaces as '+', which is
+	// only valid in a query.
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package swarming
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maruel/ut"
+	"golang.org/x/net/context"
+)
+
+// pagedServer serves count items per resource, limit items at a time.
+func pagedServer(t *testing.T, count int, check func(r *http.Request)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		check(r)
+		start, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		ut.ExpectEqual(t, nil, err)
+		items := []map[string]string{}
+		for i := start; i < start+limit && i < count; i++ {
+			items = append(items, map[string]string{"id": strconv.Itoa(i)})
+		}
+		out := map[string]interface{}{"items": items}
+		if start+limit < count {
+			out["cursor"] = strconv.Itoa(start + limit)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		ut.ExpectEqual(t, nil, json.NewEncoder(w).Encode(out))
+	}))
+}
+
+func TestListTasks(t *testing.T) {
+	t.Parallel()
+	ts := pagedServer(t, 250, func(r *http.Request) {
+		ut.ExpectEqual(t, "/swarming/api/v1/client/tasks", r.URL.Path)
+		q := r.URL.Query()
+		ut.ExpectEqual(t, []string{"a:b", "c:d"}, q["tag"])
+		ut.ExpectEqual(t, "pending", q.Get("state"))
+		ut.ExpectEqual(t, "2015-01-02 03:04:05", q.Get("start"))
+	})
+	defer ts.Close()
+
+	s, err := New(nil, ts.URL)
+	ut.AssertEqual(t, nil, err)
+	f := &TaskFilter{
+		State: "pending",
+		Tags:  []string{"a:b", "c:d"},
+		Start: time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	tasks, err := s.ListTasks(context.Background(), f)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 250, len(tasks))
+	ut.AssertEqual(t, TaskID("249"), tasks[249].ID)
+
+	f.Limit = 150
+	tasks, err = s.ListTasks(context.Background(), f)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 150, len(tasks))
+
+	f.State = "foo"
+	_, err = s.ListTasks(context.Background(), f)
+	ut.AssertEqual(t, fmt.Errorf("invalid task state filter %q", "foo"), err)
+}
+
+func TestListBots(t *testing.T) {
+	t.Parallel()
+	ts := pagedServer(t, 5, func(r *http.Request) {
+		ut.ExpectEqual(t, "/swarming/api/v1/client/bots", r.URL.Path)
+		ut.ExpectEqual(t, []string{"os:Linux", "pool:default"}, r.URL.Query()["dimensions"])
+	})
+	defer ts.Close()
+
+	s, err := New(nil, ts.URL)
+	ut.AssertEqual(t, nil, err)
+	bots, err := s.ListBots(context.Background(), map[string]string{"pool": "default", "os": "Linux"}, 3)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 3, len(bots))
+	ut.AssertEqual(t, "2", bots[2].ID)
+}
+
+func TestGetBot(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The ID is a single path segment.
+		ut.ExpectEqual(t, "/swarming/api/v1/client/bot/a%2Fbot%201", r.RequestURI)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		ut.ExpectEqual(t, nil, json.NewEncoder(w).Encode(&Bot{ID: "a/bot 1", Dimensions: map[string][]string{"os": {"Linux"}}}))
+	}))
+	defer ts.Close()
+
+	s, err := New(nil, ts.URL)
+	ut.AssertEqual(t, nil, err)
+	bot, err := s.GetBot(context.Background(), "a/bot 1")
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "a/bot 1", bot.ID)
+	ut.AssertEqual(t, []string{"Linux"}, bot.Dimensions["os"])
+}
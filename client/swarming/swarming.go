@@ -12,6 +12,7 @@ import (
 
 	"github.com/luci/luci-go/client/internal/lhttp"
 	"github.com/luci/luci-go/client/internal/retry"
+	"golang.org/x/net/context"
 )
 
 // TaskID is a unique reference to a Swarming task.
@@ -19,30 +20,132 @@ type TaskID string
 
 // Swarming defines a Swarming client.
 type Swarming struct {
-	host string
+	host   string
+	client *http.Client
 }
 
-func (s *Swarming) getJSON(resource string, v interface{}) error {
+func (s *Swarming) getJSON(ctx context.Context, resource string, v interface{}) error {
 	if len(resource) == 0 || resource[0] != '/' {
 		return errors.New("resource must start with '/'")
 	}
-	_, err := lhttp.GetJSON(retry.Default, http.DefaultClient, s.host+resource, v)
+	_, err := lhttp.GetJSON(ctx, retry.Default, s.client, s.host+resource, v)
 	return err
 }
 
-// NewSwarming returns a new Swarming client.
-func New(host string) (*Swarming, error) {
+func (s *Swarming) postJSON(ctx context.Context, config *retry.Config, resource string, in, out interface{}) error {
+	if len(resource) == 0 || resource[0] != '/' {
+		return errors.New("resource must start with '/'")
+	}
+	_, err := lhttp.PostJSON(ctx, config, s.client, s.host+resource, in, out)
+	return err
+}
+
+// noRetry is used for the requests that are not idempotent. Retrying them
+// after a failure that happened once the server processed the request, like
+// a timeout, would do the operation twice.
+var noRetry = &retry.Config{MaxTries: 1}
+
+// New returns a new Swarming client.
+//
+// client must carry credentials allowed to trigger and query tasks on host.
+// Anonymous access with http.DefaultClient is used if nil.
+func New(client *http.Client, host string) (*Swarming, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
 	host = strings.TrimRight(host, "/")
-	return &Swarming{host}, nil
+	return &Swarming{host, client}, nil
 }
 
 // FetchRequest returns the TaskRequest.
-func (s *Swarming) FetchRequest(id TaskID) (*TaskRequest, error) {
+func (s *Swarming) FetchRequest(ctx context.Context, id TaskID) (*TaskRequest, error) {
 	out := &TaskRequest{}
-	err := s.getJSON("/swarming/api/v1/client/task/"+string(id)+"/request", out)
+	err := s.getJSON(ctx, "/swarming/api/v1/client/task/"+string(id)+"/request", out)
+	return out, err
+}
+
+// FetchResult returns the current TaskResult.
+func (s *Swarming) FetchResult(ctx context.Context, id TaskID) (*TaskResult, error) {
+	out := &TaskResult{}
+	err := s.getJSON(ctx, "/swarming/api/v1/client/task/"+string(id), out)
 	return out, err
 }
 
+// FetchOutput returns the output of the task so far, which may be partial if
+// the task is still running.
+func (s *Swarming) FetchOutput(ctx context.Context, id TaskID) (string, error) {
+	out := &TaskOutput{}
+	if err := s.getJSON(ctx, "/swarming/api/v1/client/task/"+string(id)+"/output/all", out); err != nil {
+		return "", err
+	}
+	return strings.Join(out.Outputs, ""), nil
+}
+
+// Trigger submits a new task and returns its ID.
+//
+// The request is not retried on failure, since the task may have been created
+// anyway.
+func (s *Swarming) Trigger(ctx context.Context, r *TaskRequest) (TaskID, error) {
+	if r.Name == "" {
+		return "", errors.New("task name is required")
+	}
+	if len(r.Properties.Dimensions) == 0 {
+		return "", errors.New("at least one dimension is required")
+	}
+	if len(r.Properties.Commands) == 0 && r.Properties.InputsRef == nil {
+		return "", errors.New("a command or an isolated input is required")
+	}
+	out := &TriggerResult{}
+	if err := s.postJSON(ctx, noRetry, "/swarming/api/v1/client/request", r, out); err != nil {
+		return "", err
+	}
+	if out.TaskID == "" {
+		return "", errors.New("server didn't return a task id")
+	}
+	return out.TaskID, nil
+}
+
+// Cancel cancels a task. It returns false if the task had already completed
+// and couldn't be canceled.
+func (s *Swarming) Cancel(ctx context.Context, id TaskID) (bool, error) {
+	out := &CancelResult{}
+	if err := s.postJSON(ctx, retry.Default, "/swarming/api/v1/client/task/"+string(id)+"/cancel", struct{}{}, out); err != nil {
+		return false, err
+	}
+	return out.Ok, nil
+}
+
+// Retry triggers a new task with the same request as the task id and returns
+// its ID. The new task has the tags specified instead of the original ones,
+// plus "retry_of:<id>". Its priority is set to priority unless it is negative,
+// in which case the original priority is kept.
+func (s *Swarming) Retry(ctx context.Context, id TaskID, tags []string, priority int) (TaskID, error) {
+	r, err := s.FetchRequest(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	// The server only reports the expiration as a timestamp, while the new
+	// request must specify it as a duration. The timestamps are set by the
+	// server.
+	if r.ExpirationSecs == 0 && r.CreatedTS != nil && r.ExpirationTS != nil {
+		r.ExpirationSecs = int(r.ExpirationTS.Sub(r.CreatedTS.Time) / time.Second)
+	}
+	r.CreatedTS = nil
+	r.ExpirationTS = nil
+	r.Tags = append(append([]string{}, tags...), "retry_of:"+string(id))
+	if priority >= 0 {
+		r.Priority = priority
+	}
+	return s.Trigger(ctx, r)
+}
+
+// FilesRef is a reference to an isolated tree on an Isolate server.
+type FilesRef struct {
+	Isolated       string `json:"isolated"`
+	IsolatedServer string `json:"isolatedserver"`
+	Namespace      string `json:"namespace"`
+}
+
 // TaskRequestProperties describes the idempotent properties of a task.
 type TaskRequestProperties struct {
 	Commands             [][]string        `json:"commands"`
@@ -50,50 +153,107 @@ type TaskRequestProperties struct {
 	Dimensions           map[string]string `json:"dimensions"`
 	Env                  map[string]string `json:"env"`
 	ExecutionTimeoutSecs int               `json:"execution_timeout_secs"`
+	ExtraArgs            []string          `json:"extra_args,omitempty"`
+	GracePeriodSecs      int               `json:"grace_period_secs"`
 	Idempotent           bool              `json:"idempotent"`
+	InputsRef            *FilesRef         `json:"inputs_ref,omitempty"`
 	IoTimeoutSecs        int               `json:"io_timeout_secs"`
 }
 
 // TaskRequest describes a complete request.
 type TaskRequest struct {
-	//"created_ts": "2014-10-24 00:00:00",
-	//"expiration_ts": "2014-10-24 00:00:00",
+	CreatedTS      *Timestamp            `json:"created_ts,omitempty"`
+	ExpirationTS   *Timestamp            `json:"expiration_ts,omitempty"`
+	ExpirationSecs int                   `json:"scheduling_expiration_secs,omitempty"`
 	Name           string                `json:"name"`
 	Priority       int                   `json:"priority"`
 	Properties     TaskRequestProperties `json:"properties"`
-	PropertiesHash string                `json:"properties_hash"`
+	PropertiesHash string                `json:"properties_hash,omitempty"`
 	Tags           []string              `json:"tags"`
 	User           string                `json:"user"`
 }
 
+// TriggerResult is the server's reply to a new task request.
+type TriggerResult struct {
+	Request TaskRequest `json:"request"`
+	TaskID  TaskID      `json:"task_id"`
+}
+
+// CancelResult is the server's reply to a cancelation request.
+type CancelResult struct {
+	Ok         bool `json:"ok"`
+	WasRunning bool `json:"was_running"`
+}
+
 // TaskResult describes the results of a task.
 type TaskResult struct {
-	TaskRequest TaskRequest `json:"request"`
-	//"abandoned_ts": "2014-10-24 00:00:00",
-	BotID      string `json:"bot_id"`
-	BotVersion string `json:"bot_version"`
-	//"completed_ts": "2014-10-24 00:00:00",
-	//"created_ts": "2014-10-24 00:00:00",
-	DedupedFrom     string    `json:"deduped_from"`
-	Durations       []float64 `json:"durations"`
-	ExitCodes       []int     `json:"exit_codes"`
-	Failure         bool      `json:"failure"`
-	ID              TaskID    `json:"id"`
-	InternalFailure bool      `json:"internal_failure"`
-	//"modified_ts": "2014-10-24 00:00:00",
-	Name           string   `json:"name"`
-	PropertiesHash string   `json:"properties_hash"`
-	ServerVersions []string `json:"server_versions"`
-	// "started_ts": "2014-10-24 00:00:00",
-	State     int    `json:"state"`
-	TryNumber int    `json:"try_number"`
-	User      string `json:"user"`
-}
-
-// Duration returns the total duration of a task.
+	TaskRequest     TaskRequest `json:"request"`
+	AbandonedTS     Timestamp   `json:"abandoned_ts"`
+	BotID           string      `json:"bot_id"`
+	BotVersion      string      `json:"bot_version"`
+	CompletedTS     Timestamp   `json:"completed_ts"`
+	CreatedTS       Timestamp   `json:"created_ts"`
+	DedupedFrom     string      `json:"deduped_from"`
+	Durations       []float64   `json:"durations"`
+	ExitCodes       []int       `json:"exit_codes"`
+	Failure         bool        `json:"failure"`
+	ID              TaskID      `json:"id"`
+	InternalFailure bool        `json:"internal_failure"`
+	ModifiedTS      Timestamp   `json:"modified_ts"`
+	Name            string      `json:"name"`
+	OutputsRef      *FilesRef   `json:"outputs_ref,omitempty"`
+	PropertiesHash  string      `json:"properties_hash"`
+	ServerVersions  []string    `json:"server_versions"`
+	StartedTS       Timestamp   `json:"started_ts"`
+	State           TaskState   `json:"state"`
+	TryNumber       int         `json:"try_number"`
+	User            string      `json:"user"`
+}
+
+// IsFinal returns true if the task is neither pending nor running.
+func (s *TaskResult) IsFinal() bool {
+	return s.State.IsFinal()
+}
+
+// PendingDuration returns the time the task waited for a bot. It is 0 if the
+// task is still pending.
+func (s *TaskResult) PendingDuration() time.Duration {
+	end := s.StartedTS
+	if end.IsZero() {
+		// Expired or canceled before a bot picked it up.
+		end = s.AbandonedTS
+	}
+	if end.IsZero() || s.CreatedTS.IsZero() {
+		return 0
+	}
+	return end.Sub(s.CreatedTS.Time)
+}
+
+// RunDuration returns the wall clock time the task ran on the bot, including
+// the bot overhead, as opposed to Duration(). It is 0 if the task is not done
+// running.
+func (s *TaskResult) RunDuration() time.Duration {
+	end := s.CompletedTS
+	if end.IsZero() {
+		// Timed out, bot died or canceled while running.
+		end = s.AbandonedTS
+	}
+	if end.IsZero() || s.StartedTS.IsZero() {
+		return 0
+	}
+	return end.Sub(s.StartedTS.Time)
+}
+
+// Duration returns the total duration of the commands of a task, as measured
+// by the bot.
 func (s *TaskResult) Duration() (out time.Duration) {
 	for _, d := range s.Durations {
-		out += time.Duration(d) * time.Second
+		out += time.Duration(d * float64(time.Second))
 	}
 	return
 }
+
+// TaskOutput is the output of a task, one entry per command.
+type TaskOutput struct {
+	Outputs []string `json:"outputs"`
+}
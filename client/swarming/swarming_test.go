@@ -5,14 +5,111 @@
 package swarming
 
 import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/maruel/ut"
+	"golang.org/x/net/context"
 )
 
 func TestNew(t *testing.T) {
 	t.Parallel()
 	// TODO(maruel): Make a fake.
-	_, err := New("https://localhost:1")
+	_, err := New(nil, "https://localhost:1")
 	ut.AssertEqual(t, nil, err)
 }
+
+func TestTrigger(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ut.ExpectEqual(t, "POST", r.Method)
+		ut.ExpectEqual(t, "/swarming/api/v1/client/request", r.URL.Path)
+		raw := map[string]json.RawMessage{}
+		ut.ExpectEqual(t, nil, json.NewDecoder(r.Body).Decode(&raw))
+		// The timestamps are set by the server.
+		_, ok := raw["created_ts"]
+		ut.ExpectEqual(t, false, ok)
+		_, ok = raw["expiration_ts"]
+		ut.ExpectEqual(t, false, ok)
+		b, err := json.Marshal(raw)
+		ut.ExpectEqual(t, nil, err)
+		in := &TaskRequest{}
+		ut.ExpectEqual(t, nil, json.Unmarshal(b, in))
+		ut.ExpectEqual(t, "hi", in.Name)
+		ut.ExpectEqual(t, &FilesRef{"deadbeef", "https://isolate", "default-gzip"}, in.Properties.InputsRef)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		ut.ExpectEqual(t, nil, json.NewEncoder(w).Encode(&TriggerResult{Request: *in, TaskID: "123"}))
+	}))
+	defer ts.Close()
+
+	s, err := New(nil, ts.URL)
+	ut.AssertEqual(t, nil, err)
+	r := &TaskRequest{
+		Name:     "hi",
+		Priority: 100,
+		Properties: TaskRequestProperties{
+			Dimensions: map[string]string{"os": "Linux"},
+			InputsRef:  &FilesRef{"deadbeef", "https://isolate", "default-gzip"},
+		},
+	}
+	id, err := s.Trigger(context.Background(), r)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, TaskID("123"), id)
+}
+
+func TestTriggerInvalid(t *testing.T) {
+	t.Parallel()
+	s, err := New(nil, "https://localhost:1")
+	ut.AssertEqual(t, nil, err)
+	_, err = s.Trigger(context.Background(), &TaskRequest{})
+	ut.AssertEqual(t, errors.New("task name is required"), err)
+	r := &TaskRequest{Name: "hi"}
+	_, err = s.Trigger(context.Background(), r)
+	ut.AssertEqual(t, errors.New("at least one dimension is required"), err)
+	r.Properties.Dimensions = map[string]string{"os": "Linux"}
+	_, err = s.Trigger(context.Background(), r)
+	ut.AssertEqual(t, errors.New("a command or an isolated input is required"), err)
+}
+
+func TestFetchResult(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		switch r.URL.Path {
+		case "/swarming/api/v1/client/task/123":
+			ut.ExpectEqual(t, nil, json.NewEncoder(w).Encode(&TaskResult{ID: "123", State: Completed, ExitCodes: []int{0}}))
+		case "/swarming/api/v1/client/task/123/output/all":
+			ut.ExpectEqual(t, nil, json.NewEncoder(w).Encode(&TaskOutput{[]string{"foo\n", "bar\n"}}))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	s, err := New(nil, ts.URL)
+	ut.AssertEqual(t, nil, err)
+	r, err := s.FetchResult(context.Background(), "123")
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, TaskID("123"), r.ID)
+	ut.AssertEqual(t, []int{0}, r.ExitCodes)
+	ut.AssertEqual(t, true, r.IsFinal())
+	out, err := s.FetchOutput(context.Background(), "123")
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "foo\nbar\n", out)
+}
+
+func TestTaskResult(t *testing.T) {
+	t.Parallel()
+	r := &TaskResult{State: Pending}
+	ut.AssertEqual(t, false, r.IsFinal())
+	r.State = Running
+	ut.AssertEqual(t, false, r.IsFinal())
+	r.State = Expired
+	ut.AssertEqual(t, true, r.IsFinal())
+	r.Durations = []float64{1.5, 0.25}
+	ut.AssertEqual(t, 1750*time.Millisecond, r.Duration())
+}
@@ -0,0 +1,539 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package swarmingfake implements an in-process fake Swarming server.
+package swarmingfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luci/luci-go/client/swarming"
+)
+
+type failure interface {
+	Fail(err error)
+}
+
+// handlerJSON converts a jsonAPI http handler to a proper http.Handler.
+func handlerJSON(f failure, method string, handler jsonAPI) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType := "application/json; charset=utf-8"
+		if r.Method != method {
+			f.Fail(fmt.Errorf("unexpected method %s for %s", r.Method, r.URL.Path))
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if method == "POST" && r.Header.Get("Content-Type") != contentType {
+			f.Fail(fmt.Errorf("invalid content type: %s", r.Header.Get("Content-Type")))
+			return
+		}
+		defer r.Body.Close()
+		out, status := handler(r)
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			f.Fail(err)
+		}
+	})
+}
+
+type jsonAPI func(r *http.Request) (interface{}, int)
+
+// Options configures the fake server and its simulated bots.
+type Options struct {
+	// Transitions are the states a task goes through after being triggered.
+	// The task moves to the next state each time its result is fetched. The last
+	// state must be final. Defaults to Pending, Running, Completed.
+	Transitions []swarming.TaskState
+	// Bots are the bots connected to the server. A task whose dimensions do
+	// not match any bot expires instead of running. If empty, a single bot
+	// "bot1" that matches any dimensions is used.
+	Bots []*swarming.Bot
+	// Run simulates running a task on a bot and returns its exit code and
+	// output. Defaults to exit code 0 and no output.
+	Run func(r *swarming.TaskRequest) (exitCode int, output string)
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// SwarmingFake is a fake Swarming server.
+type SwarmingFake interface {
+	http.Handler
+	// Tasks returns a copy of all the tasks, in the order they were triggered.
+	Tasks() []*swarming.TaskResult
+	// InjectError makes the next count requests whose path starts with prefix
+	// fail with the HTTP status code.
+	InjectError(prefix string, status, count int)
+	// Error returns the first protocol error caused by the client, if any.
+	Error() error
+}
+
+// New returns a fake in-process Swarming server.
+//
+// Use with httptest.NewServer().
+func New(opts Options) SwarmingFake {
+	if len(opts.Transitions) == 0 {
+		opts.Transitions = []swarming.TaskState{swarming.Pending, swarming.Running, swarming.Completed}
+	}
+	if len(opts.Bots) == 0 {
+		opts.Bots = []*swarming.Bot{{ID: "bot1"}}
+	}
+	if opts.Run == nil {
+		opts.Run = func(*swarming.TaskRequest) (int, string) { return 0, "" }
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	server := &swarmingFake{
+		mux:  http.NewServeMux(),
+		opts: opts,
+	}
+
+	server.handleJSON("/swarming/api/v1/client/request", "POST", server.trigger)
+	taskHandler := handlerJSON(server, "GET", server.task)
+	cancelHandler := handlerJSON(server, "POST", server.cancel)
+	server.mux.HandleFunc("/swarming/api/v1/client/task/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/cancel") {
+			cancelHandler.ServeHTTP(w, r)
+		} else {
+			taskHandler.ServeHTTP(w, r)
+		}
+	})
+	server.handleJSON("/swarming/api/v1/client/tasks", "GET", server.listTasks)
+	server.handleJSON("/swarming/api/v1/client/bots", "GET", server.listBots)
+	server.handleJSON("/swarming/api/v1/client/bot/", "GET", server.bot)
+
+	// Fail on anything else.
+	server.mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		server.Fail(fmt.Errorf("unknown endpoint %s", req.URL))
+		w.WriteHeader(http.StatusNotFound)
+	})
+	return server
+}
+
+// Private details.
+
+type task struct {
+	result swarming.TaskResult
+	step   int // Index in Options.Transitions.
+	output string
+}
+
+type injectedError struct {
+	prefix string
+	status int
+	count  int
+}
+
+type swarmingFake struct {
+	mux    *http.ServeMux
+	opts   Options
+	lock   sync.Mutex
+	err    error
+	tasks  []*task
+	errors []*injectedError
+}
+
+func (server *swarmingFake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if status := server.injected(r.URL.Path); status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+	server.mux.ServeHTTP(w, r)
+}
+
+func (server *swarmingFake) Tasks() []*swarming.TaskResult {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	out := make([]*swarming.TaskResult, len(server.tasks))
+	for i, t := range server.tasks {
+		r := t.result
+		out[i] = &r
+	}
+	return out
+}
+
+func (server *swarmingFake) InjectError(prefix string, status, count int) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.errors = append(server.errors, &injectedError{prefix, status, count})
+}
+
+func (server *swarmingFake) Fail(err error) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.err == nil {
+		server.err = err
+	}
+}
+
+func (server *swarmingFake) Error() error {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.err
+}
+
+func (server *swarmingFake) handleJSON(path, method string, handler jsonAPI) {
+	server.mux.Handle(path, handlerJSON(server, method, handler))
+}
+
+// injected returns the injected HTTP status to reply for path, if any.
+func (server *swarmingFake) injected(path string) int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	for i, e := range server.errors {
+		if strings.HasPrefix(path, e.prefix) {
+			if e.count--; e.count <= 0 {
+				server.errors = append(server.errors[:i], server.errors[i+1:]...)
+			}
+			return e.status
+		}
+	}
+	return 0
+}
+
+func errorReply(status int, format string, a ...interface{}) (interface{}, int) {
+	return map[string]string{"error": fmt.Sprintf(format, a...)}, status
+}
+
+func (server *swarmingFake) trigger(r *http.Request) (interface{}, int) {
+	req := &swarming.TaskRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		server.Fail(err)
+		return errorReply(http.StatusBadRequest, "%s", err)
+	}
+	if req.Name == "" || len(req.Properties.Dimensions) == 0 || req.CreatedTS != nil || req.ExpirationTS != nil {
+		server.Fail(fmt.Errorf("invalid request %#v", req))
+		return errorReply(http.StatusBadRequest, "invalid request")
+	}
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	now := server.opts.Now()
+	req.CreatedTS = &swarming.Timestamp{Time: now}
+	req.ExpirationTS = &swarming.Timestamp{Time: now.Add(time.Duration(req.ExpirationSecs) * time.Second)}
+	t := &task{
+		result: swarming.TaskResult{
+			TaskRequest: *req,
+			CreatedTS:   swarming.Timestamp{Time: now},
+			ID:          swarming.TaskID(strconv.Itoa(len(server.tasks) + 1)),
+			ModifiedTS:  swarming.Timestamp{Time: now},
+			Name:        req.Name,
+			State:       server.opts.Transitions[0],
+			TryNumber:   1,
+			User:        req.User,
+		},
+	}
+	server.tasks = append(server.tasks, t)
+	server.apply(t, now)
+	return &swarming.TriggerResult{Request: *req, TaskID: t.result.ID}, http.StatusOK
+}
+
+// apply updates the task for its current state. Must be called with lock held.
+func (server *swarmingFake) apply(t *task, now time.Time) {
+	r := &t.result
+	r.ModifiedTS = swarming.Timestamp{Time: now}
+	if r.State == swarming.Pending {
+		return
+	}
+	if r.BotID == "" {
+		if r.State == swarming.Expired || r.State == swarming.Canceled {
+			// Never ran.
+			r.AbandonedTS = swarming.Timestamp{Time: now}
+			return
+		}
+		bot := server.matchBot(r.TaskRequest.Properties.Dimensions)
+		if bot == nil {
+			// No bot can run it.
+			r.State = swarming.Expired
+			r.AbandonedTS = swarming.Timestamp{Time: now}
+			t.step = len(server.opts.Transitions) - 1
+			return
+		}
+		// Start running it.
+		r.BotID = bot.ID
+		r.StartedTS = swarming.Timestamp{Time: now}
+		exitCode, output := server.opts.Run(&r.TaskRequest)
+		r.ExitCodes = []int{exitCode}
+		t.output = output
+	}
+	switch r.State {
+	case swarming.Completed:
+		r.CompletedTS = swarming.Timestamp{Time: now}
+		r.Durations = []float64{now.Sub(r.StartedTS.Time).Seconds()}
+		r.Failure = r.ExitCodes[0] != 0
+	case swarming.Running:
+	default:
+		// Timed out, bot died or canceled while running.
+		r.AbandonedTS = swarming.Timestamp{Time: now}
+		r.ExitCodes = nil
+		r.InternalFailure = r.State == swarming.BotDied
+	}
+}
+
+// matchBot returns the first bot that has all the dimensions. Must be called
+// with lock held.
+func (server *swarmingFake) matchBot(dimensions map[string]string) *swarming.Bot {
+	for _, b := range server.opts.Bots {
+		if b.Dimensions == nil || hasDimensions(b, dimensions) {
+			return b
+		}
+	}
+	return nil
+}
+
+func hasDimensions(b *swarming.Bot, dimensions map[string]string) bool {
+	for k, v := range dimensions {
+		found := false
+		for _, value := range b.Dimensions[k] {
+			if value == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// visibleOutput returns the output visible for the task in its current state. A
+// running task only has its first line available.
+func (t *task) visibleOutput() string {
+	switch t.result.State {
+	case swarming.Pending:
+		return ""
+	case swarming.Running:
+		if i := strings.Index(t.output, "\n"); i != -1 {
+			return t.output[:i+1]
+		}
+		return ""
+	default:
+		return t.output
+	}
+}
+
+// task serves /task/<id>, /task/<id>/request and /task/<id>/output/all.
+func (server *swarmingFake) task(r *http.Request) (interface{}, int) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/swarming/api/v1/client/task/"), "/", 2)
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	t := server.getTask(parts[0])
+	if t == nil {
+		return errorReply(http.StatusNotFound, "task %s not found", parts[0])
+	}
+	if len(parts) == 1 {
+		// Fetching the result makes the simulated bot progress.
+		if t.step < len(server.opts.Transitions)-1 && !t.result.State.IsFinal() {
+			t.step++
+			t.result.State = server.opts.Transitions[t.step]
+			server.apply(t, server.opts.Now())
+		}
+		return &t.result, http.StatusOK
+	}
+	switch parts[1] {
+	case "request":
+		// Like the real server, only the expiration timestamp is returned.
+		req := t.result.TaskRequest
+		req.ExpirationSecs = 0
+		return &req, http.StatusOK
+	case "output/all":
+		return &swarming.TaskOutput{Outputs: []string{t.visibleOutput()}}, http.StatusOK
+	default:
+		server.Fail(fmt.Errorf("unknown endpoint %s", r.URL))
+		return errorReply(http.StatusNotFound, "unknown endpoint")
+	}
+}
+
+// cancel serves /task/<id>/cancel.
+func (server *swarmingFake) cancel(r *http.Request) (interface{}, int) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/swarming/api/v1/client/task/"), "/cancel")
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	t := server.getTask(id)
+	if t == nil {
+		return errorReply(http.StatusNotFound, "task %s not found", id)
+	}
+	if t.result.State.IsFinal() {
+		return &swarming.CancelResult{}, http.StatusOK
+	}
+	wasRunning := t.result.State == swarming.Running
+	t.result.State = swarming.Canceled
+	t.step = len(server.opts.Transitions) - 1
+	server.apply(t, server.opts.Now())
+	return &swarming.CancelResult{Ok: true, WasRunning: wasRunning}, http.StatusOK
+}
+
+// getTask returns the task id. Must be called with lock held.
+func (server *swarmingFake) getTask(id string) *task {
+	i, err := strconv.Atoi(id)
+	if err != nil || i < 1 || i > len(server.tasks) {
+		return nil
+	}
+	return server.tasks[i-1]
+}
+
+// page returns the items of a list request as a page, with the cursor being
+// the offset of the next page.
+func page(q url.Values, items []interface{}) (interface{}, int) {
+	start := 0
+	if c := q.Get("cursor"); c != "" {
+		var err error
+		if start, err = strconv.Atoi(c); err != nil || start < 0 {
+			return errorReply(http.StatusBadRequest, "invalid cursor")
+		}
+	}
+	limit := 100
+	if l := q.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return errorReply(http.StatusBadRequest, "invalid limit")
+		}
+	}
+	out := map[string]interface{}{"items": []interface{}{}}
+	if start < len(items) {
+		end := start + limit
+		if end < len(items) {
+			out["cursor"] = strconv.Itoa(end)
+		} else {
+			end = len(items)
+		}
+		out["items"] = items[start:end]
+	}
+	return out, http.StatusOK
+}
+
+func matchState(filter string, r *swarming.TaskResult) bool {
+	switch filter {
+	case "", "all":
+		return true
+	case "pending":
+		return r.State == swarming.Pending
+	case "running":
+		return r.State == swarming.Running
+	case "pending_running":
+		return !r.State.IsFinal()
+	case "completed":
+		return r.State == swarming.Completed
+	case "completed_success":
+		return r.State == swarming.Completed && !r.Failure
+	case "completed_failure":
+		return r.State == swarming.Completed && r.Failure
+	case "expired":
+		return r.State == swarming.Expired
+	case "timed_out":
+		return r.State == swarming.TimedOut
+	case "bot_died":
+		return r.State == swarming.BotDied
+	case "canceled":
+		return r.State == swarming.Canceled
+	}
+	return false
+}
+
+func hasTags(r *swarming.TaskResult, tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range r.TaskRequest.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (server *swarmingFake) listTasks(r *http.Request) (interface{}, int) {
+	q := r.URL.Query()
+	var start, end time.Time
+	for _, v := range []struct {
+		key string
+		t   *time.Time
+	}{{"start", &start}, {"end", &end}} {
+		if s := q.Get(v.key); s != "" {
+			t, err := time.Parse(swarming.TimestampFormat, s)
+			if err != nil {
+				server.Fail(err)
+				return errorReply(http.StatusBadRequest, "invalid %s", v.key)
+			}
+			*v.t = t
+		}
+	}
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	items := []interface{}{}
+	// Most recent first.
+	for i := len(server.tasks) - 1; i >= 0; i-- {
+		t := &server.tasks[i].result
+		if name := q.Get("name"); name != "" && t.Name != name {
+			continue
+		}
+		if !matchState(q.Get("state"), t) || !hasTags(t, q["tag"]) {
+			continue
+		}
+		if (!start.IsZero() && t.CreatedTS.Before(start)) || (!end.IsZero() && t.CreatedTS.After(end)) {
+			continue
+		}
+		r := *t
+		items = append(items, &r)
+	}
+	return page(q, items)
+}
+
+func (server *swarmingFake) listBots(r *http.Request) (interface{}, int) {
+	q := r.URL.Query()
+	dimensions := map[string]string{}
+	for _, d := range q["dimensions"] {
+		kv := strings.SplitN(d, ":", 2)
+		if len(kv) != 2 {
+			return errorReply(http.StatusBadRequest, "invalid dimension %s", d)
+		}
+		dimensions[kv[0]] = kv[1]
+	}
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	bots := make([]*swarming.Bot, 0, len(server.opts.Bots))
+	for _, b := range server.opts.Bots {
+		if hasDimensions(b, dimensions) {
+			bots = append(bots, b)
+		}
+	}
+	sort.Sort(botsByID(bots))
+	items := make([]interface{}, len(bots))
+	for i, b := range bots {
+		items[i] = b
+	}
+	return page(q, items)
+}
+
+func (server *swarmingFake) bot(r *http.Request) (interface{}, int) {
+	id := strings.TrimPrefix(r.URL.Path, "/swarming/api/v1/client/bot/")
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	for _, b := range server.opts.Bots {
+		if b.ID == id {
+			return b, http.StatusOK
+		}
+	}
+	return errorReply(http.StatusNotFound, "bot %s not found", id)
+}
+
+type botsByID []*swarming.Bot
+
+func (b botsByID) Len() int           { return len(b) }
+func (b botsByID) Less(i, j int) bool { return b[i].ID < b[j].ID }
+func (b botsByID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,209 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package swarming_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/luci/luci-go/client/swarming"
+	"github.com/luci/luci-go/client/swarming/swarmingfake"
+	"github.com/maruel/ut"
+	"golang.org/x/net/context"
+)
+
+func newRequest(name string, dims map[string]string, tags ...string) *swarming.TaskRequest {
+	return &swarming.TaskRequest{
+		Name:     name,
+		Priority: 100,
+		Properties: swarming.TaskRequestProperties{
+			Commands:   [][]string{{"true"}},
+			Dimensions: dims,
+		},
+		Tags: tags,
+	}
+}
+
+func TestFake(t *testing.T) {
+	t.Parallel()
+	server := swarmingfake.New(swarmingfake.Options{
+		Run: func(r *swarming.TaskRequest) (int, string) {
+			return 0, "line1\nline2\n"
+		},
+	})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	s, err := swarming.New(nil, ts.URL)
+	ut.AssertEqual(t, nil, err)
+	ctx := context.Background()
+
+	id, err := s.Trigger(ctx, newRequest("hi", map[string]string{"os": "Linux"}, "a:b"))
+	ut.AssertEqual(t, nil, err)
+	req, err := s.FetchRequest(ctx, id)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "hi", req.Name)
+	ut.AssertEqual(t, true, req.CreatedTS != nil && !req.CreatedTS.IsZero())
+
+	// The task progresses each time its result is fetched.
+	expected := []struct {
+		state  swarming.TaskState
+		output string
+	}{
+		{swarming.Running, "line1\n"},
+		{swarming.Completed, "line1\nline2\n"},
+		{swarming.Completed, "line1\nline2\n"},
+	}
+	for i, e := range expected {
+		r, err := s.FetchResult(ctx, id)
+		ut.AssertEqualIndex(t, i, nil, err)
+		ut.AssertEqualIndex(t, i, e.state, r.State)
+		ut.AssertEqualIndex(t, i, "bot1", r.BotID)
+		out, err := s.FetchOutput(ctx, id)
+		ut.AssertEqualIndex(t, i, nil, err)
+		ut.AssertEqualIndex(t, i, e.output, out)
+	}
+
+	tasks, err := s.ListTasks(ctx, &swarming.TaskFilter{Tags: []string{"a:b"}, State: "completed_success"})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, len(tasks))
+	tasks, err = s.ListTasks(ctx, &swarming.TaskFilter{State: "pending"})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 0, len(tasks))
+	ut.AssertEqual(t, nil, server.Error())
+}
+
+func TestFakeTransitions(t *testing.T) {
+	t.Parallel()
+	server := swarmingfake.New(swarmingfake.Options{
+		Transitions: []swarming.TaskState{swarming.Pending, swarming.Running, swarming.BotDied},
+		Bots: []*swarming.Bot{
+			{ID: "linux", Dimensions: map[string][]string{"os": {"Linux"}}},
+		},
+	})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	s, err := swarming.New(nil, ts.URL)
+	ut.AssertEqual(t, nil, err)
+	ctx := context.Background()
+
+	died, err := s.Trigger(ctx, newRequest("died", map[string]string{"os": "Linux"}))
+	ut.AssertEqual(t, nil, err)
+	expired, err := s.Trigger(ctx, newRequest("expired", map[string]string{"os": "Mac"}))
+	ut.AssertEqual(t, nil, err)
+	var r *swarming.TaskResult
+	for i := 0; i < 2; i++ {
+		r, err = s.FetchResult(ctx, died)
+		ut.AssertEqual(t, nil, err)
+	}
+	ut.AssertEqual(t, swarming.BotDied, r.State)
+	ut.AssertEqual(t, true, r.InternalFailure)
+	ut.AssertEqual(t, false, r.AbandonedTS.IsZero())
+
+	r, err = s.FetchResult(ctx, expired)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, swarming.Expired, r.State)
+	ut.AssertEqual(t, "", r.BotID)
+
+	bots, err := s.ListBots(ctx, map[string]string{"os": "Linux"}, 0)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, len(bots))
+	bot, err := s.GetBot(ctx, "linux")
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "linux", bot.ID)
+	ut.AssertEqual(t, 2, len(server.Tasks()))
+	ut.AssertEqual(t, nil, server.Error())
+}
+
+func TestFakeCancel(t *testing.T) {
+	t.Parallel()
+	server := swarmingfake.New(swarmingfake.Options{})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	s, err := swarming.New(nil, ts.URL)
+	ut.AssertEqual(t, nil, err)
+	ctx := context.Background()
+
+	id, err := s.Trigger(ctx, newRequest("hi", map[string]string{"os": "Linux"}))
+	ut.AssertEqual(t, nil, err)
+	ok, err := s.Cancel(ctx, id)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, ok)
+	r, err := s.FetchResult(ctx, id)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, swarming.Canceled, r.State)
+	ut.AssertEqual(t, "", r.BotID)
+
+	// A completed task can't be canceled.
+	ok, err = s.Cancel(ctx, id)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, false, ok)
+	_, err = s.Cancel(ctx, "42")
+	ut.AssertEqual(t, true, err != nil)
+	ut.AssertEqual(t, nil, server.Error())
+}
+
+func TestFakeRetry(t *testing.T) {
+	t.Parallel()
+	server := swarmingfake.New(swarmingfake.Options{})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	s, err := swarming.New(nil, ts.URL)
+	ut.AssertEqual(t, nil, err)
+	ctx := context.Background()
+
+	r := newRequest("hi", map[string]string{"os": "Linux"}, "a:b")
+	r.ExpirationSecs = 600
+	id, err := s.Trigger(ctx, r)
+	ut.AssertEqual(t, nil, err)
+	retry, err := s.Retry(ctx, id, []string{"c:d"}, -1)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, swarming.TaskID("2"), retry)
+	_, err = s.Retry(ctx, id, nil, 10)
+	ut.AssertEqual(t, nil, err)
+
+	tasks := server.Tasks()
+	ut.AssertEqual(t, 3, len(tasks))
+	ut.AssertEqual(t, []string{"c:d", "retry_of:1"}, tasks[1].TaskRequest.Tags)
+	ut.AssertEqual(t, 100, tasks[1].TaskRequest.Priority)
+	// The expiration is kept even though the server only returns it as a
+	// timestamp.
+	ut.AssertEqual(t, 600, tasks[1].TaskRequest.ExpirationSecs)
+	ut.AssertEqual(t, []string{"retry_of:1"}, tasks[2].TaskRequest.Tags)
+	ut.AssertEqual(t, 10, tasks[2].TaskRequest.Priority)
+	ut.AssertEqual(t, tasks[0].TaskRequest.Properties, tasks[2].TaskRequest.Properties)
+	ut.AssertEqual(t, nil, server.Error())
+}
+
+func TestFakeInjectError(t *testing.T) {
+	t.Parallel()
+	server := swarmingfake.New(swarmingfake.Options{})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	s, err := swarming.New(nil, ts.URL)
+	ut.AssertEqual(t, nil, err)
+	ctx := context.Background()
+
+	// Task creation is not retried since it is not idempotent.
+	server.InjectError("/swarming/api/v1/client/request", http.StatusServiceUnavailable, 1)
+	_, err = s.Trigger(ctx, newRequest("hi", map[string]string{"os": "Linux"}))
+	ut.AssertEqual(t, false, err == nil)
+	ut.AssertEqual(t, 0, len(server.Tasks()))
+	id, err := s.Trigger(ctx, newRequest("hi", map[string]string{"os": "Linux"}))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, len(server.Tasks()))
+
+	// Transient errors are retried otherwise.
+	server.InjectError("/swarming/api/v1/client/task/", http.StatusServiceUnavailable, 1)
+	_, err = s.FetchResult(ctx, id)
+	ut.AssertEqual(t, nil, err)
+
+	server.InjectError("/swarming/api/v1/client/task/", http.StatusForbidden, 1)
+	_, err = s.FetchResult(ctx, id)
+	ut.AssertEqual(t, false, err == nil)
+	_, err = s.FetchResult(ctx, id)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, server.Error())
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package swarming
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// TaskState is the state of a task as reported by the server.
+type TaskState int
+
+// Task states, as defined by the server.
+const (
+	Running   TaskState = 0x10
+	Pending   TaskState = 0x20
+	Expired   TaskState = 0x30
+	TimedOut  TaskState = 0x40
+	BotDied   TaskState = 0x50
+	Canceled  TaskState = 0x60
+	Completed TaskState = 0x70
+)
+
+func (t TaskState) String() string {
+	switch t {
+	case Running:
+		return "RUNNING"
+	case Pending:
+		return "PENDING"
+	case Expired:
+		return "EXPIRED"
+	case TimedOut:
+		return "TIMED_OUT"
+	case BotDied:
+		return "BOT_DIED"
+	case Canceled:
+		return "CANCELED"
+	case Completed:
+		return "COMPLETED"
+	default:
+		return fmt.Sprintf("TaskState(0x%x)", int(t))
+	}
+}
+
+// IsFinal returns true if the task is neither pending nor running.
+func (t TaskState) IsFinal() bool {
+	return t != Pending && t != Running
+}
+
+// Timestamp is a time as formatted by the server, in UTC.
+//
+// The zero value is encoded as null.
+type Timestamp struct {
+	time.Time
+}
+
+// TimestampFormat is the format used by the server. Fractional seconds are
+// optional.
+const TimestampFormat = "2006-01-02 15:04:05.999999999"
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(t.UTC().Format(TimestampFormat))
+}
+
+func (t *Timestamp) UnmarshalJSON(p []byte) error {
+	var s *string
+	if err := json.Unmarshal(p, &s); err != nil {
+		return err
+	}
+	if s == nil || *s == "" {
+		t.Time = time.Time{}
+		return nil
+	}
+	v, err := time.Parse(TimestampFormat, *s)
+	if err != nil {
+		return err
+	}
+	t.Time = v
+	return nil
+}
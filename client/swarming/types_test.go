@@ -0,0 +1,92 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package swarming
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/maruel/ut"
+)
+
+func TestTaskState(t *testing.T) {
+	t.Parallel()
+	data := []struct {
+		s       TaskState
+		str     string
+		isFinal bool
+	}{
+		{Running, "RUNNING", false},
+		{Pending, "PENDING", false},
+		{Expired, "EXPIRED", true},
+		{TimedOut, "TIMED_OUT", true},
+		{BotDied, "BOT_DIED", true},
+		{Canceled, "CANCELED", true},
+		{Completed, "COMPLETED", true},
+		{TaskState(1), "TaskState(0x1)", true},
+	}
+	for i, line := range data {
+		ut.AssertEqualIndex(t, i, line.str, line.s.String())
+		ut.AssertEqualIndex(t, i, line.isFinal, line.s.IsFinal())
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	t.Parallel()
+	data := []struct {
+		in       string
+		expected time.Time
+		out      string
+	}{
+		{`"2014-10-24 01:02:03"`, time.Date(2014, 10, 24, 1, 2, 3, 0, time.UTC), `"2014-10-24 01:02:03"`},
+		{`"2014-10-24 01:02:03.5"`, time.Date(2014, 10, 24, 1, 2, 3, 500000000, time.UTC), `"2014-10-24 01:02:03.5"`},
+		{`null`, time.Time{}, `null`},
+		{`""`, time.Time{}, `null`},
+	}
+	for i, line := range data {
+		var ts Timestamp
+		ut.AssertEqualIndex(t, i, nil, json.Unmarshal([]byte(line.in), &ts))
+		ut.AssertEqualIndex(t, i, line.expected, ts.Time)
+		out, err := json.Marshal(ts)
+		ut.AssertEqualIndex(t, i, nil, err)
+		ut.AssertEqualIndex(t, i, line.out, string(out))
+	}
+	var ts Timestamp
+	ut.AssertEqual(t, false, json.Unmarshal([]byte(`"2014-10-24T01:02:03Z"`), &ts) == nil)
+}
+
+func TestTaskResultDurations(t *testing.T) {
+	t.Parallel()
+	r := &TaskResult{}
+	in := `{
+		"created_ts": "2014-10-24 00:00:00",
+		"started_ts": "2014-10-24 00:00:10",
+		"completed_ts": "2014-10-24 00:01:10.5",
+		"state": 112
+	}`
+	ut.AssertEqual(t, nil, json.Unmarshal([]byte(in), r))
+	ut.AssertEqual(t, Completed, r.State)
+	ut.AssertEqual(t, 10*time.Second, r.PendingDuration())
+	ut.AssertEqual(t, 60500*time.Millisecond, r.RunDuration())
+
+	// Expired before running.
+	r = &TaskResult{}
+	in = `{
+		"created_ts": "2014-10-24 00:00:00",
+		"abandoned_ts": "2014-10-24 01:00:00",
+		"started_ts": null,
+		"state": 48
+	}`
+	ut.AssertEqual(t, nil, json.Unmarshal([]byte(in), r))
+	ut.AssertEqual(t, Expired, r.State)
+	ut.AssertEqual(t, time.Hour, r.PendingDuration())
+	ut.AssertEqual(t, time.Duration(0), r.RunDuration())
+
+	// Still pending.
+	r = &TaskResult{CreatedTS: Timestamp{time.Now()}, State: Pending}
+	ut.AssertEqual(t, time.Duration(0), r.PendingDuration())
+	ut.AssertEqual(t, time.Duration(0), r.RunDuration())
+}
@@ -34,8 +34,10 @@ import (
 	"path/filepath"
 	"sort"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
 	"google.golang.org/cloud/compute/metadata"
 
 	"github.com/luci/luci-go/common/auth/internal"
@@ -56,18 +58,24 @@ var (
 // Known Google API OAuth scopes.
 const (
 	OAuthScopeEmail = "https://www.googleapis.com/auth/userinfo.email"
+	OAuthScopeIAM   = "https://www.googleapis.com/auth/cloud-platform"
 )
 
+// DefaultIAMCredentialsURL is the root URL of the IAM credentials service used
+// by ImpersonationMethod by default.
+const DefaultIAMCredentialsURL = "https://iamcredentials.googleapis.com"
+
 // Method defines a method to use to obtain OAuth access_token.
 type Method string
 
 // Supported authentication methods.
 const (
 	// AutoSelectMethod can be used to allow the library to pick a method most
-	// appropriate for current execution environment. It will search for a private
-	// key for a service account, then (if running on GCE) will try to query GCE
-	// metadata server, and only then pick UserCredentialsMethod that requires
-	// interaction with a user.
+	// appropriate for current execution environment. It will impersonate
+	// ImpersonateServiceAccount if set, use the local auth server of the parent
+	// process if any, search for a private key for a service account, then (if
+	// running on GCE) will try to query GCE metadata server, and only then pick
+	// UserCredentialsMethod that requires interaction with a user.
 	AutoSelectMethod Method = ""
 
 	// UserCredentialsMethod is used for interactive OAuth 3-legged login flow.
@@ -80,6 +88,17 @@ const (
 	// GCEMetadataMethod is used on Compute Engine to use tokens provided by
 	// Metadata server. See https://cloud.google.com/compute/docs/authentication
 	GCEMetadataMethod Method = "GCEMetadataMethod"
+
+	// LocalAuthMethod is used by child processes to get tokens from the
+	// LocalAuthServer of their parent, found via LocalAuthEnvVar. The tokens
+	// are not cached on disk.
+	LocalAuthMethod Method = "LocalAuthMethod"
+
+	// ImpersonationMethod is used to act as ImpersonateServiceAccount without
+	// having its private key. The tokens are minted by the IAM credentials
+	// service using the credentials of BaseMethod, which must be allowed to
+	// create tokens for the service account.
+	ImpersonationMethod Method = "ImpersonationMethod"
 )
 
 // LoginMode is used as enum in AuthenticatedClient function.
@@ -117,6 +136,32 @@ type Options struct {
 	// ClientID is OAuth client_secret to use with UserCredentialsMethod.
 	// Default: provided by DefaultClient().
 	ClientSecret string
+	// UseDeviceFlow makes UserCredentialsMethod login with the OAuth device
+	// flow: the user enters a code on a web page opened on any machine instead
+	// of pasting an authorization code in the terminal. Useful over SSH.
+	UseDeviceFlow bool
+
+	// UseIDToken makes the requests carry OpenID Connect ID tokens instead of
+	// access tokens. Only ServiceAccountMethod and UserCredentialsMethod support
+	// it.
+	UseIDToken bool
+	// Audience is the audience of the ID tokens. It is required with
+	// ServiceAccountMethod. With UserCredentialsMethod the audience is always
+	// ClientID, so it must be empty or equal to ClientID.
+	Audience string
+
+	// ImpersonateServiceAccount is the email of the service account to act as
+	// with ImpersonationMethod.
+	ImpersonateServiceAccount string
+	// BaseMethod is the method used by ImpersonationMethod to get the
+	// credentials that impersonate the service account. The other options
+	// apply to it too, except Scopes which is [OAuthScopeIAM].
+	// Default: AutoSelectMethod.
+	BaseMethod Method
+	// IAMCredentialsURL is the root URL of the IAM credentials service used by
+	// ImpersonationMethod.
+	// Default: DefaultIAMCredentialsURL.
+	IAMCredentialsURL string
 
 	// ServiceAccountJSONPath is a path to a JSON blob with a private key to use
 	// with ServiceAccountMethod. See the "Credentials" page under "APIs & Auth"
@@ -158,6 +203,13 @@ type Authenticator interface {
 
 	// PurgeCredentialsCache removes cached tokens.
 	PurgeCredentialsCache() error
+
+	// GetAccessToken returns an OAuth access token valid for at least lifetime,
+	// refreshing the cached token if necessary. Like Transport, it never
+	// interacts with the user and returns ErrLoginRequired if a login is needed.
+	// With UseIDToken, the ID token is the "id_token" extra field of the token
+	// and the access token may be empty.
+	GetAccessToken(lifetime time.Duration) (*oauth2.Token, error)
 }
 
 // NewAuthenticator returns a new instance of Authenticator given its options.
@@ -275,6 +327,18 @@ func (a *authenticatorImpl) Login() error {
 		return nil
 	}
 
+	// The interaction is done by the base credentials, the impersonated token
+	// is then minted with them.
+	if a.opts.Method == ImpersonationMethod {
+		base, err := impersonationBase(a.opts)
+		if err != nil {
+			return err
+		}
+		if err = base.Login(); err != nil {
+			return err
+		}
+	}
+
 	// Create initial token. This may require interaction with a user.
 	a.token, err = a.provider.MintToken()
 	if err != nil {
@@ -304,9 +368,72 @@ func (a *authenticatorImpl) PurgeCredentialsCache() error {
 	return nil
 }
 
+func (a *authenticatorImpl) GetAccessToken(lifetime time.Duration) (*oauth2.Token, error) {
+	if _, err := a.Transport(); err != nil {
+		return nil, err
+	}
+	tok, err := a.validToken(lifetime)
+	if err != nil {
+		return nil, err
+	}
+	t, err := internal.ExtractToken(tok)
+	if err != nil {
+		return nil, err
+	}
+	// Do not leak the refresh token.
+	out := &oauth2.Token{
+		AccessToken: t.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      t.Expiry,
+	}
+	if idToken, _ := t.Extra("id_token").(string); idToken != "" {
+		out = out.WithExtra(map[string]interface{}{"id_token": idToken})
+	}
+	return out, nil
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // Authenticator private methods.
 
+// authInfo describes the configuration and the cached token of an
+// Authenticator.
+type authInfo struct {
+	Method       Method
+	Impersonated string // the service account impersonated, if any
+	Scopes       []string
+	CachePath    string // empty if the token is only kept in memory
+	HasToken     bool
+	Expiry       time.Time // zero if unknown or if the token never expires
+	Expired      bool      // the token must be refreshed before use
+}
+
+// info returns the current state of the Authenticator. It doesn't refresh
+// the token.
+func (a *authenticatorImpl) info() (*authInfo, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if err := a.ensureInitialized(); err != nil {
+		return nil, err
+	}
+	out := &authInfo{
+		Method:    a.opts.Method,
+		Scopes:    a.opts.Scopes,
+		CachePath: a.cache.path,
+	}
+	if a.opts.Method == ImpersonationMethod {
+		out.Impersonated = a.opts.ImpersonateServiceAccount
+	}
+	if a.token != nil {
+		out.HasToken = true
+		out.Expired = a.token.Expired()
+		if t, err := internal.ExtractToken(a.token); err == nil {
+			out.Expiry = t.Expiry
+		}
+	}
+	return out, nil
+}
+
 // ensureInitialized is supposed to be called under the lock.
 func (a *authenticatorImpl) ensureInitialized() error {
 	if a.err != nil || a.provider != nil {
@@ -325,9 +452,10 @@ func (a *authenticatorImpl) ensureInitialized() error {
 	}
 
 	// Setup the cache only when Method is known, cache filename depends on it.
-	a.cache = &tokenCache{
-		path: filepath.Join(SecretsDir(), cacheFileName(a.opts)+".tok"),
-		log:  a.log,
+	// Tokens from the local auth server are kept in memory only.
+	a.cache = &tokenCache{log: a.log}
+	if a.opts.Method != LocalAuthMethod {
+		a.cache.path = filepath.Join(SecretsDir(), cacheFileName(a.opts)+".tok")
 	}
 
 	// Broken token cache is not a fatal error. So just log it and forget, a new
@@ -373,59 +501,85 @@ func (a *authenticatorImpl) currentToken() internal.Token {
 
 // refreshToken compares current token to 'prev' and launches token refresh
 // procedure if they still match. Returns a refreshed token (if a refresh
-// procedure happened) or the current token (i.e. if it's different from prev).
-// Acts as "Compare-And-Swap" where "Swap" is a token refresh procedure.
-func (a *authenticatorImpl) refreshToken(prev internal.Token) (internal.Token, error) {
-	// Refresh the token under the lock.
-	tok, cache, err := func() (internal.Token, bool, error) {
-		a.lock.Lock()
-		defer a.lock.Unlock()
-
-		// Some other goroutine already updated the token, just return the token.
-		if a.token != nil && !a.token.Equals(prev) {
-			return a.token, false, nil
-		}
+// procedure happened) or the current token (i.e. if it's different from prev
+// and valid for at least lifetime). Acts as "Compare-And-Swap" where "Swap" is
+// a token refresh procedure.
+func (a *authenticatorImpl) refreshToken(prev internal.Token, lifetime time.Duration) (internal.Token, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
 
-		// Rescan the cache. Maybe some other process updated the token.
-		cached, err := a.readTokenCache()
-		if err == nil && cached != nil && !cached.Equals(prev) && !cached.Expired() {
-			a.log.Debugf("auth: some other process put refreshed token in the cache")
-			a.token = cached
-			return a.token, false, nil
-		}
+	// The transport of the base credentials of ImpersonationMethod is used
+	// without calling Transport first.
+	if err := a.ensureInitialized(); err != nil {
+		return nil, err
+	}
 
-		// Mint a new token or refresh the existing one.
-		if a.token == nil {
-			// Can't do user interaction outside of Login.
-			if a.provider.RequiresInteraction() {
-				return nil, false, ErrLoginRequired
-			}
-			a.log.Debugf("auth: minting a new token")
-			a.token, err = a.provider.MintToken()
-			if err != nil {
-				a.log.Warningf("auth: failed to mint a token: %v", err)
-				return nil, false, err
-			}
-		} else {
-			a.log.Debugf("auth: refreshing the token")
-			a.token, err = a.provider.RefreshToken(a.token)
-			if err != nil {
-				a.log.Warningf("auth: failed to refresh the token: %v", err)
-				return nil, false, err
-			}
-		}
-		return a.token, true, nil
-	}()
+	// Some other goroutine already updated the token, just return the token.
+	if a.token != nil && !a.token.Equals(prev) && !expiresWithin(a.token, lifetime) {
+		return a.token, nil
+	}
 
+	// Hold the cache lock until the refreshed token is in the cache, so that
+	// other processes wait for it instead of refreshing the token too. Do not
+	// die if it fails or another process holds it for too long, the token can
+	// still be refreshed.
+	unlock, err := a.cache.lockFile(cacheLockTimeout)
 	if err != nil {
-		return nil, err
+		a.log.Warningf("auth: failed to lock the token cache: %v", err)
+	} else {
+		defer unlock()
+	}
+
+	// Rescan the cache. Maybe some other process updated the token.
+	cached, err := a.readTokenCache()
+	if err == nil && cached != nil && !cached.Equals(prev) && !expiresWithin(cached, lifetime) {
+		a.log.Debugf("auth: some other process put refreshed token in the cache")
+		a.token = cached
+		return a.token, nil
 	}
 
-	// Store the new token in the cache outside the lock, no need for callers to
-	// wait for this. Do not die if failed, token is still usable from the memory.
-	if cache {
-		if err = a.cacheToken(tok); err != nil {
-			a.log.Warningf("auth: failed to write refreshed token to the cache: %v", err)
+	// Mint a new token or refresh the existing one.
+	if a.token == nil {
+		// Can't do user interaction outside of Login.
+		if a.provider.RequiresInteraction() {
+			return nil, ErrLoginRequired
+		}
+		a.log.Debugf("auth: minting a new token")
+		a.token, err = a.provider.MintToken()
+		if err != nil {
+			a.log.Warningf("auth: failed to mint a token: %v", err)
+			return nil, err
+		}
+	} else {
+		a.log.Debugf("auth: refreshing the token")
+		a.token, err = a.provider.RefreshToken(a.token)
+		if err != nil {
+			a.log.Warningf("auth: failed to refresh the token: %v", err)
+			return nil, err
+		}
+	}
+
+	// Do not die if failed, token is still usable from the memory.
+	if err = a.cacheToken(a.token); err != nil {
+		a.log.Warningf("auth: failed to write refreshed token to the cache: %v", err)
+	}
+	return a.token, nil
+}
+
+// validToken returns the current token, refreshing it if it expires within
+// lifetime.
+func (a *authenticatorImpl) validToken(lifetime time.Duration) (internal.Token, error) {
+	tok := a.currentToken()
+	if tok == nil || expiresWithin(tok, lifetime) {
+		var err error
+		if tok, err = a.refreshToken(tok, lifetime); err != nil {
+			return nil, err
+		}
+		if tok == nil || tok.Expired() {
+			return nil, fmt.Errorf("auth: failed to refresh the token")
+		}
+		if expiresWithin(tok, lifetime) {
+			return nil, fmt.Errorf("auth: failed to get a token valid for %s", lifetime)
 		}
 	}
 	return tok, nil
@@ -449,17 +603,10 @@ type authTransport struct {
 }
 
 // RoundTrip appends authorization details to the request.
-func (t *authTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	tok := t.parent.currentToken()
-	if tok == nil || tok.Expired() {
-		tok, err = t.parent.refreshToken(tok)
-		if err != nil {
-			return
-		}
-		if tok == nil || tok.Expired() {
-			err = fmt.Errorf("auth: failed to refresh the token")
-			return
-		}
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tok, err := t.parent.validToken(0)
+	if err != nil {
+		return nil, err
 	}
 	clone := *req
 	clone.Header = make(http.Header)
@@ -475,6 +622,9 @@ func (t *authTransport) RoundTrip(req *http.Request) (resp *http.Response, err e
 ////////////////////////////////////////////////////////////////////////////////
 // tokenCache implementation.
 
+// tokenCache stores the token in a file shared by all the processes of the
+// user. Writes are atomic and lockFile serializes the refreshes across
+// processes. If path is empty, nothing is stored.
 type tokenCache struct {
 	path string
 	log  logging.Logger
@@ -482,6 +632,9 @@ type tokenCache struct {
 }
 
 func (c *tokenCache) read() (buf []byte, err error) {
+	if c.path == "" {
+		return nil, nil
+	}
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	c.log.Debugf("auth: reading token from %s", c.path)
@@ -493,6 +646,9 @@ func (c *tokenCache) read() (buf []byte, err error) {
 }
 
 func (c *tokenCache) write(buf []byte) error {
+	if c.path == "" {
+		return nil
+	}
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	c.log.Debugf("auth: writing token to %s", c.path)
@@ -500,11 +656,77 @@ func (c *tokenCache) write(buf []byte) error {
 	if err != nil {
 		return err
 	}
-	// TODO(vadimsh): Make it atomic across multiple processes.
-	return ioutil.WriteFile(c.path, buf, 0600)
+	// Write to a temporary file and rename it so that other processes never
+	// read a partially written token. TempFile creates the file with 0600.
+	f, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+const (
+	// cacheLockTimeout is how long refreshToken waits for another process to
+	// release the cache lock before refreshing the token without it.
+	cacheLockTimeout = 30 * time.Second
+	// cacheLockPoll is how often the cache lock is polled while waiting.
+	cacheLockPoll = 50 * time.Millisecond
+)
+
+// lockFile takes an exclusive advisory lock on the cache, waiting up to
+// timeout for it to be available. It is shared by all the processes of the
+// user. The returned function releases the lock.
+func (c *tokenCache) lockFile(timeout time.Duration) (func(), error) {
+	if c.path == "" {
+		return func() {}, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(c.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	// The lock is polled instead of blocking on it, so a process stuck while
+	// holding it doesn't block all the others.
+	deadline := time.Now().Add(timeout)
+	for {
+		locked, err := tryLockFile(f)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			_ = f.Close()
+			return nil, fmt.Errorf("timed out waiting for %s", f.Name())
+		}
+		time.Sleep(cacheLockPoll)
+	}
+	return func() {
+		if err := unlockFile(f); err != nil {
+			c.log.Warningf("auth: failed to unlock %s: %v", f.Name(), err)
+		}
+		_ = f.Close()
+	}, nil
 }
 
 func (c *tokenCache) clear() error {
+	if c.path == "" {
+		return nil
+	}
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	err := os.Remove(c.path)
@@ -533,11 +755,72 @@ func cacheFileName(opts *Options) string {
 		_, _ = sum.Write([]byte{0})
 	}
 	_, _ = sum.Write([]byte(opts.GCEAccountName))
+	// Keep the names of the access token caches unchanged.
+	if opts.Method == ImpersonationMethod {
+		_, _ = sum.Write([]byte{0})
+		_, _ = sum.Write([]byte(opts.ImpersonateServiceAccount))
+		_, _ = sum.Write([]byte{0})
+		_, _ = sum.Write([]byte(opts.BaseMethod))
+	}
+	if opts.UseIDToken {
+		_, _ = sum.Write([]byte{0})
+		_, _ = sum.Write([]byte("id_token"))
+		_, _ = sum.Write([]byte{0})
+		_, _ = sum.Write([]byte(opts.Audience))
+	}
 	return hex.EncodeToString(sum.Sum(nil))[:16]
 }
 
+// expiresWithin is true if tok is expired or expires in less than lifetime.
+// Tokens with an unknown expiration time only expire when Expired says so.
+func expiresWithin(tok internal.Token, lifetime time.Duration) bool {
+	if tok.Expired() {
+		return true
+	}
+	if lifetime <= 0 {
+		return false
+	}
+	t, err := internal.ExtractToken(tok)
+	if err != nil || t.Expiry.IsZero() {
+		return false
+	}
+	return t.Expiry.Before(time.Now().Add(lifetime))
+}
+
+// impersonationBase returns the Authenticator providing the credentials used
+// by ImpersonationMethod to call the IAM credentials service. Its method is
+// already selected.
+func impersonationBase(opts *Options) (*authenticatorImpl, error) {
+	if opts.ImpersonateServiceAccount == "" {
+		return nil, fmt.Errorf("no service account to impersonate with %s", opts.Method)
+	}
+	if opts.BaseMethod == ImpersonationMethod {
+		return nil, fmt.Errorf("the base method of %s can't be itself", opts.Method)
+	}
+	if opts.UseIDToken {
+		return nil, fmt.Errorf("ID tokens are not supported with %s", opts.Method)
+	}
+	base := *opts
+	base.Method = opts.BaseMethod
+	base.Scopes = []string{OAuthScopeIAM}
+	base.ImpersonateServiceAccount = ""
+	base.BaseMethod = ""
+	base.IAMCredentialsURL = ""
+	a := NewAuthenticator(base).(*authenticatorImpl)
+	if a.opts.Method == AutoSelectMethod {
+		a.opts.Method = selectDefaultMethod(a.opts)
+	}
+	return a, nil
+}
+
 // selectDefaultMethod is mocked in tests.
 var selectDefaultMethod = func(opts *Options) Method {
+	if opts.ImpersonateServiceAccount != "" {
+		return ImpersonationMethod
+	}
+	if os.Getenv(LocalAuthEnvVar) != "" {
+		return LocalAuthMethod
+	}
 	if opts.ServiceAccountJSONPath != "" {
 		info, _ := os.Stat(opts.ServiceAccountJSONPath)
 		if info != nil && info.Mode().IsRegular() {
@@ -565,20 +848,69 @@ var secretsDir = func() string {
 var makeTokenProvider = func(opts *Options) (internal.TokenProvider, error) {
 	switch opts.Method {
 	case UserCredentialsMethod:
+		if opts.UseIDToken && opts.Audience != "" && opts.Audience != opts.ClientID {
+			return nil, fmt.Errorf("the audience of user ID tokens must be the client ID %s", opts.ClientID)
+		}
+		if opts.UseDeviceFlow {
+			return internal.NewDeviceAuthTokenProvider(
+				opts.Context,
+				opts.ClientID,
+				opts.ClientSecret,
+				opts.Scopes,
+				opts.UseIDToken)
+		}
 		return internal.NewUserAuthTokenProvider(
 			opts.Context,
 			opts.ClientID,
 			opts.ClientSecret,
-			opts.Scopes)
+			opts.Scopes,
+			opts.UseIDToken)
 	case ServiceAccountMethod:
+		if opts.UseIDToken {
+			return internal.NewServiceAccountIDTokenProvider(
+				opts.Context,
+				opts.ServiceAccountJSONPath,
+				opts.Audience)
+		}
 		return internal.NewServiceAccountTokenProvider(
 			opts.Context,
 			opts.ServiceAccountJSONPath,
 			opts.Scopes)
 	case GCEMetadataMethod:
+		if opts.UseIDToken {
+			return nil, fmt.Errorf("ID tokens are not supported with %s", opts.Method)
+		}
 		return internal.NewGCETokenProvider(
 			opts.GCEAccountName,
 			opts.Scopes)
+	case LocalAuthMethod:
+		if opts.UseIDToken {
+			return nil, fmt.Errorf("ID tokens are not supported with %s", opts.Method)
+		}
+		path := os.Getenv(LocalAuthEnvVar)
+		if path == "" {
+			return nil, fmt.Errorf("%s is not set", LocalAuthEnvVar)
+		}
+		return internal.NewLocalAuthTokenProvider(
+			opts.Context,
+			path,
+			opts.Scopes)
+	case ImpersonationMethod:
+		base, err := impersonationBase(opts)
+		if err != nil {
+			return nil, err
+		}
+		serviceURL := opts.IAMCredentialsURL
+		if serviceURL == "" {
+			serviceURL = DefaultIAMCredentialsURL
+		}
+		return internal.NewIAMTokenProvider(
+			opts.Context,
+			base.transport,
+			base.opts.Method == UserCredentialsMethod,
+			serviceURL,
+			opts.ImpersonateServiceAccount,
+			opts.Scopes)
 	default:
 		return nil, fmt.Errorf("unrecognized authentication method: %s", opts.Method)
 	}
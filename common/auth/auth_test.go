@@ -5,13 +5,24 @@
 package auth
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
 
 	. "github.com/smartystreets/goconvey/convey"
 
@@ -81,6 +92,23 @@ func TestAuthenticator(t *testing.T) {
 				Logger:                 logging.Get(ctx),
 			})
 		})
+
+		Convey("Check ID tokens are cached separately", func() {
+			opts := &Options{Method: ServiceAccountMethod, Scopes: []string{OAuthScopeEmail}}
+			access := cacheFileName(opts)
+			opts.UseIDToken = true
+			opts.Audience = "a"
+			idA := cacheFileName(opts)
+			opts.Audience = "b"
+			idB := cacheFileName(opts)
+			So(access, ShouldNotEqual, idA)
+			So(idA, ShouldNotEqual, idB)
+		})
+
+		Convey("Check ID tokens are not supported on GCE", func() {
+			_, err := makeTokenProvider(&Options{Method: GCEMetadataMethod, UseIDToken: true})
+			So(err, ShouldNotBeNil)
+		})
 	})
 }
 
@@ -125,7 +153,7 @@ func TestRefreshToken(t *testing.T) {
 			So(err, ShouldBeNil)
 			// No token yet. The token is minted on first refresh.
 			So(auth.currentToken(), ShouldBeNil)
-			tok, err := auth.refreshToken(nil)
+			tok, err := auth.refreshToken(nil, 0)
 			So(err, ShouldBeNil)
 			So(tok, ShouldEqual, tokenProvider.tokenToMint)
 		})
@@ -148,7 +176,7 @@ func TestRefreshToken(t *testing.T) {
 			// Minted initial token.
 			So(auth.currentToken(), ShouldEqual, tokenProvider.tokenToMint)
 			// Should return refreshed token.
-			tok, err := auth.refreshToken(auth.currentToken())
+			tok, err := auth.refreshToken(auth.currentToken(), 0)
 			So(err, ShouldBeNil)
 			So(tok, ShouldEqual, tokenProvider.tokenToRefresh)
 		})
@@ -171,15 +199,335 @@ func TestRefreshToken(t *testing.T) {
 			// Minted initial token.
 			So(auth.currentToken(), ShouldEqual, tokenProvider.tokenToMint)
 			// Should return token from cache (since it's not expired yet).
-			tok, err := auth.refreshToken(auth.currentToken())
+			tok, err := auth.refreshToken(auth.currentToken(), 0)
 			So(err, ShouldBeNil)
 			So(tok, ShouldEqual, tokenProvider.tokenToUnmarshal)
 		})
 	})
 }
 
+func TestGetAccessToken(t *testing.T) {
+	Convey("Given mocked secrets dir", t, func() {
+		var tokenProvider *expiringTokenProvider
+
+		tempDir := mockSecretsDir()
+		mockTokenProvider(func() internal.TokenProvider { return tokenProvider })
+
+		Convey("Test token is refreshed to satisfy lifetime", func() {
+			tokenProvider = &expiringTokenProvider{
+				lifetimes: []time.Duration{10 * time.Minute, time.Hour},
+			}
+			auth := NewAuthenticator(Options{})
+			tok, err := auth.GetAccessToken(0)
+			So(err, ShouldBeNil)
+			So(tok.AccessToken, ShouldEqual, "tok0")
+			So(tok.RefreshToken, ShouldEqual, "")
+			tok, err = auth.GetAccessToken(5 * time.Minute)
+			So(err, ShouldBeNil)
+			So(tok.AccessToken, ShouldEqual, "tok0")
+			tok, err = auth.GetAccessToken(20 * time.Minute)
+			So(err, ShouldBeNil)
+			So(tok.AccessToken, ShouldEqual, "tok1")
+			So(tok.Expiry.After(time.Now().Add(50*time.Minute)), ShouldBeTrue)
+		})
+
+		Convey("Test lifetime can't be satisfied", func() {
+			tokenProvider = &expiringTokenProvider{
+				lifetimes: []time.Duration{10 * time.Minute},
+			}
+			_, err := NewAuthenticator(Options{}).GetAccessToken(20 * time.Minute)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "valid for 20m0s")
+		})
+
+		Convey("Test info", func() {
+			tokenProvider = &expiringTokenProvider{
+				lifetimes: []time.Duration{time.Hour},
+			}
+			auth := NewAuthenticator(Options{Method: ServiceAccountMethod}).(*authenticatorImpl)
+			info, err := auth.info()
+			So(err, ShouldBeNil)
+			So(info.Method, ShouldEqual, ServiceAccountMethod)
+			So(info.Scopes, ShouldResemble, []string{OAuthScopeEmail})
+			So(filepath.Dir(info.CachePath), ShouldEqual, tempDir)
+			So(info.HasToken, ShouldBeFalse)
+
+			tok, err := auth.GetAccessToken(0)
+			So(err, ShouldBeNil)
+			info, err = auth.info()
+			So(err, ShouldBeNil)
+			So(info.HasToken, ShouldBeTrue)
+			So(info.Expired, ShouldBeFalse)
+			So(info.Expiry, ShouldResemble, tok.Expiry)
+		})
+	})
+}
+
+func TestImpersonation(t *testing.T) {
+	Convey("Given a fake IAM credentials service", t, func() {
+		tempDir := mockSecretsDir()
+
+		// The base credentials are tokens named after their scopes.
+		var baseMints int32
+		prev := makeTokenProvider
+		makeTokenProvider = func(opts *Options) (internal.TokenProvider, error) {
+			if opts.Method == ImpersonationMethod {
+				return prev(opts)
+			}
+			return &scopedTokenProvider{
+				scopes:      opts.Scopes,
+				mints:       &baseMints,
+				interactive: opts.Method == UserCredentialsMethod,
+			}, nil
+		}
+		Reset(func() {
+			makeTokenProvider = prev
+		})
+
+		var iamCalls int32
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer "+OAuthScopeIAM {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			account := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/projects/-/serviceAccounts/"), ":generateAccessToken")
+			n := atomic.AddInt32(&iamCalls, 1)
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"accessToken": fmt.Sprintf("%s %d", account, n),
+				"expireTime":  time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			})
+		}))
+		Reset(s.Close)
+
+		opts := func(account string, base Method) Options {
+			return Options{
+				ImpersonateServiceAccount: account,
+				BaseMethod:                base,
+				IAMCredentialsURL:         s.URL,
+				Logger:                    log,
+			}
+		}
+
+		Convey("Test tokens are minted and cached per service account", func() {
+			a := NewAuthenticator(opts("a@example.com", ServiceAccountMethod))
+			tok, err := a.GetAccessToken(0)
+			So(err, ShouldBeNil)
+			So(tok.AccessToken, ShouldEqual, "a@example.com 1")
+			tok, err = a.GetAccessToken(0)
+			So(err, ShouldBeNil)
+			So(tok.AccessToken, ShouldEqual, "a@example.com 1")
+
+			tok, err = NewAuthenticator(opts("b@example.com", ServiceAccountMethod)).GetAccessToken(0)
+			So(err, ShouldBeNil)
+			So(tok.AccessToken, ShouldEqual, "b@example.com 2")
+
+			// Another process gets the token from the cache.
+			tok, err = NewAuthenticator(opts("a@example.com", ServiceAccountMethod)).GetAccessToken(0)
+			So(err, ShouldBeNil)
+			So(tok.AccessToken, ShouldEqual, "a@example.com 1")
+			So(atomic.LoadInt32(&iamCalls), ShouldEqual, 2)
+			So(atomic.LoadInt32(&baseMints), ShouldEqual, 1)
+
+			// One cache file for the base credentials and one per service account.
+			files, err := filepath.Glob(filepath.Join(tempDir, "*.tok"))
+			So(err, ShouldBeNil)
+			So(len(files), ShouldEqual, 3)
+
+			info, err := a.(*authenticatorImpl).info()
+			So(err, ShouldBeNil)
+			So(info.Method, ShouldEqual, ImpersonationMethod)
+			So(info.Impersonated, ShouldEqual, "a@example.com")
+		})
+
+		Convey("Test login is done with the base credentials", func() {
+			_, err := AuthenticatedClient(SilentLogin, NewAuthenticator(opts("a@example.com", UserCredentialsMethod)))
+			So(err, ShouldEqual, ErrLoginRequired)
+
+			client, err := AuthenticatedClient(InteractiveLogin, NewAuthenticator(opts("a@example.com", UserCredentialsMethod)))
+			So(err, ShouldBeNil)
+			So(client, ShouldNotEqual, http.DefaultClient)
+			So(atomic.LoadInt32(&baseMints), ShouldEqual, 1)
+			So(atomic.LoadInt32(&iamCalls), ShouldEqual, 1)
+
+			tok, err := NewAuthenticator(opts("a@example.com", UserCredentialsMethod)).GetAccessToken(0)
+			So(err, ShouldBeNil)
+			So(tok.AccessToken, ShouldEqual, "a@example.com 1")
+		})
+
+		Convey("Test flags select impersonation", func() {
+			fl := Flags{}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fl.Register(fs)
+			So(fs.Parse([]string{"-service-account-json", "key.json", "-impersonate", "a@example.com"}), ShouldBeNil)
+			o, err := fl.Options()
+			So(err, ShouldBeNil)
+			So(o.Method, ShouldEqual, ImpersonationMethod)
+			So(o.BaseMethod, ShouldEqual, ServiceAccountMethod)
+			So(o.ImpersonateServiceAccount, ShouldEqual, "a@example.com")
+		})
+
+		Convey("Test invalid options", func() {
+			_, err := NewAuthenticator(Options{Method: ImpersonationMethod}).Transport()
+			So(err, ShouldNotBeNil)
+			o := opts("a@example.com", ImpersonationMethod)
+			_, err = NewAuthenticator(o).Transport()
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestTokenCache(t *testing.T) {
+	Convey("Given mocked secrets dir", t, func() {
+		tempDir := mockSecretsDir()
+
+		Convey("Test write is atomic", func() {
+			c := &tokenCache{path: filepath.Join(tempDir, "a", "b.tok"), log: log}
+			So(c.write([]byte("first")), ShouldBeNil)
+			So(c.write([]byte("second")), ShouldBeNil)
+			buf, err := c.read()
+			So(err, ShouldBeNil)
+			So(string(buf), ShouldEqual, "second")
+			// No temporary file is left behind.
+			files, err := ioutil.ReadDir(filepath.Join(tempDir, "a"))
+			So(err, ShouldBeNil)
+			So(len(files), ShouldEqual, 1)
+			if runtime.GOOS != "windows" {
+				So(files[0].Mode().Perm(), ShouldEqual, os.FileMode(0600))
+			}
+			So(c.clear(), ShouldBeNil)
+			buf, err = c.read()
+			So(err, ShouldBeNil)
+			So(buf, ShouldBeNil)
+		})
+
+		Convey("Test lockFile is exclusive", func() {
+			c := &tokenCache{path: filepath.Join(tempDir, "c.tok"), log: log}
+			unlock, err := c.lockFile(time.Minute)
+			So(err, ShouldBeNil)
+			locked := make(chan struct{})
+			go func() {
+				unlock2, err := c.lockFile(time.Minute)
+				if err == nil {
+					unlock2()
+				}
+				close(locked)
+			}()
+			select {
+			case <-locked:
+				t.Error("lock acquired twice")
+			case <-time.After(50 * time.Millisecond):
+			}
+			unlock()
+			<-locked
+		})
+
+		Convey("Test lockFile times out", func() {
+			c := &tokenCache{path: filepath.Join(tempDir, "c.tok"), log: log}
+			unlock, err := c.lockFile(time.Minute)
+			So(err, ShouldBeNil)
+			defer unlock()
+			_, err = c.lockFile(100 * time.Millisecond)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+// refreshConcurrently is the work done by each goroutine and process in
+// TestConcurrentRefresh.
+func refreshConcurrently() error {
+	a := NewAuthenticator(Options{Method: ServiceAccountMethod, Logger: log}).(*authenticatorImpl)
+	if _, err := a.Transport(); err != nil {
+		return err
+	}
+	tok, err := a.refreshToken(a.currentToken(), 0)
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return fmt.Errorf("no token")
+	}
+	return nil
+}
+
+// TestHelperProcess isn't a real test; it is the process spawned by
+// TestConcurrentRefresh.
+func TestHelperProcess(t *testing.T) {
+	dir := os.Getenv("AUTH_TEST_SECRETS_DIR")
+	if dir == "" {
+		return
+	}
+	secretsDir = func() string { return dir }
+	makeTokenProvider = func(*Options) (internal.TokenProvider, error) {
+		return &countingTokenProvider{dir: dir}, nil
+	}
+	if err := refreshConcurrently(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestConcurrentRefresh(t *testing.T) {
+	Convey("Given mocked secrets dir", t, func() {
+		tempDir := mockSecretsDir()
+		mockTokenProvider(func() internal.TokenProvider { return &countingTokenProvider{dir: tempDir} })
+
+		Convey("Test only one process refreshes the token", func() {
+			const processes = 8
+			const goroutines = 8
+			cmds := make([]*exec.Cmd, processes)
+			for i := range cmds {
+				cmds[i] = exec.Command(os.Args[0], "-test.run=TestHelperProcess")
+				cmds[i].Env = append(os.Environ(), "AUTH_TEST_SECRETS_DIR="+tempDir)
+				So(cmds[i].Start(), ShouldBeNil)
+			}
+			errs := make(chan error, goroutines)
+			var wg sync.WaitGroup
+			for i := 0; i < goroutines; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs <- refreshConcurrently()
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				So(err, ShouldBeNil)
+			}
+			for _, cmd := range cmds {
+				So(cmd.Wait(), ShouldBeNil)
+			}
+			mints, err := ioutil.ReadFile(filepath.Join(tempDir, "mints"))
+			So(err, ShouldBeNil)
+			So(string(mints), ShouldEqual, "x")
+		})
+	})
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
+// countingTokenProvider records each minted token in the file "mints" in dir,
+// so that the mints can be counted across processes.
+type countingTokenProvider struct {
+	fakeTokenProvider
+	dir string
+}
+
+func (p *countingTokenProvider) MintToken() (internal.Token, error) {
+	f, err := os.OpenFile(filepath.Join(p.dir, "mints"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// Make the refresh slow enough for the other processes to race with it.
+	time.Sleep(50 * time.Millisecond)
+	if _, err := f.Write([]byte("x")); err != nil {
+		return nil, err
+	}
+	return &fakeToken{}, nil
+}
+
 type fakeTokenProvider struct {
 	interactive      bool
 	tokenToMint      internal.Token
@@ -228,3 +576,48 @@ func (t *fakeToken) Equals(another internal.Token) bool {
 
 func (t *fakeToken) RequestHeaders() map[string]string { return make(map[string]string) }
 func (t *fakeToken) Expired() bool                     { return t.expired }
+
+// expiringTokenProvider mints tokens named "tok<N>" whose lifetimes are taken
+// in order from lifetimes; the last lifetime is reused once exhausted.
+type expiringTokenProvider struct {
+	lifetimes []time.Duration
+	minted    int
+}
+
+func (p *expiringTokenProvider) RequiresInteraction() bool {
+	return false
+}
+
+func (p *expiringTokenProvider) MintToken() (internal.Token, error) {
+	lifetime := p.lifetimes[len(p.lifetimes)-1]
+	if p.minted < len(p.lifetimes) {
+		lifetime = p.lifetimes[p.minted]
+	}
+	tok := internal.NewToken(&oauth2.Token{
+		AccessToken:  fmt.Sprintf("tok%d", p.minted),
+		RefreshToken: "secret",
+		Expiry:       time.Now().Add(lifetime),
+	})
+	p.minted++
+	return tok, nil
+}
+
+func (p *expiringTokenProvider) RefreshToken(internal.Token) (internal.Token, error) {
+	return p.MintToken()
+}
+
+func (p *expiringTokenProvider) MarshalToken(tok internal.Token) ([]byte, error) {
+	t, err := internal.ExtractToken(tok)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(t)
+}
+
+func (p *expiringTokenProvider) UnmarshalToken(buf []byte) (internal.Token, error) {
+	t := &oauth2.Token{}
+	if err := json.Unmarshal(buf, t); err != nil {
+		return nil, err
+	}
+	return internal.NewToken(t), nil
+}
@@ -5,10 +5,13 @@
 package auth
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/maruel/subcommands"
 )
@@ -17,11 +20,19 @@ import (
 type Flags struct {
 	defaults           Options
 	serviceAccountJSON string
+	deviceLogin        bool
+	useIDToken         bool
+	audience           string
+	impersonate        string
 }
 
 // Register adds auth related flags to a FlagSet.
 func (fl *Flags) Register(f *flag.FlagSet) {
 	f.StringVar(&fl.serviceAccountJSON, "service-account-json", "", "Path to JSON file with service account credentials to use.")
+	f.BoolVar(&fl.deviceLogin, "device-login", false, "Login by entering a code on a web page opened on any machine, e.g. when connected over SSH.")
+	f.BoolVar(&fl.useIDToken, "use-id-token", false, "Authenticate with OpenID Connect ID tokens instead of access tokens.")
+	f.StringVar(&fl.audience, "audience", "", "Audience of the ID tokens, required with service accounts. Implies -use-id-token.")
+	f.StringVar(&fl.impersonate, "impersonate", "", "Email of a service account to act as, using the other credentials to mint its tokens.")
 }
 
 // Options return instance of Options struct with values set accordingly to
@@ -32,9 +43,37 @@ func (fl *Flags) Options() (Options, error) {
 		opts.Method = ServiceAccountMethod
 		opts.ServiceAccountJSONPath = fl.serviceAccountJSON
 	}
+	if fl.deviceLogin {
+		opts.UseDeviceFlow = true
+	}
+	if fl.useIDToken || fl.audience != "" {
+		opts.UseIDToken = true
+	}
+	if fl.audience != "" {
+		opts.Audience = fl.audience
+	}
+	if fl.impersonate != "" {
+		if opts.Method != ImpersonationMethod {
+			opts.BaseMethod = opts.Method
+			opts.Method = ImpersonationMethod
+		}
+		opts.ImpersonateServiceAccount = fl.impersonate
+	}
 	return opts, nil
 }
 
+// scopesFlag is a flag.Value holding a space separated list of OAuth scopes.
+type scopesFlag []string
+
+func (s *scopesFlag) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *scopesFlag) Set(value string) error {
+	*s = strings.Fields(value)
+	return nil
+}
+
 // SubcommandLogin returns subcommands.Command that can be used to perform
 // interactive login.
 func SubcommandLogin(opts Options, name string) *subcommands.Command {
@@ -115,11 +154,15 @@ func SubcommandInfo(opts Options, name string) *subcommands.Command {
 	return &subcommands.Command{
 		UsageLine: name,
 		ShortDesc: "prints an email address associated with currently cached token",
-		LongDesc:  "Prints an email address associated with currently cached token",
+		LongDesc: `Prints an email address associated with currently cached token.
+
+Also prints the authentication method in use, the scopes, the path of the
+token cache and the state of the cached token.`,
 		CommandRun: func() subcommands.CommandRun {
-			c := &infoRun{}
+			c := &infoRun{scopes: opts.Scopes}
 			c.flags.defaults = opts
 			c.flags.Register(&c.Flags)
+			c.Flags.Var(&c.scopes, "scopes", "Space separated list of OAuth scopes of the token.")
 			return c
 		},
 	}
@@ -127,7 +170,8 @@ func SubcommandInfo(opts Options, name string) *subcommands.Command {
 
 type infoRun struct {
 	subcommands.CommandRunBase
-	flags Flags
+	flags  Flags
+	scopes scopesFlag
 }
 
 func (c *infoRun) Run(a subcommands.Application, args []string) int {
@@ -136,7 +180,13 @@ func (c *infoRun) Run(a subcommands.Application, args []string) int {
 		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 		return 1
 	}
-	client, err := AuthenticatedClient(SilentLogin, NewAuthenticator(opts))
+	opts.Scopes = c.scopes
+	auth := NewAuthenticator(opts)
+	if err = reportInfo(auth.(*authenticatorImpl)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 3
+	}
+	client, err := AuthenticatedClient(SilentLogin, auth)
 	if err == ErrLoginRequired {
 		fmt.Fprintln(os.Stderr, "Not logged in")
 		return 2
@@ -151,6 +201,38 @@ func (c *infoRun) Run(a subcommands.Application, args []string) int {
 	return 0
 }
 
+// reportInfo prints the configuration of the authenticator and the state of
+// its cached token.
+func reportInfo(a *authenticatorImpl) error {
+	info, err := a.info()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Method: %s\n", info.Method)
+	if info.Impersonated != "" {
+		fmt.Printf("Impersonating: %s\n", info.Impersonated)
+	}
+	fmt.Printf("Scopes: %s\n", strings.Join(info.Scopes, " "))
+	if info.CachePath != "" {
+		fmt.Printf("Cache: %s\n", info.CachePath)
+	} else {
+		fmt.Printf("Cache: none, tokens are kept in memory\n")
+	}
+	switch {
+	case !info.HasToken:
+		fmt.Printf("Token: none\n")
+	case info.Expiry.IsZero():
+		fmt.Printf("Token: no known expiration\n")
+	default:
+		left := info.Expiry.Sub(time.Now()) / time.Second * time.Second
+		fmt.Printf("Token: expires at %s (in %s)\n", info.Expiry.Format(time.RFC3339), left)
+	}
+	if info.HasToken {
+		fmt.Printf("Refresh pending: %t\n", info.Expired)
+	}
+	return nil
+}
+
 // reportIdentity prints identity associated with credentials that the client
 // puts into each request (if any).
 func reportIdentity(c *http.Client) error {
@@ -163,3 +245,79 @@ func reportIdentity(c *http.Client) error {
 	fmt.Printf("Logged in to %s as %s\n", service.ServiceURL(), ident)
 	return nil
 }
+
+// SubcommandToken returns subcommand.Command that can be used to print an
+// access token, e.g. to use it in scripts.
+func SubcommandToken(opts Options, name string) *subcommands.Command {
+	return &subcommands.Command{
+		UsageLine: name,
+		ShortDesc: "prints an access token",
+		LongDesc: `Prints an access token for the given scopes, refreshing the cached one if
+needed. The token is valid for at least -lifetime.
+
+With -use-id-token, prints an ID token instead.`,
+		CommandRun: func() subcommands.CommandRun {
+			c := &tokenRun{scopes: opts.Scopes}
+			c.flags.defaults = opts
+			c.flags.Register(&c.Flags)
+			c.Flags.Var(&c.scopes, "scopes", "Space separated list of OAuth scopes of the token.")
+			c.Flags.DurationVar(&c.lifetime, "lifetime", time.Minute, "Minimum lifetime of the token, up to 30m.")
+			c.Flags.BoolVar(&c.jsonOutput, "json", false, "Print the token and its expiration time as JSON.")
+			return c
+		},
+	}
+}
+
+type tokenRun struct {
+	subcommands.CommandRunBase
+	flags      Flags
+	scopes     scopesFlag
+	lifetime   time.Duration
+	jsonOutput bool
+}
+
+// tokenOutput is printed by the token subcommand when -json is used.
+type tokenOutput struct {
+	AccessToken string `json:"token"`
+	Expiry      int64  `json:"expiry,omitempty"`
+}
+
+func (c *tokenRun) Run(a subcommands.Application, args []string) int {
+	opts, err := c.flags.Options()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+	if c.lifetime < 0 || c.lifetime > 30*time.Minute {
+		fmt.Fprintln(os.Stderr, "-lifetime must be between 0 and 30m")
+		return 1
+	}
+	opts.Scopes = c.scopes
+	tok, err := NewAuthenticator(opts).GetAccessToken(c.lifetime)
+	if err == ErrLoginRequired {
+		fmt.Fprintln(os.Stderr, "Not logged in")
+		return 2
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 3
+	}
+	value := tok.AccessToken
+	if opts.UseIDToken {
+		value, _ = tok.Extra("id_token").(string)
+	}
+	if !c.jsonOutput {
+		fmt.Println(value)
+		return 0
+	}
+	out := &tokenOutput{AccessToken: value}
+	if !tok.Expiry.IsZero() {
+		out.Expiry = tok.Expiry.Unix()
+	}
+	buf, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 3
+	}
+	fmt.Println(string(buf))
+	return 0
+}
@@ -19,6 +19,7 @@ import (
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jws"
 )
 
 // ErrInsufficientAccess is can't be minted for given OAuth scopes. For example
@@ -78,9 +79,12 @@ func TransportFromContext(ctx context.Context) http.RoundTripper {
 
 ///////////////////////////////////////////////////////////////////////////////
 
-// tokenImpl implements Token interface by adapting oauth2.Token.
+// tokenImpl implements Token interface by adapting oauth2.Token. If IDToken is
+// set, it is put in the requests instead of the access token, which may then be
+// empty, and Expiry is the earliest expiration time of the two.
 type tokenImpl struct {
 	oauth2.Token
+	IDToken string
 }
 
 // makeToken builds Token from oauth2.Token by copying it.
@@ -90,6 +94,43 @@ func makeToken(tok *oauth2.Token) Token {
 	}
 }
 
+// makeIDToken builds Token from oauth2.Token and an OpenID Connect ID token
+// minted with it. The expiration time is read from the ID token.
+func makeIDToken(tok *oauth2.Token, idToken string) (Token, error) {
+	claims, err := jws.Decode(idToken)
+	if err != nil {
+		return nil, fmt.Errorf("auth: bad ID token: %s", err)
+	}
+	t := &tokenImpl{Token: *tok, IDToken: idToken}
+	if claims.Exp != 0 {
+		expiry := time.Unix(claims.Exp, 0)
+		if t.Expiry.IsZero() || expiry.Before(t.Expiry) {
+			t.Expiry = expiry
+		}
+	}
+	return t, nil
+}
+
+// NewToken returns a Token holding the OAuth token tok.
+func NewToken(tok *oauth2.Token) Token {
+	return makeToken(tok)
+}
+
+// ExtractToken returns a copy of the OAuth token held by tok. The ID token, if
+// any, is available as the "id_token" extra field. It fails if tok wasn't
+// created by this package.
+func ExtractToken(tok Token) (*oauth2.Token, error) {
+	t, ok := tok.(*tokenImpl)
+	if !ok {
+		return nil, fmt.Errorf("auth: unexpected token type %T", tok)
+	}
+	out := t.Token
+	if t.IDToken != "" {
+		return out.WithExtra(map[string]interface{}{"id_token": t.IDToken}), nil
+	}
+	return &out, nil
+}
+
 // extractOAuthToken takes Token, checks its type and return oauth2.Token.
 // It returns a copy that can be safely mutated.
 func extractOAuthToken(tok Token) oauth2.Token {
@@ -105,11 +146,11 @@ func (t *tokenImpl) Equals(another Token) bool {
 	if !ok {
 		return false
 	}
-	return t.AccessToken == casted.AccessToken
+	return t.AccessToken == casted.AccessToken && t.IDToken == casted.IDToken
 }
 
 func (t *tokenImpl) Expired() bool {
-	if t.AccessToken == "" {
+	if t.AccessToken == "" && t.IDToken == "" {
 		return true
 	}
 	if t.Expiry.IsZero() {
@@ -122,7 +163,9 @@ func (t *tokenImpl) Expired() bool {
 
 func (t *tokenImpl) RequestHeaders() map[string]string {
 	ret := make(map[string]string)
-	if t.AccessToken != "" {
+	if t.IDToken != "" {
+		ret["Authorization"] = "Bearer " + t.IDToken
+	} else if t.AccessToken != "" {
 		ret["Authorization"] = "Bearer " + t.AccessToken
 	}
 	return ret
@@ -132,10 +175,12 @@ func (t *tokenImpl) RequestHeaders() map[string]string {
 
 // oauthTokenProvider partially implements a TokenProvider built on top of oauth
 // library. Concrete implementations embed this struct and provide missing
-// MintToken and RefreshToken methods.
+// MintToken and RefreshToken methods. If useIDToken is true, the tokens must
+// have an ID token, which is used instead of the access token.
 type oauthTokenProvider struct {
 	interactive bool
 	tokenFlavor string
+	useIDToken  bool
 }
 
 type tokenOnDisk struct {
@@ -143,6 +188,7 @@ type tokenOnDisk struct {
 	Flavor       string `json:"flavor"`
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
 	ExpiresAtSec int64  `json:"expires_at,omitempty"`
 }
 
@@ -152,13 +198,28 @@ func (p *oauthTokenProvider) RequiresInteraction() bool {
 	return p.interactive
 }
 
+// makeToken builds Token from a token returned by the oauth library, keeping
+// its ID token if the provider uses ID tokens.
+func (p *oauthTokenProvider) makeToken(tok *oauth2.Token) (Token, error) {
+	if !p.useIDToken {
+		return makeToken(tok), nil
+	}
+	idToken, _ := tok.Extra("id_token").(string)
+	if idToken == "" {
+		return nil, errors.New("auth: no ID token returned, the openid or email scope is required")
+	}
+	return makeIDToken(tok, idToken)
+}
+
 func (p *oauthTokenProvider) MarshalToken(t Token) ([]byte, error) {
-	tok := extractOAuthToken(t)
+	// It's OK to panic here on type mismatch.
+	tok := t.(*tokenImpl)
 	return json.Marshal(&tokenOnDisk{
 		Version:      tokFormatVersion,
 		Flavor:       p.tokenFlavor,
 		AccessToken:  tok.AccessToken,
 		RefreshToken: tok.RefreshToken,
+		IDToken:      tok.IDToken,
 		ExpiresAtSec: tok.Expiry.Unix(),
 	})
 }
@@ -174,9 +235,15 @@ func (p *oauthTokenProvider) UnmarshalToken(data []byte) (Token, error) {
 	if onDisk.Flavor != p.tokenFlavor {
 		return nil, fmt.Errorf("auth: bad token flavor %q, expected %q", onDisk.Flavor, p.tokenFlavor)
 	}
-	return makeToken(&oauth2.Token{
-		AccessToken:  onDisk.AccessToken,
-		RefreshToken: onDisk.RefreshToken,
-		Expiry:       time.Unix(onDisk.ExpiresAtSec, 0),
-	}), nil
+	if p.useIDToken && onDisk.IDToken == "" {
+		return nil, errors.New("auth: no ID token in the cached token")
+	}
+	return &tokenImpl{
+		Token: oauth2.Token{
+			AccessToken:  onDisk.AccessToken,
+			RefreshToken: onDisk.RefreshToken,
+			Expiry:       time.Unix(onDisk.ExpiresAtSec, 0),
+		},
+		IDToken: onDisk.IDToken,
+	}, nil
 }
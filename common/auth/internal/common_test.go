@@ -0,0 +1,102 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jws"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+// getTestKey returns a RSA key generated once per test run.
+func getTestKey() *rsa.PrivateKey {
+	testKeyOnce.Do(func() {
+		var err error
+		if testKey, err = rsa.GenerateKey(rand.Reader, 1024); err != nil {
+			panic(err)
+		}
+	})
+	return testKey
+}
+
+// fakeIDToken returns a signed ID token for audience expiring at exp.
+func fakeIDToken(audience string, exp time.Time) string {
+	tok, err := jws.Encode(&jws.Header{Algorithm: "RS256", Typ: "JWT"}, &jws.ClaimSet{
+		Iss: "https://accounts.example.com",
+		Aud: audience,
+		Iat: exp.Add(-time.Hour).Unix(),
+		Exp: exp.Unix(),
+	}, getTestKey())
+	if err != nil {
+		panic(err)
+	}
+	return tok
+}
+
+func TestIDToken(t *testing.T) {
+	Convey("Given an ID token", t, func() {
+		now := time.Now().Truncate(time.Second)
+		idToken := fakeIDToken("audience", now.Add(30*time.Minute))
+
+		Convey("Test it is used in requests", func() {
+			tok, err := makeIDToken(&oauth2.Token{AccessToken: "access"}, idToken)
+			So(err, ShouldBeNil)
+			So(tok.RequestHeaders(), ShouldResemble, map[string]string{"Authorization": "Bearer " + idToken})
+			So(tok.Expired(), ShouldBeFalse)
+			So(tok.Equals(makeToken(&oauth2.Token{AccessToken: "access"})), ShouldBeFalse)
+
+			t, err := ExtractToken(tok)
+			So(err, ShouldBeNil)
+			So(t.Extra("id_token"), ShouldEqual, idToken)
+		})
+
+		Convey("Test expiry is the earliest one", func() {
+			tok, err := makeIDToken(&oauth2.Token{AccessToken: "access", Expiry: now.Add(time.Hour)}, idToken)
+			So(err, ShouldBeNil)
+			So(tok.(*tokenImpl).Expiry, ShouldResemble, time.Unix(now.Add(30*time.Minute).Unix(), 0))
+			tok, err = makeIDToken(&oauth2.Token{AccessToken: "access", Expiry: now.Add(10 * time.Minute)}, idToken)
+			So(err, ShouldBeNil)
+			So(tok.(*tokenImpl).Expiry, ShouldResemble, now.Add(10*time.Minute))
+			tok, err = makeIDToken(&oauth2.Token{}, fakeIDToken("audience", now.Add(-time.Hour)))
+			So(err, ShouldBeNil)
+			So(tok.Expired(), ShouldBeTrue)
+		})
+
+		Convey("Test it is cached", func() {
+			p := &oauthTokenProvider{tokenFlavor: "test", useIDToken: true}
+			tok, err := makeIDToken(&oauth2.Token{}, idToken)
+			So(err, ShouldBeNil)
+			buf, err := p.MarshalToken(tok)
+			So(err, ShouldBeNil)
+			cached, err := p.UnmarshalToken(buf)
+			So(err, ShouldBeNil)
+			So(cached.Equals(tok), ShouldBeTrue)
+			So(cached.Expired(), ShouldBeFalse)
+
+			// Access tokens cached without ID token are rejected.
+			buf, err = p.MarshalToken(makeToken(&oauth2.Token{AccessToken: "access"}))
+			So(err, ShouldBeNil)
+			_, err = p.UnmarshalToken(buf)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Test bad ID token", func() {
+			_, err := makeIDToken(&oauth2.Token{}, "garbage")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,216 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// deviceGrantType is the grant_type of the OAuth device authorization grant,
+// see RFC 8628.
+const deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// defaultDeviceInterval is used when the server doesn't specify how often the
+// token endpoint can be polled.
+const defaultDeviceInterval = 5 * time.Second
+
+// deviceEndpoint is the set of URLs used by the device flow.
+type deviceEndpoint struct {
+	DeviceURL string
+	TokenURL  string
+}
+
+var googleDeviceEndpoint = deviceEndpoint{
+	DeviceURL: "https://accounts.google.com/o/oauth2/device/code",
+	TokenURL:  "https://accounts.google.com/o/oauth2/token",
+}
+
+// deviceCodeResponse is the reply of the device authorization endpoint. Google
+// uses verification_url instead of verification_uri.
+type deviceCodeResponse struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	VerificationURL string `json:"verification_url"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+// deviceTokenResponse is the reply of the token endpoint, either a token or an
+// error.
+type deviceTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	IDToken      string `json:"id_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	Error        string `json:"error"`
+}
+
+// deviceSleep waits for d or until ctx is canceled. It is mocked in tests.
+var deviceSleep = func(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// deviceAuthTokenProvider mints user tokens with the OAuth device flow: the
+// user opens a URL on any machine and enters a code there, while the tool
+// polls the token endpoint. It doesn't need a browser nor a terminal on the
+// machine running the tool. Refreshing is the same as for
+// userAuthTokenProvider, so both share the same token flavor.
+type deviceAuthTokenProvider struct {
+	userAuthTokenProvider
+
+	deviceURL string
+	out       io.Writer
+}
+
+// NewDeviceAuthTokenProvider returns TokenProvider that performs the OAuth
+// device flow involving interaction with a user on any machine. If useIDToken
+// is true, the tokens carry ID tokens whose audience is clientID.
+func NewDeviceAuthTokenProvider(ctx context.Context, clientID, clientSecret string, scopes []string, useIDToken bool) (TokenProvider, error) {
+	return newDeviceAuthTokenProvider(ctx, clientID, clientSecret, scopes, useIDToken, googleDeviceEndpoint, os.Stdout), nil
+}
+
+func newDeviceAuthTokenProvider(ctx context.Context, clientID, clientSecret string, scopes []string, useIDToken bool, e deviceEndpoint, out io.Writer) *deviceAuthTokenProvider {
+	return &deviceAuthTokenProvider{
+		userAuthTokenProvider: userAuthTokenProvider{
+			oauthTokenProvider: oauthTokenProvider{
+				interactive: true,
+				tokenFlavor: "user",
+				useIDToken:  useIDToken,
+			},
+			ctx: ctx,
+			config: &oauth2.Config{
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+				Endpoint:     oauth2.Endpoint{TokenURL: e.TokenURL},
+				Scopes:       scopes,
+			},
+		},
+		deviceURL: e.DeviceURL,
+		out:       out,
+	}
+}
+
+func (p *deviceAuthTokenProvider) MintToken() (Token, error) {
+	code := deviceCodeResponse{}
+	err := p.post(p.deviceURL, url.Values{
+		"client_id": {p.config.ClientID},
+		"scope":     {strings.Join(p.config.Scopes, " ")},
+	}, &code)
+	if err != nil {
+		return nil, fmt.Errorf("auth: failed to get a device code: %s", err)
+	}
+	if code.DeviceCode == "" || code.UserCode == "" {
+		return nil, errors.New("auth: no device code returned")
+	}
+	verificationURL := code.VerificationURI
+	if verificationURL == "" {
+		verificationURL = code.VerificationURL
+	}
+	fmt.Fprintf(p.out, "Visit the URL below on any machine and enter the code %s.\n\n%s\n\n", code.UserCode, verificationURL)
+	fmt.Fprintf(p.out, "Waiting for the authorization...\n")
+
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultDeviceInterval
+	}
+	var deadline time.Time
+	if code.ExpiresIn > 0 {
+		deadline = time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	}
+	for {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return nil, errors.New("auth: the device code expired")
+		}
+		if err := deviceSleep(p.ctx, interval); err != nil {
+			return nil, err
+		}
+		tok, oauthErr, err := p.pollToken(code.DeviceCode)
+		switch oauthErr {
+		case "":
+			if err != nil {
+				return nil, fmt.Errorf("auth: device login failed: %s", err)
+			}
+			return p.makeToken(tok)
+		case "authorization_pending":
+		case "slow_down":
+			interval += defaultDeviceInterval
+		default:
+			return nil, fmt.Errorf("auth: device login failed: %s", oauthErr)
+		}
+	}
+}
+
+// pollToken asks the token endpoint whether the user authorized the device.
+// oauthErr is the OAuth error code returned by the server, if any, e.g.
+// "authorization_pending".
+func (p *deviceAuthTokenProvider) pollToken(deviceCode string) (tok *oauth2.Token, oauthErr string, err error) {
+	resp := deviceTokenResponse{}
+	err = p.post(p.config.Endpoint.TokenURL, url.Values{
+		"client_id":     {p.config.ClientID},
+		"client_secret": {p.config.ClientSecret},
+		"device_code":   {deviceCode},
+		"grant_type":    {deviceGrantType},
+	}, &resp)
+	if resp.Error != "" {
+		return nil, resp.Error, nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.AccessToken == "" {
+		return nil, "", errors.New("no access token returned")
+	}
+	tok = &oauth2.Token{
+		AccessToken:  resp.AccessToken,
+		TokenType:    resp.TokenType,
+		RefreshToken: resp.RefreshToken,
+	}
+	if resp.ExpiresIn > 0 {
+		tok.Expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	}
+	if resp.IDToken != "" {
+		tok = tok.WithExtra(map[string]interface{}{"id_token": resp.IDToken})
+	}
+	return tok, "", nil
+}
+
+// post sends a form to urlStr and decodes the JSON reply into out. The reply
+// is decoded even on HTTP errors since it describes the error.
+func (p *deviceAuthTokenProvider) post(urlStr string, form url.Values, out interface{}) error {
+	client := &http.Client{Transport: TransportFromContext(p.ctx)}
+	resp, err := client.PostForm(urlStr, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	decodeErr := json.Unmarshal(body, out)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return decodeErr
+}
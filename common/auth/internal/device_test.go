@@ -0,0 +1,191 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeOAuthServer implements the device authorization and token endpoints.
+// The token endpoint replies with the OAuth errors in pollErrors, in order,
+// before returning a token.
+type fakeOAuthServer struct {
+	*httptest.Server
+
+	lock       sync.Mutex
+	pollErrors []string
+	polls      int
+}
+
+func newFakeOAuthServer(pollErrors ...string) *fakeOAuthServer {
+	s := &fakeOAuthServer{pollErrors: pollErrors}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device", s.device)
+	mux.HandleFunc("/token", s.token)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *fakeOAuthServer) endpoint() deviceEndpoint {
+	return deviceEndpoint{DeviceURL: s.URL + "/device", TokenURL: s.URL + "/token"}
+}
+
+func (s *fakeOAuthServer) reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *fakeOAuthServer) device(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("client_id") != "client" || r.FormValue("scope") != "a b" {
+		s.reply(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	s.reply(w, http.StatusOK, map[string]interface{}{
+		"device_code":      "device",
+		"user_code":        "ABCD-EFGH",
+		"verification_url": "https://example.com/device",
+		"expires_in":       1800,
+		"interval":         1,
+	})
+}
+
+func (s *fakeOAuthServer) token(w http.ResponseWriter, r *http.Request) {
+	switch r.FormValue("grant_type") {
+	case deviceGrantType:
+		if r.FormValue("device_code") != "device" {
+			s.reply(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		s.lock.Lock()
+		poll := s.polls
+		s.polls++
+		s.lock.Unlock()
+		if poll < len(s.pollErrors) {
+			s.reply(w, http.StatusBadRequest, map[string]string{"error": s.pollErrors[poll]})
+			return
+		}
+		s.reply(w, http.StatusOK, map[string]interface{}{
+			"access_token":  "minted",
+			"token_type":    "Bearer",
+			"refresh_token": "refresh",
+			"id_token":      fakeIDToken("client", time.Now().Add(time.Hour)),
+			"expires_in":    3600,
+		})
+	case "refresh_token":
+		if r.FormValue("refresh_token") != "refresh" {
+			s.reply(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		s.reply(w, http.StatusOK, map[string]interface{}{
+			"access_token": "refreshed",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	default:
+		s.reply(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+	}
+}
+
+func TestDeviceAuthTokenProvider(t *testing.T) {
+	Convey("Given a fake OAuth server", t, func() {
+		var sleeps []time.Duration
+		prev := deviceSleep
+		deviceSleep = func(ctx context.Context, d time.Duration) error {
+			sleeps = append(sleeps, d)
+			return nil
+		}
+		Reset(func() {
+			deviceSleep = prev
+		})
+		ctx := context.Background()
+		out := &bytes.Buffer{}
+
+		Convey("Test token is minted once authorized", func() {
+			s := newFakeOAuthServer("authorization_pending", "slow_down", "authorization_pending")
+			defer s.Close()
+			p := newDeviceAuthTokenProvider(ctx, "client", "secret", []string{"a", "b"}, false, s.endpoint(), out)
+			So(p.RequiresInteraction(), ShouldBeTrue)
+
+			tok, err := p.MintToken()
+			So(err, ShouldBeNil)
+			minted := extractOAuthToken(tok)
+			So(minted.AccessToken, ShouldEqual, "minted")
+			So(minted.RefreshToken, ShouldEqual, "refresh")
+			So(minted.Expiry.After(time.Now().Add(50*time.Minute)), ShouldBeTrue)
+			So(sleeps, ShouldResemble, []time.Duration{time.Second, time.Second, 6 * time.Second, 6 * time.Second})
+			So(out.String(), ShouldContainSubstring, "ABCD-EFGH")
+			So(out.String(), ShouldContainSubstring, "https://example.com/device")
+
+			Convey("Test token is refreshed and cached as a user token", func() {
+				tok, err = p.RefreshToken(tok)
+				So(err, ShouldBeNil)
+				So(extractOAuthToken(tok).AccessToken, ShouldEqual, "refreshed")
+
+				buf, err := p.MarshalToken(tok)
+				So(err, ShouldBeNil)
+				user, err := NewUserAuthTokenProvider(ctx, "client", "secret", []string{"a", "b"}, false)
+				So(err, ShouldBeNil)
+				tok, err = user.UnmarshalToken(buf)
+				So(err, ShouldBeNil)
+				So(extractOAuthToken(tok).AccessToken, ShouldEqual, "refreshed")
+			})
+		})
+
+		Convey("Test ID token is kept", func() {
+			s := newFakeOAuthServer()
+			defer s.Close()
+			p := newDeviceAuthTokenProvider(ctx, "client", "secret", []string{"a", "b"}, true, s.endpoint(), out)
+			tok, err := p.MintToken()
+			So(err, ShouldBeNil)
+			So(tok.(*tokenImpl).IDToken, ShouldNotEqual, "")
+			So(tok.RequestHeaders()["Authorization"], ShouldEqual, "Bearer "+tok.(*tokenImpl).IDToken)
+
+			// The refreshed token has no ID token.
+			_, err = p.RefreshToken(tok)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Test denied authorization", func() {
+			s := newFakeOAuthServer("authorization_pending", "access_denied")
+			defer s.Close()
+			p := newDeviceAuthTokenProvider(ctx, "client", "secret", []string{"a", "b"}, false, s.endpoint(), out)
+			_, err := p.MintToken()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "access_denied")
+			So(len(sleeps), ShouldEqual, 2)
+		})
+
+		Convey("Test canceled context stops polling", func() {
+			deviceSleep = prev
+			s := newFakeOAuthServer("authorization_pending")
+			defer s.Close()
+			ctx, cancel := context.WithCancel(ctx)
+			cancel()
+			p := newDeviceAuthTokenProvider(ctx, "client", "secret", []string{"a", "b"}, false, s.endpoint(), out)
+			_, err := p.MintToken()
+			So(err, ShouldEqual, context.Canceled)
+		})
+
+		Convey("Test bad device request", func() {
+			s := newFakeOAuthServer()
+			defer s.Close()
+			p := newDeviceAuthTokenProvider(ctx, "other", "secret", []string{"a", "b"}, false, s.endpoint(), out)
+			_, err := p.MintToken()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "invalid_request")
+		})
+	})
+}
@@ -0,0 +1,95 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// generateAccessTokenRequest is the body of a generateAccessToken call.
+type generateAccessTokenRequest struct {
+	Scope []string `json:"scope"`
+}
+
+// generateAccessTokenResponse is the reply of a generateAccessToken call.
+type generateAccessTokenResponse struct {
+	AccessToken string `json:"accessToken"`
+	ExpireTime  string `json:"expireTime"`
+}
+
+type iamTokenProvider struct {
+	oauthTokenProvider
+
+	ctx    context.Context
+	base   http.RoundTripper
+	url    string
+	scopes []string
+}
+
+// NewIAMTokenProvider returns TokenProvider that mints access tokens of the
+// service account by calling generateAccessToken of the IAM credentials
+// service at serviceURL. The calls are authenticated by base, which must carry
+// credentials allowed to act as the service account. interactive is true if
+// base may require a login.
+func NewIAMTokenProvider(ctx context.Context, base http.RoundTripper, interactive bool, serviceURL, account string, scopes []string) (TokenProvider, error) {
+	if account == "" || strings.Contains(account, "/") {
+		return nil, fmt.Errorf("auth: invalid service account %q", account)
+	}
+	return &iamTokenProvider{
+		oauthTokenProvider: oauthTokenProvider{
+			interactive: interactive,
+			tokenFlavor: "iam",
+		},
+		ctx:    ctx,
+		base:   base,
+		url:    fmt.Sprintf("%s/v1/projects/-/serviceAccounts/%s:generateAccessToken", strings.TrimRight(serviceURL, "/"), account),
+		scopes: scopes,
+	}, nil
+}
+
+func (p *iamTokenProvider) MintToken() (Token, error) {
+	body, err := json.Marshal(&generateAccessTokenRequest{Scope: p.scopes})
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: p.base}
+	resp, err := client.Post(p.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("auth: generateAccessToken replied %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	out := generateAccessTokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	if out.AccessToken == "" {
+		return nil, errors.New("auth: generateAccessToken didn't return a token")
+	}
+	expiry, err := time.Parse(time.RFC3339, out.ExpireTime)
+	if err != nil {
+		return nil, fmt.Errorf("auth: bad expiration time from generateAccessToken: %s", err)
+	}
+	return makeToken(&oauth2.Token{AccessToken: out.AccessToken, Expiry: expiry}), nil
+}
+
+func (p *iamTokenProvider) RefreshToken(Token) (Token, error) {
+	// Impersonated tokens have no refresh token, a new one is minted with the
+	// base credentials.
+	return p.MintToken()
+}
@@ -0,0 +1,92 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// headerTransport adds a fixed Authorization header to the requests.
+type headerTransport string
+
+func (h headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	clone := *req
+	clone.Header = http.Header{"Authorization": {string(h)}}
+	for k, v := range req.Header {
+		clone.Header[k] = v
+	}
+	return http.DefaultTransport.RoundTrip(&clone)
+}
+
+func TestIAMTokenProvider(t *testing.T) {
+	Convey("Given a fake IAM credentials service", t, func() {
+		expiry := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+		var scopes []string
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer base" {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			const prefix = "/v1/projects/-/serviceAccounts/"
+			if r.Method != "POST" || !strings.HasPrefix(r.URL.Path, prefix) || !strings.HasSuffix(r.URL.Path, ":generateAccessToken") {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			account := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, prefix), ":generateAccessToken")
+			req := generateAccessTokenRequest{}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			scopes = req.Scope
+			_ = json.NewEncoder(w).Encode(&generateAccessTokenResponse{
+				AccessToken: "token for " + account,
+				ExpireTime:  expiry.Format(time.RFC3339),
+			})
+		}))
+		defer s.Close()
+		ctx := context.Background()
+
+		Convey("Test token is minted for the service account", func() {
+			p, err := NewIAMTokenProvider(ctx, headerTransport("Bearer base"), false, s.URL+"/", "robot@example.com", []string{"a", "b"})
+			So(err, ShouldBeNil)
+			So(p.RequiresInteraction(), ShouldBeFalse)
+			tok, err := p.MintToken()
+			So(err, ShouldBeNil)
+			So(scopes, ShouldResemble, []string{"a", "b"})
+			t := extractOAuthToken(tok)
+			So(t.AccessToken, ShouldEqual, "token for robot@example.com")
+			So(t.Expiry.Equal(expiry), ShouldBeTrue)
+
+			tok, err = p.RefreshToken(tok)
+			So(err, ShouldBeNil)
+			So(extractOAuthToken(tok).AccessToken, ShouldEqual, "token for robot@example.com")
+		})
+
+		Convey("Test base credentials are denied", func() {
+			p, err := NewIAMTokenProvider(ctx, headerTransport("Bearer other"), false, s.URL, "robot@example.com", []string{"a"})
+			So(err, ShouldBeNil)
+			_, err = p.MintToken()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "403")
+		})
+
+		Convey("Test invalid service account", func() {
+			_, err := NewIAMTokenProvider(ctx, headerTransport("Bearer base"), false, s.URL, "", []string{"a"})
+			So(err, ShouldNotBeNil)
+			_, err = NewIAMTokenProvider(ctx, headerTransport("Bearer base"), false, s.URL, "a/b", []string{"a"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
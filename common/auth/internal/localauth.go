@@ -0,0 +1,111 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// LocalAuthRPCPath is the path of the local auth server endpoint serving
+// access tokens.
+const LocalAuthRPCPath = "/rpc/LuciLocalAuthService.GetOAuthToken"
+
+// LocalAuthContext describes how to reach a local auth server. It is passed to
+// child processes as a JSON file.
+type LocalAuthContext struct {
+	RPCPort int    `json:"rpc_port"`
+	Secret  string `json:"secret"`
+}
+
+// LocalAuthRequest is the request sent to the local auth server.
+type LocalAuthRequest struct {
+	Scopes []string `json:"scopes"`
+	Secret string   `json:"secret"`
+}
+
+// LocalAuthResponse is the reply of the local auth server. Expiry is in Unix
+// seconds, 0 if the token doesn't expire.
+type LocalAuthResponse struct {
+	AccessToken string `json:"access_token"`
+	Expiry      int64  `json:"expiry"`
+}
+
+type localAuthTokenProvider struct {
+	oauthTokenProvider
+
+	ctx    context.Context
+	url    string
+	secret string
+	scopes []string
+}
+
+// NewLocalAuthTokenProvider returns TokenProvider that gets tokens from the
+// local auth server described by the JSON file at contextPath.
+func NewLocalAuthTokenProvider(ctx context.Context, contextPath string, scopes []string) (TokenProvider, error) {
+	buf, err := ioutil.ReadFile(contextPath)
+	if err != nil {
+		return nil, err
+	}
+	lc := LocalAuthContext{}
+	if err := json.Unmarshal(buf, &lc); err != nil {
+		return nil, fmt.Errorf("auth: bad local auth context %s: %s", contextPath, err)
+	}
+	if lc.RPCPort == 0 || lc.Secret == "" {
+		return nil, fmt.Errorf("auth: incomplete local auth context %s", contextPath)
+	}
+	return &localAuthTokenProvider{
+		oauthTokenProvider: oauthTokenProvider{
+			interactive: false,
+			tokenFlavor: "local_auth",
+		},
+		ctx:    ctx,
+		url:    fmt.Sprintf("http://127.0.0.1:%d%s", lc.RPCPort, LocalAuthRPCPath),
+		secret: lc.Secret,
+		scopes: scopes,
+	}, nil
+}
+
+func (p *localAuthTokenProvider) MintToken() (Token, error) {
+	body, err := json.Marshal(&LocalAuthRequest{Scopes: p.scopes, Secret: p.secret})
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: TransportFromContext(p.ctx)}
+	resp, err := client.Post(p.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("auth: local auth server replied %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	out := LocalAuthResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	if out.AccessToken == "" {
+		return nil, errors.New("auth: local auth server didn't return a token")
+	}
+	tok := &oauth2.Token{AccessToken: out.AccessToken}
+	if out.Expiry != 0 {
+		tok.Expiry = time.Unix(out.Expiry, 0)
+	}
+	return makeToken(tok), nil
+}
+
+func (p *localAuthTokenProvider) RefreshToken(Token) (Token, error) {
+	// The local auth server refreshes the token as needed.
+	return p.MintToken()
+}
@@ -5,10 +5,22 @@
 package internal
 
 import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jws"
 	"golang.org/x/oauth2/jwt"
 )
 
@@ -53,3 +65,112 @@ func (p *serviceAccountTokenProvider) RefreshToken(Token) (Token, error) {
 	// a token and "refreshing" it is a same thing.
 	return p.MintToken()
 }
+
+type serviceAccountIDTokenProvider struct {
+	oauthTokenProvider
+
+	ctx      context.Context
+	config   *jwt.Config
+	key      *rsa.PrivateKey
+	audience string
+}
+
+// NewServiceAccountIDTokenProvider returns TokenProvider that mints ID tokens
+// for the given audience by exchanging a JWT signed by the service account.
+func NewServiceAccountIDTokenProvider(ctx context.Context, credsPath, audience string) (TokenProvider, error) {
+	buf, err := ioutil.ReadFile(credsPath)
+	if err != nil {
+		return nil, err
+	}
+	config, err := google.JWTConfigFromJSON(buf)
+	if err != nil {
+		return nil, err
+	}
+	return newServiceAccountIDTokenProvider(ctx, config, audience)
+}
+
+func newServiceAccountIDTokenProvider(ctx context.Context, config *jwt.Config, audience string) (*serviceAccountIDTokenProvider, error) {
+	if audience == "" {
+		return nil, errors.New("auth: an audience is required to mint ID tokens")
+	}
+	key, err := parseKey(config.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &serviceAccountIDTokenProvider{
+		oauthTokenProvider: oauthTokenProvider{
+			interactive: false,
+			tokenFlavor: "service_account",
+			useIDToken:  true,
+		},
+		ctx:      ctx,
+		config:   config,
+		key:      key,
+		audience: audience,
+	}, nil
+}
+
+func (p *serviceAccountIDTokenProvider) MintToken() (Token, error) {
+	now := time.Now()
+	assertion, err := jws.Encode(&jws.Header{Algorithm: "RS256", Typ: "JWT"}, &jws.ClaimSet{
+		Iss:           p.config.Email,
+		Aud:           p.config.TokenURL,
+		Iat:           now.Unix(),
+		Exp:           now.Add(time.Hour).Unix(),
+		PrivateClaims: map[string]interface{}{"target_audience": p.audience},
+	}, p.key)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: TransportFromContext(p.ctx)}
+	resp, err := client.PostForm(p.config.TokenURL, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth: failed to mint an ID token: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	out := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return nil, err
+	}
+	if out.IDToken == "" {
+		return nil, errors.New("auth: no ID token returned")
+	}
+	return makeIDToken(&oauth2.Token{}, out.IDToken)
+}
+
+func (p *serviceAccountIDTokenProvider) RefreshToken(Token) (Token, error) {
+	// Like the access tokens of service accounts, ID tokens are minted again.
+	return p.MintToken()
+}
+
+// parseKey parses a PEM encoded RSA private key, in PKCS8 or PKCS1 format.
+func parseKey(buf []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(buf)
+	if block != nil {
+		buf = block.Bytes
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(buf); err == nil {
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("auth: the private key is not a RSA key")
+		}
+		return rsaKey, nil
+	}
+	key, err := x509.ParsePKCS1PrivateKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("auth: bad private key: %s", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/jws"
+	"golang.org/x/oauth2/jwt"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestServiceAccountIDTokenProvider(t *testing.T) {
+	Convey("Given a fake token endpoint", t, func() {
+		expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+		idToken := fakeIDToken("https://backend.example.com", expiry)
+		var claims *jws.ClaimSet
+		var audience string
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assertion := r.FormValue("assertion")
+			if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || jws.Verify(assertion, &getTestKey().PublicKey) != nil {
+				http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+			claims, _ = jws.Decode(assertion)
+			// jws.Decode drops the private claims.
+			payload, _ := base64.RawURLEncoding.DecodeString(strings.Split(assertion, ".")[1])
+			private := struct {
+				TargetAudience string `json:"target_audience"`
+			}{}
+			_ = json.Unmarshal(payload, &private)
+			audience = private.TargetAudience
+			_ = json.NewEncoder(w).Encode(map[string]string{"id_token": idToken})
+		}))
+		defer s.Close()
+
+		key := pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(getTestKey()),
+		})
+		config := &jwt.Config{
+			Email:      "account@example.com",
+			PrivateKey: key,
+			TokenURL:   s.URL,
+		}
+
+		Convey("Test ID token is minted for the audience", func() {
+			p, err := newServiceAccountIDTokenProvider(context.Background(), config, "https://backend.example.com")
+			So(err, ShouldBeNil)
+			tok, err := p.MintToken()
+			So(err, ShouldBeNil)
+			So(claims.Iss, ShouldEqual, "account@example.com")
+			So(claims.Aud, ShouldEqual, s.URL)
+			So(audience, ShouldEqual, "https://backend.example.com")
+			So(tok.RequestHeaders()["Authorization"], ShouldEqual, "Bearer "+idToken)
+			So(tok.(*tokenImpl).Expiry, ShouldResemble, expiry)
+			So(tok.Expired(), ShouldBeFalse)
+		})
+
+		Convey("Test bad key is rejected by the server", func() {
+			other, err := rsa.GenerateKey(rand.Reader, 1024)
+			So(err, ShouldBeNil)
+			config.PrivateKey = pem.EncodeToMemory(&pem.Block{
+				Type:  "RSA PRIVATE KEY",
+				Bytes: x509.MarshalPKCS1PrivateKey(other),
+			})
+			p, err := newServiceAccountIDTokenProvider(context.Background(), config, "https://backend.example.com")
+			So(err, ShouldBeNil)
+			_, err = p.MintToken()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "invalid_grant")
+		})
+
+		Convey("Test PKCS8 keys are supported", func() {
+			buf, err := x509.MarshalPKCS8PrivateKey(getTestKey())
+			So(err, ShouldBeNil)
+			parsed, err := parseKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: buf}))
+			So(err, ShouldBeNil)
+			So(parsed.N, ShouldResemble, getTestKey().N)
+		})
+
+		Convey("Test audience is required", func() {
+			_, err := newServiceAccountIDTokenProvider(context.Background(), config, "")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
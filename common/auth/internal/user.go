@@ -20,12 +20,14 @@ type userAuthTokenProvider struct {
 }
 
 // NewUserAuthTokenProvider returns TokenProvider that can perform 3-legged
-// OAuth flow involving interaction with a user.
-func NewUserAuthTokenProvider(ctx context.Context, clientID, clientSecret string, scopes []string) (TokenProvider, error) {
+// OAuth flow involving interaction with a user. If useIDToken is true, the
+// tokens carry ID tokens whose audience is clientID.
+func NewUserAuthTokenProvider(ctx context.Context, clientID, clientSecret string, scopes []string, useIDToken bool) (TokenProvider, error) {
 	return &userAuthTokenProvider{
 		oauthTokenProvider: oauthTokenProvider{
 			interactive: true,
 			tokenFlavor: "user",
+			useIDToken:  useIDToken,
 		},
 		ctx: ctx,
 		config: &oauth2.Config{
@@ -55,7 +57,7 @@ func (p *userAuthTokenProvider) MintToken() (Token, error) {
 	if err != nil {
 		return nil, err
 	}
-	return makeToken(tok), nil
+	return p.makeToken(tok)
 }
 
 func (p *userAuthTokenProvider) RefreshToken(tok Token) (Token, error) {
@@ -68,5 +70,5 @@ func (p *userAuthTokenProvider) RefreshToken(tok Token) (Token, error) {
 	if err != nil {
 		return nil, err
 	}
-	return makeToken(newTok), nil
+	return p.makeToken(newTok)
 }
@@ -0,0 +1,163 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/luci/luci-go/common/auth/internal"
+)
+
+// LocalAuthEnvVar is the environment variable holding the path of the file
+// describing the LocalAuthServer of the parent process. LocalAuthMethod uses
+// it to find the server.
+const LocalAuthEnvVar = "LUCI_LOCAL_AUTH"
+
+// LocalAuthServer serves access tokens to child processes over localhost, so
+// they can call APIs without having credentials on disk.
+//
+// The tokens are minted by Authenticators created with the Options of the
+// server, for the scopes requested by the children. Requests must include a
+// secret generated for each server, which is only available to the processes
+// that can read the file pointed to by Environ.
+type LocalAuthServer struct {
+	opts     Options
+	listener net.Listener
+	secret   string
+	dir      string
+	path     string
+	done     chan struct{}
+
+	lock  sync.Mutex
+	auths map[string]*authenticatorImpl
+}
+
+// StartLocalAuthServer starts a LocalAuthServer on a random port of
+// 127.0.0.1. Close must be called to stop it.
+func StartLocalAuthServer(opts Options) (*LocalAuthServer, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &LocalAuthServer{
+		opts:     opts,
+		listener: l,
+		secret:   hex.EncodeToString(buf),
+		done:     make(chan struct{}),
+		auths:    map[string]*authenticatorImpl{},
+	}
+	if err := s.writeContext(); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(internal.LocalAuthRPCPath, s.getOAuthToken)
+	go func() {
+		defer close(s.done)
+		// Serve returns an error once the listener is closed.
+		_ = http.Serve(l, mux)
+	}()
+	return s, nil
+}
+
+// Environ returns the environment variable to pass to the child processes, as
+// "key=value".
+func (s *LocalAuthServer) Environ() string {
+	return LocalAuthEnvVar + "=" + s.path
+}
+
+// Close stops the server and deletes the file describing it.
+func (s *LocalAuthServer) Close() error {
+	err := s.listener.Close()
+	<-s.done
+	if err2 := os.RemoveAll(s.dir); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// writeContext writes the file describing the server in a new directory only
+// accessible to the current user.
+func (s *LocalAuthServer) writeContext() error {
+	buf, err := json.Marshal(&internal.LocalAuthContext{
+		RPCPort: s.listener.Addr().(*net.TCPAddr).Port,
+		Secret:  s.secret,
+	})
+	if err != nil {
+		return err
+	}
+	if s.dir, err = ioutil.TempDir("", "local_auth"); err != nil {
+		return err
+	}
+	s.path = filepath.Join(s.dir, "local_auth.json")
+	if err = ioutil.WriteFile(s.path, buf, 0600); err != nil {
+		_ = os.RemoveAll(s.dir)
+	}
+	return err
+}
+
+// authenticator returns the Authenticator to use for scopes.
+func (s *LocalAuthServer) authenticator(scopes []string) *authenticatorImpl {
+	sorted := append([]string{}, scopes...)
+	sort.Strings(sorted)
+	key := strings.Join(sorted, "\n")
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	a := s.auths[key]
+	if a == nil {
+		opts := s.opts
+		opts.Scopes = sorted
+		a = NewAuthenticator(opts).(*authenticatorImpl)
+		s.auths[key] = a
+	}
+	return a
+}
+
+func (s *LocalAuthServer) getOAuthToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST expected", http.StatusMethodNotAllowed)
+		return
+	}
+	req := internal.LocalAuthRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(req.Secret), []byte(s.secret)) != 1 {
+		http.Error(w, "invalid secret", http.StatusForbidden)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "no scopes requested", http.StatusBadRequest)
+		return
+	}
+	t, err := s.authenticator(req.Scopes).GetAccessToken(0)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get a token: %s", err), http.StatusInternalServerError)
+		return
+	}
+	out := &internal.LocalAuthResponse{AccessToken: t.AccessToken}
+	if !t.Expiry.IsZero() {
+		out.Expiry = t.Expiry.Unix()
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(out)
+}
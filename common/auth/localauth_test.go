@@ -0,0 +1,175 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/luci/luci-go/common/auth/internal"
+)
+
+func mockLocalAuthEnv(value string) {
+	// os.LookupEnv is not available in Go 1.4.
+	prev, set := "", false
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, LocalAuthEnvVar+"=") {
+			prev, set = kv[len(LocalAuthEnvVar)+1:], true
+		}
+	}
+	So(os.Setenv(LocalAuthEnvVar, value), ShouldBeNil)
+	Reset(func() {
+		if set {
+			So(os.Setenv(LocalAuthEnvVar, prev), ShouldBeNil)
+		} else {
+			So(os.Unsetenv(LocalAuthEnvVar), ShouldBeNil)
+		}
+	})
+}
+
+// get fetches url with client and returns the Authorization header received
+// by the echo server.
+func get(client *http.Client, url string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	return string(buf), err
+}
+
+func TestLocalAuthServer(t *testing.T) {
+	Convey("Given a local auth server", t, func() {
+		tempDir := mockSecretsDir()
+
+		// The parent process mints tokens named after their scopes.
+		var mints int32
+		prev := makeTokenProvider
+		makeTokenProvider = func(opts *Options) (internal.TokenProvider, error) {
+			if opts.Method == LocalAuthMethod {
+				return prev(opts)
+			}
+			return &scopedTokenProvider{scopes: opts.Scopes, mints: &mints}, nil
+		}
+		Reset(func() {
+			makeTokenProvider = prev
+		})
+		server, err := StartLocalAuthServer(Options{Method: ServiceAccountMethod})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			So(server.Close(), ShouldBeNil)
+		})
+		echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, r.Header.Get("Authorization"))
+		}))
+		Reset(echo.Close)
+
+		Convey("Test child processes get tokens for their scopes", func() {
+			kv := strings.SplitN(server.Environ(), "=", 2)
+			So(kv[0], ShouldEqual, LocalAuthEnvVar)
+			mockLocalAuthEnv(kv[1])
+
+			client, err := AuthenticatedClient(SilentLogin, NewAuthenticator(Options{Scopes: []string{"b", "a"}}))
+			So(err, ShouldBeNil)
+			for i := 0; i < 2; i++ {
+				header, err := get(client, echo.URL)
+				So(err, ShouldBeNil)
+				So(header, ShouldEqual, "Bearer a b")
+			}
+			So(atomic.LoadInt32(&mints), ShouldEqual, 1)
+
+			client, err = AuthenticatedClient(SilentLogin, NewAuthenticator(Options{Scopes: []string{"c"}}))
+			So(err, ShouldBeNil)
+			header, err := get(client, echo.URL)
+			So(err, ShouldBeNil)
+			So(header, ShouldEqual, "Bearer c")
+			So(atomic.LoadInt32(&mints), ShouldEqual, 2)
+		})
+
+		Convey("Test invalid secret is rejected", func() {
+			buf, err := ioutil.ReadFile(strings.SplitN(server.Environ(), "=", 2)[1])
+			So(err, ShouldBeNil)
+			lc := internal.LocalAuthContext{}
+			So(json.Unmarshal(buf, &lc), ShouldBeNil)
+			lc.Secret = "bad"
+			buf, err = json.Marshal(&lc)
+			So(err, ShouldBeNil)
+			path := filepath.Join(tempDir, "local_auth.json")
+			So(ioutil.WriteFile(path, buf, 0600), ShouldBeNil)
+			mockLocalAuthEnv(path)
+
+			client, err := AuthenticatedClient(SilentLogin, NewAuthenticator(Options{Method: LocalAuthMethod}))
+			So(err, ShouldBeNil)
+			_, err = get(client, echo.URL)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "403")
+			So(atomic.LoadInt32(&mints), ShouldEqual, 0)
+		})
+
+		Convey("Test Close deletes the context file", func() {
+			other, err := StartLocalAuthServer(Options{})
+			So(err, ShouldBeNil)
+			path := strings.SplitN(other.Environ(), "=", 2)[1]
+			info, err := os.Stat(path)
+			So(err, ShouldBeNil)
+			if runtime.GOOS != "windows" {
+				So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+			}
+			So(other.Close(), ShouldBeNil)
+			_, err = os.Stat(path)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// scopedTokenProvider mints tokens whose value is their space separated
+// scopes.
+type scopedTokenProvider struct {
+	scopes      []string
+	mints       *int32
+	interactive bool
+}
+
+func (p *scopedTokenProvider) RequiresInteraction() bool {
+	return p.interactive
+}
+
+func (p *scopedTokenProvider) MintToken() (internal.Token, error) {
+	atomic.AddInt32(p.mints, 1)
+	return p.UnmarshalToken([]byte(strings.Join(p.scopes, " ")))
+}
+
+func (p *scopedTokenProvider) RefreshToken(internal.Token) (internal.Token, error) {
+	return p.MintToken()
+}
+
+func (p *scopedTokenProvider) MarshalToken(tok internal.Token) ([]byte, error) {
+	t, err := internal.ExtractToken(tok)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(t.AccessToken), nil
+}
+
+func (p *scopedTokenProvider) UnmarshalToken(buf []byte) (internal.Token, error) {
+	return internal.NewToken(&oauth2.Token{AccessToken: string(buf), Expiry: time.Now().Add(time.Hour)}), nil
+}
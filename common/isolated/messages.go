@@ -73,3 +73,20 @@ type StorageRequest struct {
 	UploadTicket string `json:"upload_ticket"`
 	Content      []byte `json:"content"`
 }
+
+// RetrieveRequest is used as input for /retrieve.
+type RetrieveRequest struct {
+	Digest    HexDigest `json:"digest"`
+	Namespace struct {
+		Namespace string `json:"namespace"`
+	} `json:"namespace"`
+	Offset int64 `json:"offset"`
+}
+
+// RetrievedContent is returned by /retrieve.
+//
+// Either Content or URL is set. Content is compressed.
+type RetrievedContent struct {
+	Content []byte `json:"content"`
+	URL     string `json:"url"`
+}